@@ -13,9 +13,24 @@ import (
 
 func main() {
 	l := options.NewLoglet()
-	l.AddFlags()
+	l.AddFlags(kingpin.CommandLine)
 
-	kingpin.Parse()
+	configDump := options.AddCommands(kingpin.CommandLine)
+
+	command := kingpin.Parse()
+
+	err := l.LoadConfigFile(kingpin.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if command == configDump.FullCommand() {
+		err := l.DumpConfig(kingpin.CommandLine, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if l.CpuProfile != "" {
 		f, err := os.Create(l.CpuProfile)
@@ -29,7 +44,7 @@ func main() {
 	log.SetLevel(l.LogLevel)
 	log.Infof("starting")
 
-	err := loglet.Run(l)
+	err = loglet.Run(l)
 	if err != nil {
 		log.Errorf("%s", err)
 		os.Exit(1)
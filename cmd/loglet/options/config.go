@@ -0,0 +1,439 @@
+package options
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Config files hold settings named after flags, in either YAML:
+//
+//	broker: [kafka-1:9092, kafka-2:9092]
+//	topic: logs
+//	include-filter:
+//	  - _SYSTEMD_UNIT =~ "^kube" && PRIORITY <= 4
+//	default-field:
+//	  environment: production
+//	tls:
+//	  ca-file: /etc/kafka/ca.pem
+//
+// or TOML:
+//
+//	broker = ["kafka-1:9092", "kafka-2:9092"]
+//	topic = "logs"
+//	include-filter = ['_SYSTEMD_UNIT =~ "^kube" && PRIORITY <= 4']
+//
+//	[default-field]
+//	environment = "production"
+//
+//	[tls]
+//	ca-file = "/etc/kafka/ca.pem"
+//
+// Settings may be grouped in sections named after the start of their flags,
+// as with tls above, and sections may be nested.
+
+// resetter is implemented by repeatable flag values, so a list from the
+// config file replaces the default rather than adding to it
+type resetter interface {
+	Reset()
+}
+
+// LoadConfigFile applies the settings in the config file, if there is one,
+// to every flag that wasn't set on the command line in args or through its
+// environment variable.
+func (l *Loglet) LoadConfigFile(app *kingpin.Application, args []string) error {
+	l.args = args
+
+	if l.ConfigFile == "" {
+		return nil
+	}
+
+	tree, err := readConfigFile(l.ConfigFile)
+	if err != nil {
+		return err
+	}
+	settings, err := configSettings(tree, func(name string) bool {
+		flag := app.GetFlag(name)
+		if flag == nil {
+			return false
+		}
+		_, ok := flag.Model().Value.(*StringMapValue)
+		return ok
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", l.ConfigFile, err)
+	}
+
+	context, err := app.ParseContext(args)
+	if err != nil {
+		return err
+	}
+	onCommandLine := make(map[string]bool)
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			onCommandLine[flag.Model().Name] = true
+		}
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := settings[name]
+
+		flag := app.GetFlag(name)
+		if flag == nil || name == "config" || name == app.HelpFlag.Model().Name {
+			return fmt.Errorf("%s: unknown setting '%s'", l.ConfigFile, name)
+		}
+		model := flag.Model()
+
+		if onCommandLine[name] || (model.Envar != "" && os.Getenv(model.Envar) != "") {
+			continue
+		}
+
+		r, repeatable := model.Value.(resetter)
+		if repeatable {
+			r.Reset()
+		} else if len(values) != 1 {
+			return fmt.Errorf("%s: setting '%s' takes a single value", l.ConfigFile, name)
+		}
+
+		for _, value := range values {
+			err := model.Value.Set(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid value for '%s': %s", l.ConfigFile, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reload returns the settings with the config file read again. Flags and
+// environment variables still take precedence over it, as they did when
+// first loaded.
+func (l *Loglet) Reload() (*Loglet, error) {
+	app := kingpin.New("loglet", "")
+	reloaded := NewLoglet()
+	reloaded.AddFlags(app)
+	AddCommands(app)
+
+	_, err := app.Parse(l.args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = reloaded.LoadConfigFile(app, l.args)
+	if err != nil {
+		return nil, err
+	}
+
+	return reloaded, nil
+}
+
+// Outputs returns the settings for each output, the main output named
+// default followed by any named outputs in order of name. A named output
+// takes its settings from --named-output, and otherwise from the main
+// output. Repeatable settings take newline separated values, as in
+// environment variables.
+func (l *Loglet) Outputs() ([]*Loglet, error) {
+	settings := make(map[string]map[string]string)
+	for key, value := range l.NamedOutputs {
+		i := strings.Index(key, ".")
+		if i <= 0 || i == len(key)-1 {
+			return nil, fmt.Errorf("invalid named output setting '%s', expected NAME.SETTING", key)
+		}
+		name, setting := key[:i], key[i+1:]
+		if name == "default" {
+			return nil, fmt.Errorf("invalid named output setting '%s', the main output is named default", key)
+		}
+		if settings[name] == nil {
+			settings[name] = make(map[string]string)
+		}
+		settings[name][setting] = value
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	outputs := []*Loglet{l}
+	for _, name := range names {
+		output := *l
+		output.OutputName = name
+		output.NamedOutputs = nil
+
+		app := kingpin.New("loglet", "")
+		output.AddFlags(app)
+
+		for setting, value := range settings[name] {
+			flag := app.GetFlag(setting)
+			if flag == nil || setting == "config" || setting == "named-output" || setting == app.HelpFlag.Model().Name {
+				return nil, fmt.Errorf("output %s: unknown setting '%s'", name, setting)
+			}
+			model := flag.Model()
+
+			values := []string{value}
+			if _, repeatable := model.Value.(resetter); repeatable {
+				values = strings.Split(value, "\n")
+			}
+			for _, value := range values {
+				err := model.Value.Set(value)
+				if err != nil {
+					return nil, fmt.Errorf("output %s: invalid value for '%s': %s", name, setting, err)
+				}
+			}
+		}
+
+		outputs = append(outputs, &output)
+	}
+
+	return outputs, nil
+}
+
+// DumpConfig writes the effective configuration in YAML config file format
+func (l *Loglet) DumpConfig(app *kingpin.Application, w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# effective configuration, from flags, then environment variables, then\n# the config file, then defaults\n")
+	if err != nil {
+		return err
+	}
+
+	var config yaml.MapSlice
+	for _, flag := range app.Model().Flags {
+		if flag.Hidden || flag.Name == "config" || flag.Name == app.HelpFlag.Model().Name {
+			continue
+		}
+
+		var value interface{} = flag.Value.String()
+		if getter, ok := flag.Value.(kingpin.Getter); ok {
+			switch v := getter.Get().(type) {
+			case []string:
+				value = v
+			case map[string]string:
+				value = redactEntries(flag.Name, v)
+			default:
+				value = fmt.Sprint(v)
+			}
+		}
+		if s, ok := value.(string); ok && s != "" && secretFlags[flag.Name] {
+			value = redacted
+		}
+		config = append(config, yaml.MapItem{Key: flag.Name, Value: value})
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// secretFlags are settings holding credentials, whose values config dump
+// leaves out. For KEY=VALUE settings every value is left out.
+var secretFlags = map[string]bool{
+	"sasl-password": true,
+	"output-header": true,
+}
+
+const redacted = "<redacted>"
+
+// redactEntries returns the entries of a KEY=VALUE setting with the values of
+// secrets left out, including secret settings of named outputs
+func redactEntries(name string, entries map[string]string) map[string]string {
+	result := make(map[string]string, len(entries))
+	for key, value := range entries {
+		secret := secretFlags[name]
+		if name == "named-output" {
+			if i := strings.Index(key, "."); i >= 0 {
+				secret = secretFlags[key[i+1:]]
+			}
+		}
+		if secret && value != "" {
+			value = redacted
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// readConfigFile reads a config file into the sections and settings it
+// holds, before they're matched to flags
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %s", err)
+	}
+
+	tree := make(map[string]interface{})
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		// strictly, so settings given twice aren't silently dropped
+		err = yaml.UnmarshalStrict(data, &tree)
+	case ".toml":
+		_, err = toml.Decode(string(data), &tree)
+	default:
+		return nil, fmt.Errorf("%s: unknown config file format, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return tree, nil
+}
+
+// configSettings flattens the sections of a config file into values for
+// each setting, in the form they'd be given as flags. Sections are joined
+// to the names of the settings in them with a dash, so tls.ca-file is the
+// tls-ca-file setting, except for KEY=VALUE settings, whose nested keys are
+// joined with a dot, so named-output.audit.topic is audit.topic=VALUE.
+func configSettings(tree map[string]interface{}, isMap func(name string) bool) (map[string][]string, error) {
+	settings := make(map[string][]string)
+
+	var flatten func(prefix string, section map[string]interface{}) error
+	flatten = func(prefix string, section map[string]interface{}) error {
+		for key, value := range section {
+			name := prefix + key
+
+			var values []string
+			switch v := value.(type) {
+			case map[string]interface{}, map[interface{}]interface{}:
+				if !isMap(name) {
+					err := flatten(name+"-", configMap(v))
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				entries, err := configEntries("", configMap(v))
+				if err != nil {
+					return fmt.Errorf("setting '%s': %s", name, err)
+				}
+				values = entries
+
+			case []interface{}:
+				values = []string{}
+				for _, item := range v {
+					s, err := configScalar(item)
+					if err != nil {
+						return fmt.Errorf("setting '%s': %s", name, err)
+					}
+					values = append(values, s)
+				}
+
+			default:
+				s, err := configScalar(v)
+				if err != nil {
+					return fmt.Errorf("setting '%s': %s", name, err)
+				}
+				values = []string{s}
+			}
+
+			if _, ok := settings[name]; ok {
+				return fmt.Errorf("setting '%s' is given more than once", name)
+			}
+			settings[name] = values
+		}
+		return nil
+	}
+
+	err := flatten("", tree)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// configEntries returns the KEY=VALUE entries of a section, with nested keys
+// joined with a dot and lists as newline separated values
+func configEntries(prefix string, section map[string]interface{}) ([]string, error) {
+	entries := []string{}
+
+	for key, value := range section {
+		key = prefix + key
+
+		switch v := value.(type) {
+		case map[string]interface{}, map[interface{}]interface{}:
+			nested, err := configEntries(key+".", configMap(v))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, nested...)
+
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				s, err := configScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", key, err)
+				}
+				items = append(items, s)
+			}
+			entries = append(entries, key+"="+strings.Join(items, "\n"))
+
+		default:
+			s, err := configScalar(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+			entries = append(entries, key+"="+s)
+		}
+	}
+
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// configMap returns a section as decoded from either format, as YAML
+// decodes nested maps with keys of any type
+func configMap(section interface{}) map[string]interface{} {
+	switch s := section.(type) {
+	case map[string]interface{}:
+		return s
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(s))
+		for key, value := range s {
+			m[fmt.Sprint(key)] = value
+		}
+		return m
+	}
+	return nil
+}
+
+// configScalar returns a single value as it would be given as a flag
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case nil:
+		return "", fmt.Errorf("expected a value")
+	}
+	return "", fmt.Errorf("expected a value, got %v", value)
+}
@@ -0,0 +1,412 @@
+package options
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+const testYAML = `
+# kafka
+broker: [k1:9092, "k2:9092"]
+topic: logs-{{.systemd_unit}} # routed by unit
+retries: 7
+include-filter:
+  - _SYSTEMD_UNIT =~ "^kube" && PRIORITY <= 4
+  - 'has(CONTAINER_NAME)'
+default-field:
+  environment: production
+  "team name": 'o''ps'
+journal-dir:
+- /journal
+`
+
+const testTOML = `
+# kafka
+broker = [
+  "k1:9092",
+  "k2:9092", # trailing comma
+]
+topic = "logs-{{.systemd_unit}}" # routed by unit
+retries = 7
+include-filter = ['_SYSTEMD_UNIT =~ "^kube" && PRIORITY <= 4', "has(CONTAINER_NAME)"]
+journal-dir = ["/journal"]
+
+[default-field]
+environment = "production"
+"team name" = "o'ps"
+`
+
+// parseConfig reads a config file with the given contents into settings,
+// with default-field, named-output and loki-static-label as KEY=VALUE
+// settings
+func parseConfig(t *testing.T, name, contents string) (map[string][]string, error) {
+	dir, err := ioutil.TempDir("", "loglet-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return configSettings(tree, func(name string) bool {
+		return name == "default-field" || name == "named-output" || name == "loki-static-label"
+	})
+}
+
+func TestParseConfig(t *testing.T) {
+	expected := map[string][]string{
+		"broker":         {"k1:9092", "k2:9092"},
+		"topic":          {"logs-{{.systemd_unit}}"},
+		"retries":        {"7"},
+		"include-filter": {`_SYSTEMD_UNIT =~ "^kube" && PRIORITY <= 4`, "has(CONTAINER_NAME)"},
+		"default-field":  {"environment=production", "team name=o'ps"},
+		"journal-dir":    {"/journal"},
+	}
+
+	yaml, err := parseConfig(t, "loglet.yaml", testYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(yaml, expected) {
+		t.Errorf("unexpected settings from YAML: %q", yaml)
+	}
+
+	toml, err := parseConfig(t, "loglet.toml", testTOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(toml, expected) {
+		t.Errorf("unexpected settings from TOML: %q", toml)
+	}
+}
+
+func TestParseConfigSections(t *testing.T) {
+	expected := map[string][]string{
+		"tls":               {"true"},
+		"tls-ca-file":       {"/etc/kafka/ca.pem"},
+		"loki-label":        {"hostname", "systemd_unit"},
+		"loki-static-label": {"job=loglet"},
+		"named-output":      {"audit.broker=a1:9092\na2:9092", "audit.topic=audit"},
+	}
+
+	yaml, err := parseConfig(t, "loglet.yaml", `
+tls: true
+tls-ca-file: /etc/kafka/ca.pem
+loki:
+  label: [hostname, systemd_unit]
+  static:
+    label:
+      job: loglet
+named-output:
+  audit:
+    topic: audit
+    broker: [a1:9092, a2:9092]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(yaml, expected) {
+		t.Errorf("unexpected settings from YAML: %q", yaml)
+	}
+
+	toml, err := parseConfig(t, "loglet.toml", `
+tls = true
+tls-ca-file = "/etc/kafka/ca.pem"
+
+[loki]
+label = ["hostname", "systemd_unit"]
+
+[loki.static.label]
+job = "loglet"
+
+[named-output.audit]
+topic = "audit"
+broker = ["a1:9092", "a2:9092"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(toml, expected) {
+		t.Errorf("unexpected settings from TOML: %q", toml)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, yaml := range []string{
+		"topic",
+		"topic: logs\ntopic: other",
+		"topic: \"logs",
+		"broker: [k1:9092",
+		"topic:",
+		"broker: [[k1:9092]]",
+		"tls-ca-file: a\ntls:\n  ca-file: b",
+	} {
+		_, err := parseConfig(t, "loglet.yaml", yaml)
+		if err == nil {
+			t.Errorf("expected error parsing YAML %q", yaml)
+		}
+	}
+
+	for _, toml := range []string{
+		"topic",
+		"topic = logs",
+		"topic = \"logs\"\ntopic = \"other\"",
+		"broker = [\"k1:9092\"",
+		"[[broker]]\nhost = \"k1\"",
+	} {
+		_, err := parseConfig(t, "loglet.toml", toml)
+		if err == nil {
+			t.Errorf("expected error parsing TOML %q", toml)
+		}
+	}
+}
+
+func testApp() (*kingpin.Application, *Loglet) {
+	app := kingpin.New("loglet", "")
+	l := NewLoglet()
+	l.AddFlags(app)
+	return app, l
+}
+
+func TestLoadConfigFilePrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "loglet.yaml")
+	err = ioutil.WriteFile(config, []byte(testYAML), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("LOGLET_RETRIES", "9")
+	defer os.Unsetenv("LOGLET_RETRIES")
+
+	app, l := testApp()
+	args := []string{"--config", config, "--topic", "from-flag"}
+	_, err = app.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.LoadConfigFile(app, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.KafkaTopic != "from-flag" {
+		t.Error("expected flag to take precedence over config file, topic was", l.KafkaTopic)
+	}
+	if l.Retries != 9 {
+		t.Error("expected environment to take precedence over config file, retries was", l.Retries)
+	}
+	if !reflect.DeepEqual(l.KafkaBrokers, []string{"k1:9092", "k2:9092"}) {
+		t.Error("expected brokers from config file to replace default, was", l.KafkaBrokers)
+	}
+	if !reflect.DeepEqual(l.JournalDirs, []string{"/journal"}) {
+		t.Error("expected journal dirs from config file to replace default, was", l.JournalDirs)
+	}
+	if l.DefaultFields["team name"] != "o'ps" {
+		t.Error("expected default fields from config file, was", l.DefaultFields)
+	}
+	if l.MaxTopics != 100 {
+		t.Error("expected default for setting in neither, max topics was", l.MaxTopics)
+	}
+
+	// repeated flags replace the default rather than adding to it
+	app, l = testApp()
+	_, err = app.Parse([]string{"--journal-dir", "/a", "--journal-dir", "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l.JournalDirs, []string{"/a", "/b"}) {
+		t.Error("expected journal dirs from flags only, was", l.JournalDirs)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range map[string]string{
+		"unknown.yaml":   "not-a-flag: true",
+		"invalid.yaml":   "retries: lots",
+		"enum.toml":      "acks = \"some\"",
+		"multiple.yaml":  "topic: [a, b]",
+		"format.json":    "{}",
+		"recursive.yaml": "config: other.yaml",
+	} {
+		config := filepath.Join(dir, name)
+		err = ioutil.WriteFile(config, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		app, l := testApp()
+		l.ConfigFile = config
+		err = l.LoadConfigFile(app, nil)
+		if err == nil {
+			t.Errorf("expected error loading %s", name)
+		}
+	}
+}
+
+func TestDumpConfigRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app, l := testApp()
+	args := []string{"--topic", "logs-{{.systemd_unit}}", "--include-filter", `PRIORITY <= 3 && MESSAGE =~ "#\\d+"`, "--default-field", "env=prod", "--retries", "5"}
+	_, err = app.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	err = l.DumpConfig(app, &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "dump.yaml")
+	err = ioutil.WriteFile(config, dump.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloadedApp, reloaded := testApp()
+	reloaded.ConfigFile = config
+	err = reloaded.LoadConfigFile(reloadedApp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.ConfigFile = ""
+
+	if !reflect.DeepEqual(l, reloaded) {
+		t.Errorf("expected dumped config to load the same settings\n%s", dump.String())
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "loglet.yaml")
+	err = ioutil.WriteFile(config, []byte(`
+topic: logs
+named-output:
+  audit.topic: audit
+  audit.output-filter: 'systemd_unit =~ "^(sshd|sudo)"'
+  audit.broker: "audit-1:9092\naudit-2:9092"
+  archive.output: file
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, l := testApp()
+	args := []string{"--config", config, "--retries", "5"}
+	_, err = app.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.LoadConfigFile(app, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs, err := l.Outputs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, output := range outputs {
+		names = append(names, output.OutputName)
+	}
+	if !reflect.DeepEqual(names, []string{"default", "archive", "audit"}) {
+		t.Fatal("expected default output then named outputs in order, got", names)
+	}
+
+	archive, audit := outputs[1], outputs[2]
+	if archive.Output != "file" || archive.KafkaTopic != "logs" {
+		t.Error("expected archive output to override output only, got", archive.Output, archive.KafkaTopic)
+	}
+	if audit.KafkaTopic != "audit" || audit.OutputFilter != `systemd_unit =~ "^(sshd|sudo)"` {
+		t.Error("expected audit output settings, got", audit.KafkaTopic, audit.OutputFilter)
+	}
+	if !reflect.DeepEqual(audit.KafkaBrokers, []string{"audit-1:9092", "audit-2:9092"}) {
+		t.Error("expected newline separated brokers, got", audit.KafkaBrokers)
+	}
+	if audit.Retries != 5 || audit.Output != "kafka" {
+		t.Error("expected audit output to inherit settings from the main output")
+	}
+	if l.KafkaTopic != "logs" || !reflect.DeepEqual(l.KafkaBrokers, []string{"localhost:9092"}) {
+		t.Error("expected main output settings to be unchanged, got", l.KafkaTopic, l.KafkaBrokers)
+	}
+
+	for _, setting := range []string{"audit", "default.topic", "audit.config", "audit.nonsense", "audit.retries"} {
+		l := NewLoglet()
+		l.NamedOutputs = map[string]string{setting: "x"}
+		_, err := l.Outputs()
+		if err == nil {
+			t.Error("expected error for named output setting", setting)
+		}
+	}
+}
+
+func TestDumpConfigRedactsSecrets(t *testing.T) {
+	os.Setenv("LOGLET_SASL_PASSWORD", "hunter2")
+	defer os.Unsetenv("LOGLET_SASL_PASSWORD")
+
+	app, l := testApp()
+	_, err := app.Parse([]string{"--sasl-mechanism", "plain", "--sasl-username", "loglet", "--output-header", "Authorization=Bearer s3cret", "--named-output", "audit.sasl-password=t0ps3cret", "--named-output", "audit.topic=audit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.SASLPassword != "hunter2" {
+		t.Fatal("expected password from the environment, was", l.SASLPassword)
+	}
+
+	var dump bytes.Buffer
+	err = l.DumpConfig(app, &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"hunter2", "s3cret", "t0ps3cret"} {
+		if strings.Contains(dump.String(), secret) {
+			t.Errorf("expected %s to be redacted from\n%s", secret, dump.String())
+		}
+	}
+	for _, setting := range []string{"sasl-password: <redacted>", "audit.topic: audit", "sasl-username: loglet"} {
+		if !strings.Contains(dump.String(), setting) {
+			t.Errorf("expected %q in\n%s", setting, dump.String())
+		}
+	}
+}
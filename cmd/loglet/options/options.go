@@ -1,29 +1,113 @@
 package options
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
+// defaultJournalDirs are the directories journald writes persistent and
+// volatile journal files to
+var defaultJournalDirs = []string{"/var/log/journal", "/run/log/journal"}
+
 type Loglet struct {
-	KafkaBrokers    []string
-	KafkaTopic      string
-	CursorFile      string
-	MaxMessageDelay time.Duration
-	MaxMessageSize  int
-	MaxMessageCount int
-	DefaultFields   map[string]string
-	LogLevel        log.Level
-	IncludeFilters  []string
-	ExcludeFilters  []string
+	ConfigFile               string
+	Output                   string
+	OutputFile               string
+	OutputURL                string
+	OutputHeaders            map[string]string
+	OutputTimeout            time.Duration
+	OutputFilter             string
+	OutputEncoder            string
+	NamedOutputs             map[string]string
+	ElasticsearchIndex       string
+	LokiLabels               []string
+	LokiStaticLabels         map[string]string
+	LokiFormat               string
+	KafkaBrokers             []string
+	KafkaTopic               string
+	TopicRoutes              []string
+	FallbackTopic            string
+	MaxTopics                int
+	KafkaKey                 string
+	KeyFields                []string
+	Partitioner              string
+	RequiredAcks             string
+	Compression              string
+	KafkaVersion             string
+	Idempotent               bool
+	Retries                  int
+	RetryBackoff             time.Duration
+	MaxMessageBytes          int
+	TLS                      bool
+	TLSCAFile                string
+	TLSCertFile              string
+	TLSKeyFile               string
+	TLSServerName            string
+	TLSInsecureSkipVerify    bool
+	SASLMechanism            string
+	SASLUsername             string
+	SASLPassword             string
+	CursorFile               string
+	CursorRecovery           string
+	CursorRecoverySince      time.Time
+	JournalReader            string
+	JournalDirs              []string
+	MaxMessageDelay          time.Duration
+	MaxMessageSize           int
+	MaxMessageCount          int
+	SpoolDir                 string
+	SpoolSegmentSize         int64
+	SpoolMaxSize             int64
+	DefaultFields            map[string]string
+	PartialMessages          bool
+	PartialMessageMaxSize    int
+	PartialMessageTimeout    time.Duration
+	MultilineRules           []string
+	MultilineTimeout         time.Duration
+	MultilineMaxLines        int
+	KubernetesMetadata       bool
+	KubernetesMetadataSource string
+	KubernetesURL            string
+	KubernetesTokenFile      string
+	KubernetesCAFile         string
+	KubernetesNodeName       string
+	KubernetesCacheTTL       time.Duration
+	ECSMetadata              bool
+	ECSAgentURL              string
+	ECSRefreshInterval       time.Duration
+	TimestampFormat          string
+	TimestampPrecision       string
+	KeepJournalTimestamps    bool
+	JSONMessage              bool
+	JSONMessageTarget        string
+	JSONMessageConflict      string
+	JSONMessageMaxDepth      int
+	JSONMessageMaxSize       int
+	LogfmtMessage            bool
+	LogfmtPromote            bool
+	GrokRules                []string
+	GrokPatternFiles         []string
+	LogLevel                 log.Level
+	IncludeFilters           []string
+	ExcludeFilters           []string
+	MetricsListen            string
+	DrainTimeout             time.Duration
 
 	// testing/debugging
 	FakeKafka  bool
 	CpuProfile string
 	MemProfile string
+
+	// name of the output the settings are for, see Outputs
+	OutputName string
+
+	// command line the settings were parsed from, for reloading
+	args []string
 }
 
 const (
@@ -32,40 +116,174 @@ const (
 
 func NewLoglet() *Loglet {
 	return &Loglet{
-		KafkaBrokers:    nil,
-		KafkaTopic:      "logs",
-		CursorFile:      "loglet.cursor",
-		MaxMessageDelay: 10 * time.Second,
-		MaxMessageSize:  1 * MB,
-		MaxMessageCount: 2000,
-		DefaultFields:   make(map[string]string),
-		LogLevel:        log.InfoLevel,
+		Output:                   "kafka",
+		OutputHeaders:            make(map[string]string),
+		OutputTimeout:            30 * time.Second,
+		OutputEncoder:            "json",
+		NamedOutputs:             make(map[string]string),
+		ElasticsearchIndex:       `logs-{{date "2006.01.02"}}`,
+		LokiLabels:               []string{"hostname", "systemd_unit"},
+		LokiStaticLabels:         make(map[string]string),
+		LokiFormat:               "protobuf",
+		KafkaBrokers:             []string{"localhost:9092"},
+		KafkaTopic:               "logs",
+		FallbackTopic:            "logs",
+		MaxTopics:                100,
+		Partitioner:              "hash",
+		RequiredAcks:             "local",
+		Compression:              "none",
+		KafkaVersion:             "1.0.0",
+		Retries:                  3,
+		RetryBackoff:             1 * time.Second,
+		MaxMessageBytes:          1000000,
+		SASLMechanism:            "none",
+		CursorFile:               "loglet.cursor",
+		CursorRecovery:           "tail",
+		JournalReader:            "journalctl",
+		JournalDirs:              defaultJournalDirs,
+		MaxMessageDelay:          10 * time.Second,
+		MaxMessageSize:           1 * MB,
+		MaxMessageCount:          2000,
+		SpoolDir:                 "",
+		SpoolSegmentSize:         64 * MB,
+		SpoolMaxSize:             1024 * MB,
+		DefaultFields:            make(map[string]string),
+		PartialMessageMaxSize:    1 * MB,
+		PartialMessageTimeout:    5 * time.Second,
+		MultilineTimeout:         1 * time.Second,
+		MultilineMaxLines:        500,
+		KubernetesMetadataSource: "none",
+		KubernetesCacheTTL:       5 * time.Minute,
+		ECSAgentURL:              "http://localhost:51678",
+		ECSRefreshInterval:       30 * time.Second,
+		TimestampFormat:          "rfc3339",
+		TimestampPrecision:       "ms",
+		JSONMessageConflict:      "journal",
+		JSONMessageMaxDepth:      10,
+		JSONMessageMaxSize:       64 * 1024,
+		LogLevel:                 log.InfoLevel,
+		MetricsListen:            "",
+		DrainTimeout:             20 * time.Second,
 
 		// testing/debugging
 		FakeKafka:  false,
 		CpuProfile: "",
 		MemProfile: "",
+
+		OutputName: "default",
 	}
 }
 
-func (l *Loglet) AddFlags() {
-	kingpin.Flag("broker", "kafka brokers in destination cluster").Default("localhost:9092").StringsVar(&l.KafkaBrokers)
-	kingpin.Flag("topic", "kafka topic to produce messages to").Default(l.KafkaTopic).StringVar(&l.KafkaTopic)
-	kingpin.Flag("cursor-file", "File in which to keep cursor state between runs").Default(l.CursorFile).StringVar(&l.CursorFile)
-	kingpin.Flag("default-field", "Default fields to add to all log entries. Values of fields in messages take precedence").StringMapVar(&l.DefaultFields)
-	kingpin.Flag("log-level", "Log level").Default(l.LogLevel.String()).SetValue(&LogLevelValue{&l.LogLevel})
-	kingpin.Flag("include-filter", "Include entries with a matching key value pair in the fields, combines as OR. Format: Key=Value").StringsVar(&l.IncludeFilters)
-	kingpin.Flag("exclude-filter", "Exclude entries with a matching key value pair in the fields, combines as OR. Format: Key=Value").StringsVar(&l.ExcludeFilters)
+// AddFlags adds flags for every setting to app. Each can also be set through
+// an environment variable named after the flag, e.g. LOGLET_SPOOL_DIR for
+// --spool-dir, or in the config file given by --config. Flags take
+// precedence over environment variables, which take precedence over the
+// config file, which takes precedence over defaults.
+func (l *Loglet) AddFlags(app *kingpin.Application) {
+	flag := func(name, help string) *kingpin.FlagClause {
+		return app.Flag(name, help).Envar(EnvarName(name))
+	}
+
+	flag("config", "Config file in YAML (.yaml, .yml) or TOML (.toml) format, with settings named after flags. See 'config dump' for an example").Default(l.ConfigFile).StringVar(&l.ConfigFile)
+	flag("output", "Where to send messages: kafka, stdout, file (--output-file), http, elasticsearch or loki (--output-url)").Default(l.Output).StringVar(&l.Output)
+	flag("output-file", "File to append messages to, one per line, with --output=file. Reopened when rotated").Default(l.OutputFile).StringVar(&l.OutputFile)
+	flag("output-url", "URL to post batches of messages to, as newline delimited JSON, with --output=http, or of the cluster with --output=elasticsearch or loki").Default(l.OutputURL).StringVar(&l.OutputURL)
+	flag("output-header", "Header to add to requests with --output=http, elasticsearch or loki, e.g. Authorization=\"Bearer ...\"").SetValue(&StringMapValue{target: &l.OutputHeaders})
+	flag("output-timeout", "Timeout for requests with --output=http, elasticsearch or loki").Default(l.OutputTimeout.String()).DurationVar(&l.OutputTimeout)
+	flag("output-filter", "Only send messages matching a filter expression over message fields to the output, e.g. 'systemd_unit =~ \"^(sshd|sudo)\"'").Default(l.OutputFilter).StringVar(&l.OutputFilter)
+	flag("output-encoder", "How to encode messages for the output: json, or text for just the message field").Default(l.OutputEncoder).EnumVar(&l.OutputEncoder, "json", "text")
+	flag("named-output", "Setting for an additional output as NAME.SETTING=VALUE, with settings named after flags, e.g. audit.topic=audit. Messages are sent to every output, and settings not given are the same as for the main output").SetValue(&StringMapValue{target: &l.NamedOutputs})
+	flag("elasticsearch-index", "Index to write messages to with --output=elasticsearch. May be a template over message fields, with date formatting @timestamp using a go time layout").Default(l.ElasticsearchIndex).StringVar(&l.ElasticsearchIndex)
+	flag("loki-label", "Message field to use as a loki stream label with --output=loki. Repeat for each label").Default(l.LokiLabels...).SetValue(&StringsValue{target: &l.LokiLabels})
+	flag("loki-static-label", "Label to add to every loki stream, e.g. job=loglet").SetValue(&StringMapValue{target: &l.LokiStaticLabels})
+	flag("loki-format", "Format of loki push requests: protobuf (snappy compressed) or json").Default(l.LokiFormat).EnumVar(&l.LokiFormat, "protobuf", "json")
+	flag("broker", "kafka brokers in destination cluster").Default(l.KafkaBrokers...).SetValue(&StringsValue{target: &l.KafkaBrokers})
+	flag("topic", "kafka topic to produce messages to. May be a template over message fields, e.g. logs-{{.systemd_unit}}").Default(l.KafkaTopic).StringVar(&l.KafkaTopic)
+	flag("topic-route", "Route messages matching a filter expression over message fields to a topic, e.g. 'systemd_unit =~ \"^kube\" => kubernetes-logs'. The first matching route is used, otherwise --topic").SetValue(&StringsValue{target: &l.TopicRoutes})
+	flag("fallback-topic", "kafka topic for messages whose topic template refers to a missing field, or gives an invalid topic").Default(l.FallbackTopic).StringVar(&l.FallbackTopic)
+	flag("max-topics", "The maximum number of distinct topics to produce to, after which messages go to the fallback topic").Default(strconv.Itoa(l.MaxTopics)).IntVar(&l.MaxTopics)
+	flag("key-field", "Message field to use as the kafka message key, so messages with the same value go to the same partition. Repeat to combine fields, e.g. --key-field=hostname --key-field=systemd_unit").SetValue(&StringsValue{target: &l.KeyFields})
+	flag("key", "Template over message fields for the kafka message key, as an alternative to --key-field, e.g. {{.hostname}}-{{.systemd_unit}}").Default(l.KafkaKey).StringVar(&l.KafkaKey)
+	flag("partitioner", "How to pick the partition for a message: hash of the key, murmur2 hash of the key compatible with the java client, roundrobin, or random").Default(l.Partitioner).EnumVar(&l.Partitioner, "hash", "murmur2", "roundrobin", "random")
+	flag("tls", "Connect to kafka brokers over TLS. Implied by any of the other --tls flags").Default(strconv.FormatBool(l.TLS)).BoolVar(&l.TLS)
+	flag("tls-ca-file", "CA bundle to verify kafka broker certificates with, instead of the system roots. Reloaded when it changes").Default(l.TLSCAFile).StringVar(&l.TLSCAFile)
+	flag("tls-cert-file", "Client certificate to authenticate to kafka brokers with. Reloaded when it changes").Default(l.TLSCertFile).StringVar(&l.TLSCertFile)
+	flag("tls-key-file", "Key for --tls-cert-file. Reloaded when it changes").Default(l.TLSKeyFile).StringVar(&l.TLSKeyFile)
+	flag("tls-server-name", "Server name to verify kafka broker certificates against, instead of the broker's host").Default(l.TLSServerName).StringVar(&l.TLSServerName)
+	flag("tls-insecure-skip-verify", "Don't verify kafka broker certificates. For testing only").Default(strconv.FormatBool(l.TLSInsecureSkipVerify)).BoolVar(&l.TLSInsecureSkipVerify)
+	flag("sasl-mechanism", "SASL mechanism to authenticate to kafka brokers with: none, plain, scram-sha-256 or scram-sha-512. Use with --tls, as plain sends the password as is").Default(l.SASLMechanism).EnumVar(&l.SASLMechanism, "none", "plain", "scram-sha-256", "scram-sha-512")
+	flag("sasl-username", "Username to authenticate to kafka brokers with, with --sasl-mechanism").Default(l.SASLUsername).StringVar(&l.SASLUsername)
+	flag("sasl-password", "Password for --sasl-username. Better given as "+EnvarName("sasl-password")+" than on the command line").Default(l.SASLPassword).StringVar(&l.SASLPassword)
+	flag("cursor-file", "File in which to keep cursor state between runs").Default(l.CursorFile).StringVar(&l.CursorFile)
+	flag("cursor-recovery", "Where to start reading the journal if the cursor file is corrupt: head, tail, or since --cursor-recovery-since").Default(l.CursorRecovery).EnumVar(&l.CursorRecovery, "head", "tail", "since")
+	flag("cursor-recovery-since", "Time to start reading the journal from with --cursor-recovery=since, in RFC3339 format").SetValue(&TimeValue{&l.CursorRecoverySince})
+	flag("journal-reader", "How to read the journal: through journalctl, or native to read journal files directly").Default(l.JournalReader).EnumVar(&l.JournalReader, "journalctl", "native")
+	flag("journal-dir", "Directory containing journal files, used by the native journal reader").Default(l.JournalDirs...).SetValue(&StringsValue{target: &l.JournalDirs})
+	flag("partial-messages", "Join the pieces docker's journald log driver splits long lines into, marked with CONTAINER_PARTIAL_MESSAGE, back into single entries").Default(strconv.FormatBool(l.PartialMessages)).BoolVar(&l.PartialMessages)
+	flag("partial-message-max-size", "The largest message to join from pieces, in bytes, after which what there is so far is sent on its own").Default(strconv.Itoa(l.PartialMessageMaxSize)).IntVar(&l.PartialMessageMaxSize)
+	flag("partial-message-timeout", "How long to wait for the rest of a message split into pieces before sending what there is so far. Later entries are held back until then").Default(l.PartialMessageTimeout.String()).DurationVar(&l.PartialMessageTimeout)
+	flag("multiline", "Join events logged over several lines, like stack traces, with a pattern for lines starting an event or continuing one, optionally only for entries matching a filter expression, e.g. '_SYSTEMD_UNIT == \"app.service\" => continue:^(\\s|Caused by:)'. Lines are joined per container or systemd unit, and the first matching rule is used").SetValue(&StringsValue{target: &l.MultilineRules})
+	flag("multiline-timeout", "How long to wait for more lines of an event before sending it. Later entries are held back until then").Default(l.MultilineTimeout.String()).DurationVar(&l.MultilineTimeout)
+	flag("multiline-max-lines", "The most lines to join into one event, after which the event is sent and the next line starts another").Default(strconv.Itoa(l.MultilineMaxLines)).IntVar(&l.MultilineMaxLines)
+	flag("kubernetes-metadata", "Add the kubernetes namespace, pod and container to entries from containers started by the kubelet, parsed from CONTAINER_NAME, as kubernetes_namespace, kubernetes_pod and kubernetes_container fields").Default(strconv.FormatBool(l.KubernetesMetadata)).BoolVar(&l.KubernetesMetadata)
+	flag("kubernetes-metadata-source", "Where to fetch pod labels and annotations from with --kubernetes-metadata: none, api, or kubelet for its /pods").Default(l.KubernetesMetadataSource).EnumVar(&l.KubernetesMetadataSource, "none", "api", "kubelet")
+	flag("kubernetes-url", "URL of the kubernetes API or kubelet. Defaults to the API from inside the cluster, or the kubelet's read only port").Default(l.KubernetesURL).StringVar(&l.KubernetesURL)
+	flag("kubernetes-token-file", "File with a bearer token for the kubernetes API or kubelet. Defaults to the service account's inside the cluster").Default(l.KubernetesTokenFile).StringVar(&l.KubernetesTokenFile)
+	flag("kubernetes-ca-file", "CA certificates to verify the kubernetes API or kubelet with. Defaults to the service account's inside the cluster").Default(l.KubernetesCAFile).StringVar(&l.KubernetesCAFile)
+	flag("kubernetes-node-name", "Node whose pods to watch for changes to labels and annotations. Defaults to the hostname").Default(l.KubernetesNodeName).StringVar(&l.KubernetesNodeName)
+	flag("kubernetes-cache-ttl", "How long to cache pod labels and annotations").Default(l.KubernetesCacheTTL.String()).DurationVar(&l.KubernetesCacheTTL)
+	flag("ecs-metadata", "Add the ECS cluster, task and container to entries from containers started by the ECS agent, looked up by CONTAINER_ID").Default(strconv.FormatBool(l.ECSMetadata)).BoolVar(&l.ECSMetadata)
+	flag("ecs-agent-url", "URL of the ECS agent's introspection API").Default(l.ECSAgentURL).StringVar(&l.ECSAgentURL)
+	flag("ecs-refresh-interval", "How often to refresh tasks from the ECS agent, at least 5s").Default(l.ECSRefreshInterval.String()).DurationVar(&l.ECSRefreshInterval)
+	flag("timestamp-format", "Format of @timestamp: rfc3339, epoch for a number since the epoch, or a go time layout, e.g. '2006-01-02 15:04:05.000'. Taken from _SOURCE_REALTIME_TIMESTAMP if the entry has one, otherwise when the journal received it").Default(l.TimestampFormat).StringVar(&l.TimestampFormat)
+	flag("timestamp-precision", "Precision of @timestamp with --timestamp-format=rfc3339 or epoch: ms, us or ns").Default(l.TimestampPrecision).EnumVar(&l.TimestampPrecision, "ms", "us", "ns")
+	flag("keep-journal-timestamps", "Keep the source_realtime_timestamp, monotonic_timestamp and source_monotonic_timestamp fields of entries, in microseconds, alongside realtime_timestamp").Default(strconv.FormatBool(l.KeepJournalTimestamps)).BoolVar(&l.KeepJournalTimestamps)
+	flag("json-message", "Parse messages that are JSON objects into fields").Default(strconv.FormatBool(l.JSONMessage)).BoolVar(&l.JSONMessage)
+	flag("json-message-target", "Field to put fields parsed from JSON messages under, rather than merging them into the message").Default(l.JSONMessageTarget).StringVar(&l.JSONMessageTarget)
+	flag("json-message-conflict", "Which value to keep when a field parsed from a JSON message is already in the journal entry: journal or payload").Default(l.JSONMessageConflict).EnumVar(&l.JSONMessageConflict, "journal", "payload")
+	flag("json-message-max-depth", "How deeply fields parsed from JSON messages can be nested, deeper values are kept as JSON strings").Default(strconv.Itoa(l.JSONMessageMaxDepth)).IntVar(&l.JSONMessageMaxDepth)
+	flag("json-message-max-size", "The largest JSON message to parse, in bytes").Default(strconv.Itoa(l.JSONMessageMaxSize)).IntVar(&l.JSONMessageMaxSize)
+	flag("logfmt-message", "Parse messages of key=value pairs, like those logrus writes, into fields").Default(strconv.FormatBool(l.LogfmtMessage)).BoolVar(&l.LogfmtMessage)
+	flag("logfmt-promote", "Replace messages parsed with --logfmt-message with their msg field, and their level with the level field").Default(strconv.FormatBool(l.LogfmtPromote)).BoolVar(&l.LogfmtPromote)
+	flag("grok", "Extract fields from messages with a grok pattern, optionally only for messages matching a filter expression, e.g. 'systemd_unit == \"nginx.service\" => %{NGINXACCESS}'. The first matching pattern is used").SetValue(&StringsValue{target: &l.GrokRules})
+	flag("grok-patterns-file", "File of additional grok patterns, one per line as NAME PATTERN").SetValue(&StringsValue{target: &l.GrokPatternFiles})
+	flag("default-field", "Default fields to add to all log entries. Values of fields in messages take precedence").SetValue(&StringMapValue{target: &l.DefaultFields})
+	flag("log-level", "Log level").Default(l.LogLevel.String()).SetValue(&LogLevelValue{&l.LogLevel})
+	flag("include-filter", "Include entries matching a filter expression, e.g. '_SYSTEMD_UNIT =~ \"^kube.*\" && PRIORITY <= 4 && !has(CONTAINER_NAME)'. Combines as OR.").SetValue(&StringsValue{target: &l.IncludeFilters})
+	flag("exclude-filter", "Exclude entries matching a filter expression, same format as --include-filter. Combines as OR.").SetValue(&StringsValue{target: &l.ExcludeFilters})
+	flag("metrics-listen", "Address on which to serve prometheus metrics at /metrics, e.g. :9100. Disabled if not set.").Default(l.MetricsListen).StringVar(&l.MetricsListen)
+	flag("drain-timeout", "How long to wait on shutdown for entries already read from the journal to be published, before committing the cursor and exiting.").Default(l.DrainTimeout.String()).DurationVar(&l.DrainTimeout)
 
-	// TODO: might resurrect these if switching to AsyncProducer
-	// kingpin.Flag("max-message-delay", "The maximum time to buffer messages before sending to ES.").Default(l.MaxMessageDelay.String()).DurationVar(&l.MaxMessageDelay)
-	// kingpin.Flag("max-message-size", "The maximum size (soft limit) of a single message payload sent to ES.").Default(strconv.Itoa(l.MaxMessageSize)).IntVar(&l.MaxMessageSize)
-	// kingpin.Flag("max-message-count", "The maximum number of messages to buffer before sending to ES.").Default(strconv.Itoa(l.MaxMessageCount)).IntVar(&l.MaxMessageCount)
+	flag("max-message-delay", "The maximum time to buffer messages before sending a batch to kafka.").Default(l.MaxMessageDelay.String()).DurationVar(&l.MaxMessageDelay)
+	flag("max-message-size", "The maximum size (soft limit) of a batch of messages sent to kafka.").Default(strconv.Itoa(l.MaxMessageSize)).IntVar(&l.MaxMessageSize)
+	flag("max-message-count", "The maximum number of messages to buffer before sending a batch to kafka.").Default(strconv.Itoa(l.MaxMessageCount)).IntVar(&l.MaxMessageCount)
+	flag("max-message-bytes", "The maximum size of a single message sent to kafka. Should be no larger than the broker's message.max.bytes.").Default(strconv.Itoa(l.MaxMessageBytes)).IntVar(&l.MaxMessageBytes)
+	flag("acks", "Acknowledgements kafka must give before a message counts as published: none, local (the partition leader) or all (all in-sync replicas).").Default(l.RequiredAcks).EnumVar(&l.RequiredAcks, "none", "local", "all")
+	flag("compression", "Compression for batches of messages sent to kafka: none, gzip, snappy, lz4 or zstd (kafka 2.1.0 and later).").Default(l.Compression).EnumVar(&l.Compression, "none", "gzip", "snappy", "lz4", "zstd")
+	flag("kafka-version", "Oldest version of kafka the brokers run, e.g. 2.1.0, which decides the protocol features used").Default(l.KafkaVersion).StringVar(&l.KafkaVersion)
+	flag("idempotent", "Have kafka drop duplicates of messages retried by the producer. Needs --acks=all and kafka 0.11.0 or later, and allows only one request in flight to each broker").Default(strconv.FormatBool(l.Idempotent)).BoolVar(&l.Idempotent)
+	flag("retries", "The number of times the kafka producer retries sending a message before it is handed back to be retried later.").Default(strconv.Itoa(l.Retries)).IntVar(&l.Retries)
+	flag("retry-backoff", "How long the kafka producer waits for the cluster to settle between retries.").Default(l.RetryBackoff.String()).DurationVar(&l.RetryBackoff)
+	flag("spool-dir", "Directory in which to spool messages that can't be sent to kafka straight away. Spooling is disabled if not set.").Default(l.SpoolDir).StringVar(&l.SpoolDir)
+	flag("spool-segment-size", "The size at which to start a new spool segment file.").Default(strconv.FormatInt(l.SpoolSegmentSize, 10)).Int64Var(&l.SpoolSegmentSize)
+	flag("spool-max-size", "The maximum size of the spool, after which reading from the journal is paused.").Default(strconv.FormatInt(l.SpoolMaxSize, 10)).Int64Var(&l.SpoolMaxSize)
 
 	// hiden testing/debugging flags
-	kingpin.Flag("fake-kafka", "").Hidden().Default(strconv.FormatBool(l.FakeKafka)).BoolVar(&l.FakeKafka)
-	kingpin.Flag("cpu-profile", "").Hidden().Default(l.CpuProfile).StringVar(&l.CpuProfile)
-	kingpin.Flag("mem-profile", "").Hidden().Default(l.MemProfile).StringVar(&l.MemProfile)
+	flag("fake-kafka", "").Hidden().Default(strconv.FormatBool(l.FakeKafka)).BoolVar(&l.FakeKafka)
+	flag("cpu-profile", "").Hidden().Default(l.CpuProfile).StringVar(&l.CpuProfile)
+	flag("mem-profile", "").Hidden().Default(l.MemProfile).StringVar(&l.MemProfile)
+}
+
+// AddCommands adds loglet's commands to app, returning the command for
+// dumping the configuration
+func AddCommands(app *kingpin.Application) *kingpin.CmdClause {
+	app.Command("run", "Read the journal and publish entries to kafka.").Default()
+	return app.Command("config", "Configuration commands.").Command("dump", "Print the effective configuration in config file format.")
+}
+
+// TLSEnabled returns whether to connect to kafka over TLS
+func (l *Loglet) TLSEnabled() bool {
+	return l.TLS || l.TLSCAFile != "" || l.TLSCertFile != "" || l.TLSKeyFile != "" || l.TLSServerName != "" || l.TLSInsecureSkipVerify
 }
 
 type LogLevelValue struct {
@@ -84,3 +302,102 @@ func (l *LogLevelValue) Set(s string) error {
 	*l.target = level
 	return nil
 }
+
+type TimeValue struct {
+	target *time.Time
+}
+
+func (t *TimeValue) String() string {
+	if t.target.IsZero() {
+		return ""
+	}
+	return t.target.Format(time.RFC3339)
+}
+
+func (t *TimeValue) Set(s string) error {
+	if s == "" {
+		*t.target = time.Time{}
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	*t.target = parsed
+	return nil
+}
+
+// StringsValue is a repeatable flag whose values replace the default, or any
+// value from the config file, rather than adding to them
+type StringsValue struct {
+	target *[]string
+	set    bool
+}
+
+func (s *StringsValue) String() string {
+	return strings.Join(*s.target, ",")
+}
+
+func (s *StringsValue) Set(value string) error {
+	if !s.set {
+		*s.target = nil
+		s.set = true
+	}
+	*s.target = append(*s.target, value)
+	return nil
+}
+
+func (s *StringsValue) Get() interface{} {
+	return *s.target
+}
+
+func (s *StringsValue) IsCumulative() bool {
+	return true
+}
+
+// Reset clears the value so the next value set replaces it
+func (s *StringsValue) Reset() {
+	s.set = false
+}
+
+// StringMapValue is a repeatable KEY=VALUE flag whose values replace the
+// default, or any value from the config file, rather than adding to them
+type StringMapValue struct {
+	target *map[string]string
+	set    bool
+}
+
+func (s *StringMapValue) String() string {
+	return fmt.Sprintf("%s", *s.target)
+}
+
+func (s *StringMapValue) Set(value string) error {
+	i := strings.IndexAny(value, "=:")
+	if i < 0 {
+		return fmt.Errorf("expected KEY=VALUE got '%s'", value)
+	}
+	if !s.set {
+		*s.target = make(map[string]string)
+		s.set = true
+	}
+	(*s.target)[value[:i]] = value[i+1:]
+	return nil
+}
+
+func (s *StringMapValue) Get() interface{} {
+	return *s.target
+}
+
+func (s *StringMapValue) IsCumulative() bool {
+	return true
+}
+
+// Reset clears the value so the next value set replaces it
+func (s *StringMapValue) Reset() {
+	s.set = false
+}
+
+// EnvarName returns the environment variable that can be used to set a flag
+func EnvarName(flag string) string {
+	return "LOGLET_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
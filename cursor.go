@@ -4,22 +4,41 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/journal"
 )
 
 type CursorState interface {
 	Cursor() (string, error)
 	Commit(cursor string) error
+	Close() error
 }
 
 type cursorState struct {
 	filename string
+	lock     *os.File
 }
 
-func NewCursorState(filename string) CursorState {
+// NewCursorState takes an exclusive lock on the cursor file, so that two
+// instances can't share one. The lock is held until Close.
+func NewCursorState(filename string) (CursorState, error) {
+	// the cursor file itself is replaced on every commit, so the lock is
+	// taken on a file alongside it
+	lock, err := lockFile(filename + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
 	return &cursorState{
 		filename: filename,
-	}
+		lock:     lock,
+	}, nil
 }
 
 func (s *cursorState) Cursor() (string, error) {
@@ -31,15 +50,96 @@ func (s *cursorState) Cursor() (string, error) {
 
 		return "", err
 	}
-	return string(bytes), nil
+	return strings.TrimSpace(string(bytes)), nil
 }
 
+// Commit replaces the cursor file atomically, so a crash can't leave a
+// partially written cursor behind
 func (s *cursorState) Commit(cursor string) error {
-	err := ioutil.WriteFile(s.filename, []byte(cursor), 0644)
+	tmp := s.filename + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(cursor)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, s.filename)
+	if err != nil {
+		return err
+	}
+
+	// make the rename itself durable
+	dir, err := os.Open(filepath.Dir(s.filename))
 	if err != nil {
 		return err
 	}
-	return nil
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func (s *cursorState) Close() error {
+	return unlockFile(s.lock)
+}
+
+// StartPosition is where to start reading the journal
+type StartPosition struct {
+	// Cursor of the last entry already read, reading continues after it
+	Cursor string
+	// Head starts at the oldest entry in the journal, if there's no cursor
+	Head bool
+	// Since starts at the first entry at or after the time, if there's no
+	// cursor
+	Since time.Time
+}
+
+func (p StartPosition) String() string {
+	switch {
+	case p.Cursor != "":
+		return fmt.Sprintf("cursor %s", p.Cursor)
+	case p.Head:
+		return "head"
+	case !p.Since.IsZero():
+		return fmt.Sprintf("entries since %s", p.Since.Format(time.RFC3339))
+	}
+	return "tail"
+}
+
+// startPosition continues from the committed cursor, or if it's corrupt
+// falls back to the configured recovery policy rather than failing
+func startPosition(loglet *options.Loglet, cursor string) StartPosition {
+	if cursor == "" {
+		return StartPosition{}
+	}
+
+	_, err := journal.ParseCursor(cursor)
+	if err == nil {
+		return StartPosition{Cursor: cursor}
+	}
+
+	var position StartPosition
+	switch loglet.CursorRecovery {
+	case "head":
+		position.Head = true
+	case "since":
+		position.Since = loglet.CursorRecoverySince
+	}
+
+	log.Warnf("cursor: ignoring corrupt cursor in %s, starting from %s: %s", loglet.CursorFile, position, err)
+
+	return position
 }
 
 type CursorCommitter interface {
@@ -70,28 +170,53 @@ func (c *cursorCommitter) Ret() <-chan error {
 func (c *cursorCommitter) loop(cursors <-chan string, done <-chan struct{}) {
 	defer close(c.ret)
 
-	var lastPublishedCursor string
+	var lastPublishedCursor, lastCommittedCursor string
+
+	commit := func() error {
+		if lastPublishedCursor == lastCommittedCursor {
+			return nil
+		}
+
+		err := c.state.Commit(lastPublishedCursor)
+		if err != nil {
+			return fmt.Errorf("committer: unable to commit cursor state: %v", err)
+		}
+		lastCommittedCursor = lastPublishedCursor
+		recordCommit(lastCommittedCursor)
+
+		return nil
+	}
 
 	timer := time.NewTicker(5 * time.Second)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-done:
+			// everything up to the last published cursor is in kafka, so
+			// it's safe to commit even when stopping early
+			err := commit()
+			if err != nil {
+				c.ret <- err
+			}
 			return
 
 		case cursor, ok := <-cursors:
 			if !ok {
+				err := commit()
+				if err != nil {
+					c.ret <- err
+				}
 				return
 			}
 			lastPublishedCursor = cursor
 
 		case <-timer.C:
-			err := c.state.Commit(lastPublishedCursor)
+			err := commit()
 			if err != nil {
-				c.ret <- fmt.Errorf("committer: unable to commit cursor state: %v", err)
+				c.ret <- err
 				return
 			}
 		}
 	}
-
 }
@@ -0,0 +1,175 @@
+package loglet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+type memoryCursorState struct {
+	commits []string
+}
+
+func (s *memoryCursorState) Cursor() (string, error) {
+	return "", nil
+}
+
+func (s *memoryCursorState) Commit(cursor string) error {
+	s.commits = append(s.commits, cursor)
+	return nil
+}
+
+func (s *memoryCursorState) Close() error {
+	return nil
+}
+
+func TestCursorCommitterCommitsLastCursorOnClose(t *testing.T) {
+	state := &memoryCursorState{}
+	cursors := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+
+	committer := NewCursorCommitter(state, cursors, done)
+	cursors <- "a"
+	cursors <- "b"
+	close(cursors)
+
+	for err := range committer.Ret() {
+		t.Error("unexpected error:", err)
+	}
+
+	if len(state.commits) != 1 || state.commits[0] != "b" {
+		t.Error("expected a single commit of b, was", state.commits)
+	}
+}
+
+func TestCursorCommitterCommitsLastCursorWhenDone(t *testing.T) {
+	state := &memoryCursorState{}
+	cursors := make(chan string)
+	done := make(chan struct{})
+
+	committer := NewCursorCommitter(state, cursors, done)
+	cursors <- "a"
+	close(done)
+
+	for err := range committer.Ret() {
+		t.Error("unexpected error:", err)
+	}
+
+	if len(state.commits) != 1 || state.commits[0] != "a" {
+		t.Error("expected a single commit of a, was", state.commits)
+	}
+}
+
+func TestCursorCommitterDoesNotCommitEmptyCursor(t *testing.T) {
+	state := &memoryCursorState{}
+	cursors := make(chan string)
+	done := make(chan struct{})
+
+	committer := NewCursorCommitter(state, cursors, done)
+	close(done)
+
+	for err := range committer.Ret() {
+		t.Error("unexpected error:", err)
+	}
+
+	if len(state.commits) != 0 {
+		t.Error("expected nothing to be committed before a cursor was published, was", state.commits)
+	}
+}
+
+func TestCursorStateCommitReplacesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-cursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "loglet.cursor")
+	state, err := NewCursorState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	for _, cursor := range []string{"a much longer cursor", "short"} {
+		err := state.Commit(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := state.Cursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != cursor {
+			t.Errorf("expected cursor %s, read %s", cursor, read)
+		}
+	}
+
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Error("expected temporary file to be gone after commit")
+	}
+}
+
+func TestCursorStateIsLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-cursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "loglet.cursor")
+	state, err := NewCursorState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewCursorState(filename)
+	if err == nil {
+		t.Error("expected second cursor state on the same file to fail")
+	}
+
+	state.Close()
+
+	state, err = NewCursorState(filename)
+	if err != nil {
+		t.Error("expected cursor state to be available after closing, got", err)
+	} else {
+		state.Close()
+	}
+}
+
+func TestStartPositionRecoversFromCorruptCursor(t *testing.T) {
+	valid := "s=bbe71afbfc214be7aeffec29714c893d;i=1;b=6a8280c8ae924ebf9bab8cd91cd2de93;m=46224d6c;t=65e0384520007;x=c31620b2a5193a82"
+	since := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	loglet := options.NewLoglet()
+
+	if p := startPosition(loglet, ""); p != (StartPosition{}) {
+		t.Error("expected tail without a cursor, was", p)
+	}
+	if p := startPosition(loglet, valid); p.Cursor != valid {
+		t.Error("expected valid cursor to be used, was", p)
+	}
+
+	corrupt := valid[:40]
+	if p := startPosition(loglet, corrupt); p != (StartPosition{}) {
+		t.Error("expected tail for corrupt cursor by default, was", p)
+	}
+
+	loglet.CursorRecovery = "head"
+	if p := startPosition(loglet, corrupt); !p.Head || p.Cursor != "" {
+		t.Error("expected head for corrupt cursor, was", p)
+	}
+
+	loglet.CursorRecovery = "since"
+	loglet.CursorRecoverySince = since
+	if p := startPosition(loglet, corrupt); !p.Since.Equal(since) || p.Cursor != "" {
+		t.Error("expected entries since a time for corrupt cursor, was", p)
+	}
+}
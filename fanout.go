@@ -0,0 +1,346 @@
+package loglet
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/filters"
+	"github.com/uswitch/loglet/types"
+)
+
+// fanOut sends messages to several outputs, each publishing the cursors of
+// the messages it has delivered. A cursor is only published once every
+// output has delivered the message, and all messages before it, so
+// committing it never loses messages for any output.
+type fanOut struct {
+	outputs   []*fanOutput
+	ret       chan error
+	rets      <-chan error
+	published chan string
+}
+
+type fanOutput struct {
+	name      string
+	filter    filters.Expr
+	encoder   string
+	msgs      chan *EncodedMessage
+	publisher Publisher
+	// named outputs route messages with their own settings, while the main
+	// output uses the routing done by the transformer
+	router *topicRouter
+	keyer  *messageKeyer
+	// messages sent to the output that it hasn't published yet
+	sent []sentMessage
+}
+
+type sentMessage struct {
+	seq    uint64
+	cursor string
+}
+
+type outputAck struct {
+	output int
+	cursor string
+}
+
+// NewOutputs creates the publisher for the main output, or one that fans
+// out to every output if there are named outputs or the main output
+// filters or encodes messages
+func NewOutputs(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error) {
+	settings, err := loglet.Outputs()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(settings) == 1 && loglet.OutputFilter == "" && loglet.OutputEncoder == "json" {
+		return NewPublisher(loglet, msgs, done)
+	}
+
+	var outputs []*fanOutput
+	for _, s := range settings {
+		output, err := newFanOutput(s, done)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+
+	return newFanOut(outputs, msgs, done), nil
+}
+
+func newFanOutput(loglet *options.Loglet, done <-chan struct{}) (*fanOutput, error) {
+	output := &fanOutput{
+		name:    loglet.OutputName,
+		encoder: loglet.OutputEncoder,
+		msgs:    make(chan *EncodedMessage),
+	}
+
+	if loglet.OutputFilter != "" {
+		filter, err := filters.Compile(loglet.OutputFilter)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: invalid filter: %s", output.name, err)
+		}
+		output.filter = filter
+	}
+
+	if output.name != "default" {
+		router, err := newTopicRouter(loglet)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %s", output.name, err)
+		}
+		keyer, err := newMessageKeyer(loglet)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %s", output.name, err)
+		}
+		output.router, output.keyer = router, keyer
+	}
+
+	publisher, err := NewPublisher(loglet, output.msgs, done)
+	if err != nil {
+		return nil, fmt.Errorf("output %s: %s", output.name, err)
+	}
+	output.publisher = publisher
+
+	return output, nil
+}
+
+func newFanOut(outputs []*fanOutput, msgs <-chan *EncodedMessage, done <-chan struct{}) Publisher {
+	f := &fanOut{
+		outputs:   outputs,
+		ret:       make(chan error),
+		published: make(chan string),
+	}
+
+	rets := []<-chan error{f.ret}
+	for _, output := range outputs {
+		rets = append(rets, output.publisher.Ret())
+	}
+	f.rets = merge(rets...)
+
+	go f.loop(msgs, done)
+
+	return f
+}
+
+// Ret returns errors from every output as well as the fan out itself
+func (f *fanOut) Ret() <-chan error {
+	return f.rets
+}
+
+func (f *fanOut) Published() <-chan string {
+	return f.published
+}
+
+// forwardAcks collects the cursors published by every output
+func (f *fanOut) forwardAcks(done <-chan struct{}) <-chan outputAck {
+	var wg sync.WaitGroup
+	acks := make(chan outputAck)
+
+	wg.Add(len(f.outputs))
+	for i, output := range f.outputs {
+		go func(i int, published <-chan string) {
+			defer wg.Done()
+			for cursor := range published {
+				select {
+				case <-done:
+					return
+				case acks <- outputAck{i, cursor}:
+				}
+			}
+		}(i, output.publisher.Published())
+	}
+
+	go func() {
+		wg.Wait()
+		close(acks)
+	}()
+
+	return acks
+}
+
+func (f *fanOut) loop(msgs <-chan *EncodedMessage, done <-chan struct{}) {
+	defer close(f.ret)
+	defer close(f.published)
+
+	closeOutputs := func() {
+		for _, output := range f.outputs {
+			close(output.msgs)
+		}
+	}
+
+	var (
+		acks = f.forwardAcks(done)
+		// outputs that have yet to publish each message
+		queue     = newAckQueue()
+		remaining = make(map[uint64]int)
+
+		// the message being sent, and the outputs it's still to be sent to
+		seq     uint64
+		next    []*EncodedMessage
+		targets []int
+
+		// published is only non-nil when there is a cursor to publish
+		published chan<- string
+		cursor    string
+	)
+
+	ack := func(seq uint64) {
+		if c, ok := queue.ack(seq); ok {
+			cursor = c
+			published = f.published
+		}
+	}
+
+	for {
+		// once every output has drained, return after the last cursor has
+		// been published
+		if acks == nil && published == nil {
+			return
+		}
+
+		var (
+			in  <-chan *EncodedMessage
+			out chan<- *EncodedMessage
+		)
+		if len(targets) > 0 {
+			out = f.outputs[targets[0]].msgs
+		} else if msgs != nil {
+			in = msgs
+		}
+
+		var m *EncodedMessage
+		if out != nil {
+			m = next[0]
+		}
+
+		select {
+		case <-done:
+			return
+
+		case m, ok := <-in:
+			if !ok {
+				msgs = nil
+				closeOutputs()
+				continue
+			}
+			seq = queue.add(m.Cursor)
+			next, targets = f.route(m)
+			if len(targets) == 0 {
+				ack(seq)
+			} else {
+				remaining[seq] = len(targets)
+			}
+
+		case out <- m:
+			output := f.outputs[targets[0]]
+			output.sent = append(output.sent, sentMessage{seq, m.Cursor})
+			next, targets = next[1:], targets[1:]
+
+		case a, ok := <-acks:
+			if !ok {
+				acks = nil
+				continue
+			}
+			for _, seq := range f.outputs[a.output].acked(a.cursor) {
+				remaining[seq]--
+				if remaining[seq] == 0 {
+					delete(remaining, seq)
+					ack(seq)
+				}
+			}
+
+		case published <- cursor:
+			published = nil
+		}
+	}
+}
+
+// route picks the outputs a message goes to, along with the message to
+// send each of them
+func (f *fanOut) route(m *EncodedMessage) ([]*EncodedMessage, []int) {
+	var (
+		msgs    []*EncodedMessage
+		targets []int
+
+		// decoded only if an output needs the message's fields
+		message *types.LogMessage
+		fields  map[string]string
+	)
+
+	for i, output := range f.outputs {
+		if output.filter == nil && output.router == nil && output.encoder == "json" {
+			msgs = append(msgs, m)
+			targets = append(targets, i)
+			continue
+		}
+
+		if message == nil {
+			decoded, err := decodeMessage(m)
+			if err != nil {
+				log.Warnf("outputs: unable to decode message %s: %s", m.Cursor, err)
+				decoded = make(map[string]interface{})
+			}
+			message = &types.LogMessage{Fields: decoded}
+			fields = message.StringFields()
+		}
+
+		if output.filter != nil && !output.filter.Match(fields) {
+			outputMessagesFiltered.WithLabelValues(output.name).Inc()
+			continue
+		}
+
+		encoded := m
+		if output.router != nil || output.encoder != "json" {
+			copied := *m
+			encoded = &copied
+		}
+		if output.router != nil {
+			encoded.Topic = output.router.route(message)
+			encoded.Key = output.keyer.key(message)
+		}
+		if output.encoder == "text" {
+			encoded.Message = textMessage(m, fields)
+		}
+
+		msgs = append(msgs, encoded)
+		targets = append(targets, i)
+	}
+
+	return msgs, targets
+}
+
+// textMessage is the message field of a message, or the whole message if it
+// hasn't got one
+func textMessage(m *EncodedMessage, fields map[string]string) []byte {
+	if text, ok := fields["message"]; ok {
+		return []byte(text)
+	}
+	return m.Message
+}
+
+// acked removes messages up to the one with the given cursor, which the
+// output has published, returning their sequence numbers
+func (o *fanOutput) acked(cursor string) []uint64 {
+	n := -1
+	for i, sent := range o.sent {
+		if sent.cursor == cursor {
+			n = i
+			break
+		}
+	}
+	if n < 0 {
+		log.Warnf("outputs: %s published unknown cursor %s", o.name, cursor)
+		return nil
+	}
+
+	seqs := make([]uint64, n+1)
+	for i, sent := range o.sent[:n+1] {
+		seqs[i] = sent.seq
+	}
+	o.sent = o.sent[n+1:]
+
+	return seqs
+}
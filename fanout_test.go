@@ -0,0 +1,163 @@
+package loglet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/filters"
+)
+
+// gatedSender records batches, sending each only once the gate allows it
+type gatedSender struct {
+	gate     chan struct{}
+	messages chan string
+}
+
+func (s *gatedSender) send(batch []*EncodedMessage) error {
+	<-s.gate
+	for _, m := range batch {
+		s.messages <- m.Cursor + " " + string(m.Message)
+	}
+	return nil
+}
+
+func (s *gatedSender) close() error {
+	return nil
+}
+
+func testFanOutput(t *testing.T, name string, settings map[string]string, sender batchSender, done <-chan struct{}) *fanOutput {
+	loglet := options.NewLoglet()
+	loglet.OutputName = name
+	for k, v := range settings {
+		switch k {
+		case "output-filter":
+			loglet.OutputFilter = v
+		case "output-encoder":
+			loglet.OutputEncoder = v
+		case "topic":
+			loglet.KafkaTopic = v
+		}
+	}
+
+	output := &fanOutput{
+		name:    name,
+		encoder: loglet.OutputEncoder,
+		msgs:    make(chan *EncodedMessage),
+	}
+	if name != "default" {
+		output.router, _ = newTopicRouter(loglet)
+		output.keyer, _ = newMessageKeyer(loglet)
+	}
+	if loglet.OutputFilter != "" {
+		filter, err := filters.Compile(loglet.OutputFilter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output.filter = filter
+	}
+	output.publisher = newBatchPublisher(batchOptions{name: name, count: 1}, sender, output.msgs, done)
+	return output
+}
+
+func TestFanOutCommitsMinimumCursor(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	main := &gatedSender{gate: make(chan struct{}), messages: make(chan string, 10)}
+	audit := &gatedSender{gate: make(chan struct{}), messages: make(chan string, 10)}
+	close(main.gate)
+
+	outputs := []*fanOutput{
+		testFanOutput(t, "default", nil, main, done),
+		testFanOutput(t, "audit", map[string]string{
+			"output-filter":  `systemd_unit == "sshd.service"`,
+			"output-encoder": "text",
+			"topic":          "audit",
+		}, audit, done),
+	}
+
+	msgs := make(chan *EncodedMessage)
+	publisher := newFanOut(outputs, msgs, done)
+
+	go func() {
+		msgs <- &EncodedMessage{Cursor: "c1", Message: []byte(`{"systemd_unit":"web.service","message":"a"}`)}
+		msgs <- &EncodedMessage{Cursor: "c2", Message: []byte(`{"systemd_unit":"sshd.service","message":"b"}`)}
+		msgs <- &EncodedMessage{Cursor: "c3", Message: []byte(`{"systemd_unit":"web.service","message":"c"}`)}
+		close(msgs)
+	}()
+
+	var mainMessages []string
+	for i := 0; i < 3; i++ {
+		mainMessages = append(mainMessages, <-main.messages)
+	}
+
+	// c1 isn't for the audit output, but c2 is and hasn't been sent yet
+	select {
+	case cursor := <-publisher.Published():
+		if cursor != "c1" {
+			t.Errorf("published %s before the audit output delivered c2", cursor)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected c1 to be published")
+	}
+	select {
+	case cursor := <-publisher.Published():
+		t.Errorf("published %s before the audit output delivered c2", cursor)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(audit.gate)
+
+	var published []string
+	for cursor := range publisher.Published() {
+		published = append(published, cursor)
+	}
+	if len(published) == 0 || published[len(published)-1] != "c3" {
+		t.Errorf("expected c3 to be published last, got %v", published)
+	}
+
+	expected := []string{
+		`c1 {"systemd_unit":"web.service","message":"a"}`,
+		`c2 {"systemd_unit":"sshd.service","message":"b"}`,
+		`c3 {"systemd_unit":"web.service","message":"c"}`,
+	}
+	if !reflect.DeepEqual(mainMessages, expected) {
+		t.Errorf("expected main output to get %q, got %q", expected, mainMessages)
+	}
+	if m := <-audit.messages; m != "c2 b" {
+		t.Errorf("expected audit output to get the text of c2, got %q", m)
+	}
+}
+
+func TestFanOutRoute(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	outputs := []*fanOutput{
+		testFanOutput(t, "default", nil, &recordingSender{}, done),
+		testFanOutput(t, "audit", map[string]string{
+			"output-filter": `systemd_unit == "sshd.service"`,
+			"topic":         "audit-{{.hostname}}",
+		}, &recordingSender{}, done),
+	}
+	f := &fanOut{outputs: outputs}
+
+	m := &EncodedMessage{Cursor: "c1", Topic: "logs", Message: []byte(`{"systemd_unit":"sshd.service","hostname":"a"}`)}
+	msgs, targets := f.route(m)
+	if !reflect.DeepEqual(targets, []int{0, 1}) {
+		t.Fatalf("expected message to go to both outputs, got %v", targets)
+	}
+	if msgs[0] != m {
+		t.Errorf("expected main output to get the message unchanged")
+	}
+	if msgs[1].Topic != "audit-a" || m.Topic != "logs" {
+		t.Errorf("expected audit output to route to audit-a, got %s", msgs[1].Topic)
+	}
+
+	_, targets = f.route(&EncodedMessage{Cursor: "c2", Message: []byte(`{"systemd_unit":"web.service"}`)})
+	if !reflect.DeepEqual(targets, []int{0}) {
+		t.Errorf("expected message to only go to the main output, got %v", targets)
+	}
+}
@@ -1,44 +1,46 @@
 package loglet
 
 import (
-	"fmt"
-	"regexp"
-	"strings"
+	"sync"
 
 	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/filters"
 )
 
 type JournalEntryFilter interface {
 	Ret() <-chan error
 	Entries() <-chan *JournalEntry
+	// Reload replaces the filters, keeping the current ones if the new
+	// ones are invalid
+	Reload(loglet *options.Loglet) error
 }
 
 type journalEntryFilter struct {
-	ret            chan error
-	entries        chan *JournalEntry
-	includeFilters []map[string]string
-	excludeFilters []map[string]string
+	ret     chan error
+	entries chan *JournalEntry
+
+	mu    sync.Mutex
+	rules *filterRules
+}
+
+type filterRules struct {
+	include []filters.Expr
+	exclude []filters.Expr
 }
 
 func NewJournalEntryFilter(loglet *options.Loglet, unfilteredEntries <-chan *JournalEntry, done <-chan struct{}) (JournalEntryFilter, error) {
 	ret := make(chan error, 2)
-	filteredEntries := make(chan *JournalEntry)
+	filteredEntries := make(chan *JournalEntry, stageBuffer)
 
-	includeFilters, err := parseFilters(loglet.IncludeFilters)
-	if err != nil {
-		return nil, err
-	}
-
-	excludeFilters, err := parseFilters(loglet.ExcludeFilters)
+	rules, err := newFilterRules(loglet)
 	if err != nil {
 		return nil, err
 	}
 
 	filter := &journalEntryFilter{
-		ret:            ret,
-		entries:        filteredEntries,
-		includeFilters: includeFilters,
-		excludeFilters: excludeFilters,
+		ret:     ret,
+		entries: filteredEntries,
+		rules:   rules,
 	}
 
 	go filter.start(unfilteredEntries, done)
@@ -54,6 +56,25 @@ func (j *journalEntryFilter) Entries() <-chan *JournalEntry {
 	return j.entries
 }
 
+func (j *journalEntryFilter) Reload(loglet *options.Loglet) error {
+	rules, err := newFilterRules(loglet)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.rules = rules
+	j.mu.Unlock()
+
+	return nil
+}
+
+func (j *journalEntryFilter) currentRules() *filterRules {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.rules
+}
+
 func (j *journalEntryFilter) start(unfilteredEntries <-chan *JournalEntry, done <-chan struct{}) {
 	defer close(j.ret)
 	defer close(j.entries)
@@ -70,12 +91,19 @@ func (j *journalEntryFilter) start(unfilteredEntries <-chan *JournalEntry, done
 			}
 		}
 
+		rules := j.currentRules()
+
 		// if there are any include filters then an entry has to match at least one,
 		// however there need to be exclude filters before a match will exclude a message
-		included := len(j.includeFilters) == 0 || matchesFilters(j.includeFilters, entry.Fields)
-		excluded := len(j.excludeFilters) > 0 && matchesFilters(j.excludeFilters, entry.Fields)
-
-		if included && !excluded {
+		included := len(rules.include) == 0 || matchesFilters(rules.include, entry.Fields)
+		excluded := len(rules.exclude) > 0 && matchesFilters(rules.exclude, entry.Fields)
+
+		switch {
+		case !included:
+			includeDropped.Inc()
+		case excluded:
+			excludeDropped.Inc()
+		default:
 			select {
 			case <-done:
 				return
@@ -86,45 +114,37 @@ func (j *journalEntryFilter) start(unfilteredEntries <-chan *JournalEntry, done
 	}
 }
 
-var filterRe = regexp.MustCompile("^([^=]+)=([^=]+)$")
+func newFilterRules(loglet *options.Loglet) (*filterRules, error) {
+	include, err := parseFilters(loglet.IncludeFilters)
+	if err != nil {
+		return nil, err
+	}
 
-func parseFilters(rawFilters []string) ([]map[string]string, error) {
-	orFilters := []map[string]string{}
+	exclude, err := parseFilters(loglet.ExcludeFilters)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, rawFilter := range rawFilters {
-		andFilters := make(map[string]string)
+	return &filterRules{include, exclude}, nil
+}
 
-		for _, rawAndFilter := range strings.Split(rawFilter, ",") {
-			matches := filterRe.FindStringSubmatch(rawAndFilter)
+func parseFilters(rawFilters []string) ([]filters.Expr, error) {
+	var exprs []filters.Expr
 
-			if len(matches) == 0 {
-				return nil, fmt.Errorf("'%s' doesn't match expected pattern Key=Value", rawAndFilter)
-			} else {
-				andFilters[matches[1]] = matches[2]
-			}
+	for _, rawFilter := range rawFilters {
+		expr, err := filters.Compile(rawFilter)
+		if err != nil {
+			return nil, err
 		}
-
-		orFilters = append(orFilters, andFilters)
+		exprs = append(exprs, expr)
 	}
 
-	return orFilters, nil
+	return exprs, nil
 }
 
-func matchesFilters(orFilters []map[string]string, fields map[string]string) bool {
-
-	for _, andFilters := range orFilters {
-		matched := true
-
-		for k, filterValue := range andFilters {
-			fieldValue, ok := fields[k]
-
-			if !ok || fieldValue != filterValue {
-				matched = false
-				break
-			}
-		}
-
-		if matched {
+func matchesFilters(exprs []filters.Expr, fields map[string]string) bool {
+	for _, expr := range exprs {
+		if expr.Match(fields) {
 			return true
 		}
 	}
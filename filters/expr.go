@@ -0,0 +1,145 @@
+package filters
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// Expr is a compiled filter expression
+type Expr interface {
+	// Match reports whether the journal entry fields match the expression
+	Match(fields map[string]string) bool
+}
+
+type and struct {
+	left, right Expr
+}
+
+func (e *and) Match(fields map[string]string) bool {
+	return e.left.Match(fields) && e.right.Match(fields)
+}
+
+type or struct {
+	left, right Expr
+}
+
+func (e *or) Match(fields map[string]string) bool {
+	return e.left.Match(fields) || e.right.Match(fields)
+}
+
+type not struct {
+	expr Expr
+}
+
+func (e *not) Match(fields map[string]string) bool {
+	return !e.expr.Match(fields)
+}
+
+type has struct {
+	field string
+}
+
+func (e *has) Match(fields map[string]string) bool {
+	_, ok := fields[e.field]
+	return ok
+}
+
+type value struct {
+	s       string
+	n       float64
+	numeric bool
+}
+
+// compareTo returns -1, 0 or 1 as s is less than, equal to or greater than
+// the value. Numeric values compare numerically, and don't compare at all to
+// strings that aren't numbers.
+func (v value) compareTo(s string) (int, bool) {
+	if !v.numeric {
+		switch {
+		case s < v.s:
+			return -1, true
+		case s > v.s:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case n < v.n:
+		return -1, true
+	case n > v.n:
+		return 1, true
+	}
+	return 0, true
+}
+
+type compare struct {
+	field string
+	op    string
+	value value
+}
+
+func (e *compare) Match(fields map[string]string) bool {
+	s, ok := fields[e.field]
+	if !ok {
+		return false
+	}
+
+	c, ok := e.value.compareTo(s)
+	if !ok {
+		return false
+	}
+
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type match struct {
+	field  string
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (e *match) Match(fields map[string]string) bool {
+	s, ok := fields[e.field]
+	if !ok {
+		return false
+	}
+	return e.re.MatchString(s) != e.negate
+}
+
+type in struct {
+	field  string
+	values []value
+}
+
+func (e *in) Match(fields map[string]string) bool {
+	s, ok := fields[e.field]
+	if !ok {
+		return false
+	}
+
+	for _, v := range e.values {
+		if c, ok := v.compareTo(s); ok && c == 0 {
+			return true
+		}
+	}
+	return false
+}
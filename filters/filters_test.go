@@ -0,0 +1,110 @@
+package filters
+
+import (
+	"strings"
+	"testing"
+)
+
+var entry = map[string]string{
+	"_SYSTEMD_UNIT":     "kubelet.service",
+	"PRIORITY":          "4",
+	"MESSAGE":           "Liveness probe failed",
+	"SYSLOG_IDENTIFIER": "kubelet",
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`_SYSTEMD_UNIT =~ "^kube.*" && PRIORITY <= 4 && !has(CONTAINER_NAME)`, true},
+		{`_SYSTEMD_UNIT == "kubelet.service"`, true},
+		{`_SYSTEMD_UNIT != "kubelet.service"`, false},
+		{`_SYSTEMD_UNIT !~ "^docker"`, true},
+		{"MESSAGE =~ `probe\\s+failed$`", true},
+		{`PRIORITY < 4`, false},
+		{`PRIORITY >= 4.0`, true},
+		{`PRIORITY == 4`, true},
+		{`PRIORITY > 3 && PRIORITY < 5`, true},
+		{`SYSLOG_IDENTIFIER > 3`, false},
+		{`has(MESSAGE)`, true},
+		{`!has(MESSAGE)`, false},
+		{`CONTAINER_NAME == "x"`, false},
+		{`CONTAINER_NAME != "x"`, false},
+		{`PRIORITY in [0, 1, 2, 3]`, false},
+		{`PRIORITY in [3, 4]`, true},
+		{`SYSLOG_IDENTIFIER in ["dockerd", "kubelet"]`, true},
+		{`!(PRIORITY in [3, 4])`, false},
+		{`PRIORITY == 7 || SYSLOG_IDENTIFIER == "kubelet"`, true},
+		{`PRIORITY == 7 || SYSLOG_IDENTIFIER == "kubelet" && PRIORITY == 3`, false},
+		{`(PRIORITY == 7 || SYSLOG_IDENTIFIER == "kubelet") && PRIORITY == 4`, true},
+		{`!!has(PRIORITY)`, true},
+		{`_SYSTEMD_UNIT=~"^kube"`, true},
+		{`_SYSTEMD_UNIT=~"^docker"`, false},
+		{`_SYSTEMD_UNIT!="kubelet.service"`, false},
+		{`_SYSTEMD_UNIT!="docker.service"`, true},
+		{`PRIORITY=="4"`, true},
+
+		// original format
+		{`SYSLOG_IDENTIFIER=kubelet`, true},
+		{`SYSLOG_IDENTIFIER=kubelet,PRIORITY=4`, true},
+		{`SYSLOG_IDENTIFIER=kubelet,PRIORITY=3`, false},
+		{`_SYSTEMD_UNIT=kubelet.service`, true},
+	}
+
+	for _, test := range tests {
+		expr, err := Compile(test.expr)
+		if err != nil {
+			t.Errorf("unexpected error compiling %s: %s", test.expr, err)
+			continue
+		}
+		if expr.Match(entry) != test.expected {
+			t.Errorf("expected %s to be %v", test.expr, test.expected)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{`PRIORITY <= && has(MESSAGE)`, 12, "expected a number"},
+		{`PRIORITY < "4"`, 11, "expected a number"},
+		{`MESSAGE =~ "("`, 11, "invalid regular expression"},
+		{`(PRIORITY == 4`, 14, "expected ')'"},
+		{`PRIORITY == 4)`, 13, "unexpected ')'"},
+		{`MESSAGE = "x" && PRIORITY == 4`, 8, "use '=='"},
+		// not the original format when combined with other expressions
+		{`PRIORITY=4 || has(X)`, 8, "use '=='"},
+		{`PRIORITY=4,SYSLOG_IDENTIFIER=kubelet && has(X)`, 8, "use '=='"},
+		{`MESSAGE == "x`, 11, "unterminated string"},
+		{`MESSAGE == x`, 11, "expected a string or number"},
+		{`PRIORITY in [1, 2`, 17, "expected ',' or ']'"},
+		{`has(1)`, 4, "expected a field name"},
+		{`PRIORITY`, 8, "expected an operator"},
+		{`&& PRIORITY == 4`, 0, "expected a field name"},
+		{``, 0, "expected a field name"},
+	}
+
+	for _, test := range tests {
+		_, err := Compile(test.expr)
+		if err == nil {
+			t.Errorf("expected error compiling %s", test.expr)
+			continue
+		}
+
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("expected *Error compiling %s, was %T", test.expr, err)
+			continue
+		}
+		if e.Pos != test.pos || !strings.Contains(e.Msg, test.msg) {
+			t.Errorf("expected '%s' at %d compiling %s, was: %s", test.msg, test.pos, test.expr, err)
+		}
+		if e.Expr != test.expr {
+			t.Errorf("expected error to include expression %s, was %s", test.expr, e.Expr)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package filters
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// operators, longest first so that e.g. <= isn't read as <
+var operators = []string{"==", "!=", "=~", "!~", "<=", ">=", "<", ">"}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+
+	for pos := 0; pos < len(src); {
+		c := src[pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", pos})
+			pos++
+			continue
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", pos})
+			pos++
+			continue
+		case c == '[':
+			tokens = append(tokens, token{tokenLBracket, "[", pos})
+			pos++
+			continue
+		case c == ']':
+			tokens = append(tokens, token{tokenRBracket, "]", pos})
+			pos++
+			continue
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", pos})
+			pos++
+			continue
+
+		case strings.HasPrefix(src[pos:], "&&"):
+			tokens = append(tokens, token{tokenAnd, "&&", pos})
+			pos += 2
+			continue
+		case strings.HasPrefix(src[pos:], "||"):
+			tokens = append(tokens, token{tokenOr, "||", pos})
+			pos += 2
+			continue
+
+		case c == '"' || c == '`':
+			end, err := scanString(src, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, src[pos:end], pos})
+			pos = end
+			continue
+
+		case isDigit(c) || (c == '-' && pos+1 < len(src) && isDigit(src[pos+1])):
+			end := pos + 1
+			for end < len(src) && (isDigit(src[end]) || src[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{tokenNumber, src[pos:end], pos})
+			pos = end
+			continue
+
+		case isIdentStart(c):
+			end := pos + 1
+			for end < len(src) && isIdentPart(src[end]) {
+				end++
+			}
+			tokens = append(tokens, token{tokenIdent, src[pos:end], pos})
+			pos = end
+			continue
+		}
+
+		op := ""
+		for _, o := range operators {
+			if strings.HasPrefix(src[pos:], o) {
+				op = o
+				break
+			}
+		}
+		switch {
+		case op != "":
+			tokens = append(tokens, token{tokenOp, op, pos})
+			pos += len(op)
+		case c == '!':
+			tokens = append(tokens, token{tokenNot, "!", pos})
+			pos++
+		case c == '=':
+			return nil, &Error{Pos: pos, Msg: "unexpected '=', use '==' to compare"}
+		default:
+			return nil, &Error{Pos: pos, Msg: fmt.Sprintf("unexpected character '%c'", c)}
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "", len(src)}), nil
+}
+
+// scanString returns the end of the quoted string starting at pos
+func scanString(src string, pos int) (int, error) {
+	quote := src[pos]
+	for end := pos + 1; end < len(src); end++ {
+		switch src[end] {
+		case quote:
+			return end + 1, nil
+		case '\\':
+			if quote == '"' {
+				end++
+			}
+		}
+	}
+	return 0, &Error{Pos: pos, Msg: "unterminated string"}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
@@ -0,0 +1,293 @@
+package filters
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Error is a problem compiling an expression, at a position in it
+type Error struct {
+	Expr string
+	// byte offset of the problem in Expr
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d in filter '%s'", e.Msg, e.Pos+1, e.Expr)
+}
+
+// legacyRe matches the original Key=Value filter format, where a comma
+// separated list of pairs must all match. Values can't contain whitespace,
+// quotes or the characters of operators, so FIELD=~"re" and anything
+// combining a pair with other expressions is left for the expression
+// grammar.
+var legacyRe = regexp.MustCompile("^([A-Za-z0-9_]+)=([^\\s=~!<>&|()\\[\\]\"'`]+)$")
+
+// Compile parses a filter expression, e.g.
+//
+//	_SYSTEMD_UNIT =~ "^kube.*" && PRIORITY <= 4 && !has(CONTAINER_NAME)
+//
+// Fields can be compared with ==, !=, <, <=, > and >= against strings or
+// numbers, matched against regular expressions with =~ and !~, and checked
+// against a list of values with in [...]. has(FIELD) checks that a field
+// exists. Comparisons against a field that doesn't exist are false.
+// Expressions combine with &&, || and !, and group with parentheses.
+//
+// Filters in the original Key=Value,Key=Value format are still accepted.
+func Compile(src string) (Expr, error) {
+	if expr, ok := compileLegacy(src); ok {
+		return expr, nil
+	}
+
+	expr, err := compile(src)
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			e.Expr = src
+		}
+		return nil, err
+	}
+
+	return expr, nil
+}
+
+func compileLegacy(src string) (Expr, bool) {
+	var expr Expr
+
+	for _, pair := range strings.Split(src, ",") {
+		matches := legacyRe.FindStringSubmatch(pair)
+		if matches == nil {
+			return nil, false
+		}
+
+		e := &compare{field: matches[1], op: "==", value: value{s: matches[2]}}
+		if expr == nil {
+			expr = e
+		} else {
+			expr = &and{expr, e}
+		}
+	}
+
+	return expr, true
+}
+
+func compile(src string) (Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+
+	return expr, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &Error{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.errorf(t, "expected %s, found %s", what, t)
+	}
+	return t, nil
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &or{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokenAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &and{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &not{expr}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokenRParen, "')'")
+		if err != nil {
+			return nil, err
+		}
+		return expr, nil
+
+	case tokenIdent:
+		if t.text == "has" && p.peek().kind == tokenLParen {
+			p.next()
+			field, err := p.expect(tokenIdent, "a field name")
+			if err != nil {
+				return nil, err
+			}
+			_, err = p.expect(tokenRParen, "')'")
+			if err != nil {
+				return nil, err
+			}
+			return &has{field.text}, nil
+		}
+		return p.parseComparison(t)
+	}
+
+	return nil, p.errorf(t, "expected a field name, '!' or '(', found %s", t)
+}
+
+func (p *parser) parseComparison(field token) (Expr, error) {
+	t := p.next()
+
+	if t.kind == tokenIdent && t.text == "in" {
+		return p.parseIn(field)
+	}
+	if t.kind != tokenOp {
+		return nil, p.errorf(t, "expected an operator after '%s', found %s", field.text, t)
+	}
+
+	valueToken := p.next()
+
+	switch t.text {
+	case "=~", "!~":
+		if valueToken.kind != tokenString {
+			return nil, p.errorf(valueToken, "expected a regular expression string after '%s', found %s", t.text, valueToken)
+		}
+		pattern, err := strconv.Unquote(valueToken.text)
+		if err != nil {
+			return nil, p.errorf(valueToken, "invalid string %s", valueToken)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, p.errorf(valueToken, "invalid regular expression: %s", err)
+		}
+		return &match{field: field.text, re: re, negate: t.text == "!~"}, nil
+
+	case "<", "<=", ">", ">=":
+		if valueToken.kind != tokenNumber {
+			return nil, p.errorf(valueToken, "expected a number after '%s', found %s", t.text, valueToken)
+		}
+	}
+
+	v, err := p.parseValue(valueToken, t.text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compare{field: field.text, op: t.text, value: v}, nil
+}
+
+func (p *parser) parseIn(field token) (Expr, error) {
+	_, err := p.expect(tokenLBracket, "'[' to start a list")
+	if err != nil {
+		return nil, err
+	}
+
+	var values []value
+	for {
+		v, err := p.parseValue(p.next(), "in")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		t := p.next()
+		if t.kind == tokenRBracket {
+			break
+		}
+		if t.kind != tokenComma {
+			return nil, p.errorf(t, "expected ',' or ']', found %s", t)
+		}
+	}
+
+	return &in{field: field.text, values: values}, nil
+}
+
+func (p *parser) parseValue(t token, after string) (value, error) {
+	switch t.kind {
+	case tokenString:
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			return value{}, p.errorf(t, "invalid string %s", t)
+		}
+		return value{s: s}, nil
+
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return value{}, p.errorf(t, "invalid number %s", t)
+		}
+		return value{s: t.text, n: n, numeric: true}, nil
+	}
+
+	return value{}, p.errorf(t, "expected a string or number after '%s', found %s", after, t)
+}
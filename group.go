@@ -0,0 +1,174 @@
+package loglet
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// entryGroups holds entries being joined into one, by key, along with the
+// entries read after them. Entries are sent in journal order of their
+// cursors, and nothing read after the first entry of a group is sent before
+// the group, so cursors are only committed once everything before them has
+// been published.
+type entryGroups struct {
+	timeout time.Duration
+
+	// position of the next entry read
+	next   uint64
+	groups map[string]*entryGroup
+	// entries ready to be sent, by position
+	ready []readyEntry
+}
+
+type entryGroup struct {
+	key     string
+	first   uint64
+	last    uint64
+	started time.Time
+	lines   []string
+	size    int
+	// the first entry added, whose timestamps the joined entry has
+	firstEntry *JournalEntry
+	// the last entry added, whose cursor and other fields the joined entry
+	// has
+	entry *JournalEntry
+	// the multiline rule the group started with, which decides which
+	// entries continue it
+	rule *multilineRule
+}
+
+type readyEntry struct {
+	position uint64
+	entry    *JournalEntry
+}
+
+func newEntryGroups(timeout time.Duration) *entryGroups {
+	return &entryGroups{
+		timeout: timeout,
+		groups:  make(map[string]*entryGroup),
+	}
+}
+
+// run reads entries until there are no more, passing each to add with its
+// position, and passing groups that have been waiting longer than the
+// timeout to expire. Everything still held is sent once there are no more
+// entries, including groups passed to expire.
+func (g *entryGroups) run(in <-chan *JournalEntry, out chan<- *JournalEntry, done <-chan struct{}, add func(uint64, *JournalEntry), expire func(*entryGroup)) {
+	for {
+		var send chan<- *JournalEntry
+		var head *JournalEntry
+		if g.canSend() {
+			send = out
+			head = g.ready[0].entry
+		}
+
+		var expired <-chan time.Time
+		if oldest := g.oldest(); oldest != nil {
+			expired = time.After(time.Until(oldest.started.Add(g.timeout)))
+		}
+
+		select {
+		case <-done:
+			return
+		case send <- head:
+			g.ready = g.ready[1:]
+		case <-expired:
+			expire(g.oldest())
+		case entry := <-in:
+			if entry == nil {
+				g.drain(out, done, expire)
+				return
+			}
+			position := g.next
+			g.next++
+			add(position, entry)
+		}
+	}
+}
+
+func (g *entryGroups) drain(out chan<- *JournalEntry, done <-chan struct{}, expire func(*entryGroup)) {
+	for oldest := g.oldest(); oldest != nil; oldest = g.oldest() {
+		expire(oldest)
+	}
+
+	for _, ready := range g.ready {
+		select {
+		case <-done:
+			return
+		case out <- ready.entry:
+		}
+	}
+	g.ready = nil
+}
+
+func (g *entryGroups) get(key string) (*entryGroup, bool) {
+	group, ok := g.groups[key]
+	return group, ok
+}
+
+// add adds an entry to the group for key, starting one if there isn't one
+func (g *entryGroups) add(key string, position uint64, entry *JournalEntry) *entryGroup {
+	line := entry.Fields[journalMessageField]
+
+	group, ok := g.groups[key]
+	if !ok {
+		group = &entryGroup{key: key, first: position, started: time.Now(), firstEntry: entry}
+		g.groups[key] = group
+	}
+	group.last = position
+	group.lines = append(group.lines, line)
+	group.size += len(line)
+	group.entry = entry
+
+	return group
+}
+
+// remove stops holding a group, returning the fields of its last entry with
+// the timestamps of its first, so the joined entry is dated from when it
+// started being logged, and the messages of all of them joined with sep
+func (g *entryGroups) remove(group *entryGroup, sep string) map[string]string {
+	delete(g.groups, group.key)
+
+	fields := make(map[string]string, len(group.entry.Fields))
+	for k, v := range group.entry.Fields {
+		fields[k] = v
+	}
+	for _, k := range journalTimestampFields {
+		if v, ok := group.firstEntry.Fields[k]; ok {
+			fields[k] = v
+		} else {
+			delete(fields, k)
+		}
+	}
+	fields[journalMessageField] = strings.Join(group.lines, sep)
+	return fields
+}
+
+// send queues an entry in journal order. Only groups sent before they're
+// complete can come before entries already queued.
+func (g *entryGroups) send(position uint64, entry *JournalEntry) {
+	i := sort.Search(len(g.ready), func(i int) bool { return g.ready[i].position > position })
+	g.ready = append(g.ready, readyEntry{})
+	copy(g.ready[i+1:], g.ready[i:])
+	g.ready[i] = readyEntry{position, entry}
+}
+
+// canSend is whether the next queued entry comes before every group
+func (g *entryGroups) canSend() bool {
+	if len(g.ready) == 0 {
+		return false
+	}
+	oldest := g.oldest()
+	return oldest == nil || g.ready[0].position < oldest.first
+}
+
+func (g *entryGroups) oldest() *entryGroup {
+	var oldest *entryGroup
+	for _, group := range g.groups {
+		if oldest == nil || group.first < oldest.first {
+			oldest = group
+		}
+	}
+	return oldest
+}
@@ -26,15 +26,15 @@ type journalFollower struct {
 	entries chan *JournalEntry
 }
 
-func NewJournalFollower(cursor string, done <-chan struct{}) JournalFollower {
+func NewJournalFollower(start StartPosition, done <-chan struct{}) JournalFollower {
 	ret := make(chan error, 2)
-	entries := make(chan *JournalEntry)
+	entries := make(chan *JournalEntry, stageBuffer)
 
 	follower := &journalFollower{
 		ret:     ret,
 		entries: entries,
 	}
-	go follower.start(cursor, done)
+	go follower.start(start, done)
 
 	return follower
 }
@@ -47,7 +47,7 @@ func (j *journalFollower) Entries() <-chan *JournalEntry {
 	return j.entries
 }
 
-func (j *journalFollower) start(cursor string, done <-chan struct{}) {
+func (j *journalFollower) start(start StartPosition, done <-chan struct{}) {
 	stat, err := os.Stdin.Stat()
 	if err != nil {
 		j.ret <- fmt.Errorf("journal: unable to stat stdin: %s", err)
@@ -58,7 +58,7 @@ func (j *journalFollower) start(cursor string, done <-chan struct{}) {
 	if (stat.Mode() & os.ModeCharDevice) == 0 {
 		go j.startStdin(done)
 	} else {
-		go j.startJournalctl(cursor, done)
+		go j.startJournalctl(start, done)
 	}
 
 }
@@ -74,7 +74,7 @@ func (j *journalFollower) startStdin(done <-chan struct{}) {
 	}
 }
 
-func (j *journalFollower) startJournalctl(cursor string, done <-chan struct{}) {
+func (j *journalFollower) startJournalctl(start StartPosition, done <-chan struct{}) {
 	defer close(j.ret)
 
 	var wg sync.WaitGroup
@@ -88,9 +88,14 @@ func (j *journalFollower) startJournalctl(cursor string, done <-chan struct{}) {
 		defer close(followerDone)
 
 		args := []string{"--output", "export", "--follow"}
-		if cursor != "" {
-			args = append(args, "--no-tail", "--after-cursor", cursor)
-		} else {
+		switch {
+		case start.Cursor != "":
+			args = append(args, "--no-tail", "--after-cursor", start.Cursor)
+		case start.Head:
+			args = append(args, "--no-tail")
+		case !start.Since.IsZero():
+			args = append(args, "--no-tail", "--since", fmt.Sprintf("@%d", start.Since.Unix()))
+		default:
 			args = append(args, "--lines=0")
 		}
 
@@ -161,6 +166,7 @@ func (j *journalFollower) sendEntries(output io.ReadCloser, done <-chan struct{}
 			Fields: fields,
 			Cursor: cursor,
 		}
+		journalEntriesRead.Inc()
 
 		select {
 		case <-done:
@@ -0,0 +1,49 @@
+package journal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/compressed/message.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file       string
+		decompress func([]byte) ([]byte, error)
+	}{
+		{"message.txt.xz", decompressXZ},
+		{"message.txt.crc64.xz", decompressXZ},
+		{"message.txt.lz4", decompressLZ4},
+		{"message.txt.zst", decompressZstd},
+		{"message.txt.19.zst", decompressZstd},
+	}
+
+	for _, test := range tests {
+		compressed, err := ioutil.ReadFile("testdata/compressed/" + test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decompressed, err := test.decompress(compressed)
+		if err != nil {
+			t.Errorf("%s: %s", test.file, err)
+			continue
+		}
+		if !bytes.Equal(decompressed, expected) {
+			t.Errorf("%s: decompressed %d bytes not matching original", test.file, len(decompressed))
+		}
+
+		// truncated input must fail rather than panic
+		for _, n := range []int{0, 1, len(compressed) / 2, len(compressed) - 1} {
+			_, err := test.decompress(compressed[:n])
+			if err == nil {
+				t.Errorf("%s: expected error decompressing %d bytes", test.file, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package journal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Location identifies the position of an entry in the journal
+type Location struct {
+	SeqnumID  ID128
+	Seqnum    uint64
+	BootID    ID128
+	Monotonic uint64
+	Realtime  uint64
+	XorHash   uint64
+}
+
+// Entry is a single journal entry
+type Entry struct {
+	Location
+	Fields map[string]string
+}
+
+// Cursor formats the location the same way as journalctl, so cursors can be
+// used interchangeably
+func (l *Location) Cursor() string {
+	return fmt.Sprintf("s=%s;i=%x;b=%s;m=%x;t=%x;x=%x", l.SeqnumID, l.Seqnum, l.BootID, l.Monotonic, l.Realtime, l.XorHash)
+}
+
+// ParseCursor parses a cursor as produced by journalctl or Location.Cursor
+func ParseCursor(cursor string) (*Location, error) {
+	loc := &Location{}
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(cursor, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid cursor '%s'", cursor)
+		}
+
+		var err error
+		switch kv[0] {
+		case "s":
+			loc.SeqnumID, err = ParseID128(kv[1])
+		case "i":
+			loc.Seqnum, err = strconv.ParseUint(kv[1], 16, 64)
+		case "b":
+			loc.BootID, err = ParseID128(kv[1])
+		case "m":
+			loc.Monotonic, err = strconv.ParseUint(kv[1], 16, 64)
+		case "t":
+			loc.Realtime, err = strconv.ParseUint(kv[1], 16, 64)
+		case "x":
+			loc.XorHash, err = strconv.ParseUint(kv[1], 16, 64)
+		default:
+			// unknown parts are ignored, like journalctl does
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor '%s': %s", cursor, err)
+		}
+		seen[kv[0]] = true
+	}
+
+	for _, k := range []string{"s", "i", "b", "m", "t", "x"} {
+		if !seen[k] {
+			return nil, fmt.Errorf("invalid cursor '%s': missing '%s'", cursor, k)
+		}
+	}
+
+	return loc, nil
+}
+
+// compareLocations orders entries the same way journalctl does when
+// interleaving files: by sequence number when they share a sequence number
+// space, by monotonic time when they're from the same boot, and otherwise by
+// wallclock time
+func compareLocations(a, b *Location) int {
+	switch {
+	case a.SeqnumID == b.SeqnumID:
+		if c := compareUint64(a.Seqnum, b.Seqnum); c != 0 {
+			return c
+		}
+	case a.BootID == b.BootID:
+		if c := compareUint64(a.Monotonic, b.Monotonic); c != 0 {
+			return c
+		}
+	}
+
+	if c := compareUint64(a.Realtime, b.Realtime); c != 0 {
+		return c
+	}
+	return compareUint64(a.XorHash, b.XorHash)
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,504 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// The journal file format is described here:
+// https://systemd.io/JOURNAL_FILE_FORMAT/
+
+var signature = []byte("LPKSHHRH")
+
+const (
+	incompatibleCompressedXZ   = 1 << 0
+	incompatibleCompressedLZ4  = 1 << 1
+	incompatibleKeyedHash      = 1 << 2
+	incompatibleCompressedZSTD = 1 << 3
+	incompatibleCompact        = 1 << 4
+
+	incompatibleSupported = incompatibleCompressedXZ | incompatibleCompressedLZ4 |
+		incompatibleKeyedHash | incompatibleCompressedZSTD | incompatibleCompact
+)
+
+const (
+	objectData           = 1
+	objectField          = 2
+	objectEntry          = 3
+	objectDataHashTable  = 4
+	objectFieldHashTable = 5
+	objectEntryArray     = 6
+	objectTag            = 7
+)
+
+const (
+	objectCompressedXZ   = 1 << 0
+	objectCompressedLZ4  = 1 << 1
+	objectCompressedZSTD = 1 << 2
+
+	objectCompressionMask = objectCompressedXZ | objectCompressedLZ4 | objectCompressedZSTD
+)
+
+const (
+	headerMinSize      = 208
+	objectHeaderSize   = 16
+	entryObjectSize    = 64
+	dataObjectSize     = 64
+	compactDataSize    = 72
+	entryArrayItemsPos = 24
+	hashItemSize       = 16
+
+	// guard against corrupt sizes making us allocate huge buffers
+	maxObjectSize = 1 << 30
+)
+
+// ID128 is a 128 bit identifier, such as a boot or machine id
+type ID128 [16]byte
+
+func (id ID128) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseID128 parses an id formatted as 32 hexadecimal characters
+func ParseID128(s string) (ID128, error) {
+	var id ID128
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("invalid id '%s'", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+type header struct {
+	incompatibleFlags uint32
+	fileID            ID128
+	machineID         ID128
+	seqnumID          ID128
+	headerSize        uint64
+	arenaSize         uint64
+	dataHashTableOff  uint64
+	dataHashTableSize uint64
+	nEntries          uint64
+	entryArrayOffset  uint64
+}
+
+// File is a single journal file opened for reading. Files may be appended to
+// while open, in which case Refresh picks up the new entries.
+type File struct {
+	path   string
+	f      *os.File
+	header header
+
+	// entry arrays seen so far, in order
+	arrays []entryArray
+}
+
+type entryArray struct {
+	offset   uint64
+	capacity uint64
+	// index of the first entry in this array
+	first uint64
+}
+
+// OpenFile opens the journal file at path
+func OpenFile(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		path: path,
+		f:    f,
+	}
+
+	err = file.Refresh()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return file, nil
+}
+
+// Close closes the underlying file
+func (f *File) Close() error {
+	return f.f.Close()
+}
+
+// Path returns the path the file was opened with
+func (f *File) Path() string {
+	return f.path
+}
+
+// ID returns the unique id of the file
+func (f *File) ID() ID128 {
+	return f.header.fileID
+}
+
+// SeqnumID returns the id of the sequence number space entries in this file
+// belong to
+func (f *File) SeqnumID() ID128 {
+	return f.header.seqnumID
+}
+
+// Entries returns the number of entries in the file
+func (f *File) Entries() uint64 {
+	return f.header.nEntries
+}
+
+func (f *File) compact() bool {
+	return f.header.incompatibleFlags&incompatibleCompact != 0
+}
+
+// Refresh re-reads the file header to pick up entries written since the file
+// was opened or last refreshed
+func (f *File) Refresh() error {
+	buf := make([]byte, headerMinSize)
+	_, err := f.f.ReadAt(buf, 0)
+	if err != nil {
+		return fmt.Errorf("reading header: %s", err)
+	}
+
+	if !bytes.Equal(buf[0:8], signature) {
+		return fmt.Errorf("not a journal file")
+	}
+
+	h := header{
+		incompatibleFlags: binary.LittleEndian.Uint32(buf[12:16]),
+		headerSize:        binary.LittleEndian.Uint64(buf[88:96]),
+		arenaSize:         binary.LittleEndian.Uint64(buf[96:104]),
+		dataHashTableOff:  binary.LittleEndian.Uint64(buf[104:112]),
+		dataHashTableSize: binary.LittleEndian.Uint64(buf[112:120]),
+		nEntries:          binary.LittleEndian.Uint64(buf[152:160]),
+		entryArrayOffset:  binary.LittleEndian.Uint64(buf[176:184]),
+	}
+	copy(h.fileID[:], buf[24:40])
+	copy(h.machineID[:], buf[40:56])
+	copy(h.seqnumID[:], buf[72:88])
+
+	if unsupported := h.incompatibleFlags &^ incompatibleSupported; unsupported != 0 {
+		return fmt.Errorf("unsupported incompatible flags %#x", unsupported)
+	}
+	if h.headerSize < headerMinSize {
+		return fmt.Errorf("header too small: %d", h.headerSize)
+	}
+	if f.arrays != nil && h.fileID != f.header.fileID {
+		return fmt.Errorf("file id changed")
+	}
+
+	f.header = h
+
+	return f.loadEntryArrays()
+}
+
+// loadEntryArrays follows the chain of entry arrays far enough to cover all
+// entries in the file
+func (f *File) loadEntryArrays() error {
+	var covered uint64
+	if n := len(f.arrays); n > 0 {
+		last := f.arrays[n-1]
+		covered = last.first + last.capacity
+	}
+
+	for covered < f.header.nEntries {
+		var offset uint64
+		if len(f.arrays) == 0 {
+			offset = f.header.entryArrayOffset
+		} else {
+			last := f.arrays[len(f.arrays)-1]
+			buf, err := f.readObject(last.offset, objectEntryArray)
+			if err != nil {
+				return err
+			}
+			offset = binary.LittleEndian.Uint64(buf[16:24])
+		}
+
+		if offset == 0 {
+			// entries are counted before they're linked into an array
+			return nil
+		}
+
+		typ, size, err := f.readObjectHeader(offset)
+		if err != nil {
+			return err
+		}
+		if typ != objectEntryArray || size < entryArrayItemsPos {
+			return fmt.Errorf("invalid entry array object at %d", offset)
+		}
+
+		array := entryArray{
+			offset:   offset,
+			capacity: (size - entryArrayItemsPos) / f.entryArrayItemSize(),
+			first:    covered,
+		}
+		f.arrays = append(f.arrays, array)
+		covered += array.capacity
+	}
+
+	return nil
+}
+
+func (f *File) entryArrayItemSize() uint64 {
+	if f.compact() {
+		return 4
+	}
+	return 8
+}
+
+func (f *File) readObjectHeader(offset uint64) (uint8, uint64, error) {
+	if offset%8 != 0 || offset < f.header.headerSize {
+		return 0, 0, fmt.Errorf("invalid object offset %d", offset)
+	}
+
+	buf := make([]byte, objectHeaderSize)
+	_, err := f.f.ReadAt(buf, int64(offset))
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading object header at %d: %s", offset, err)
+	}
+
+	size := binary.LittleEndian.Uint64(buf[8:16])
+	if size < objectHeaderSize || size > maxObjectSize {
+		return 0, 0, fmt.Errorf("invalid object size %d at %d", size, offset)
+	}
+
+	return buf[0], size, nil
+}
+
+// readObject reads a whole object, checking it's of the expected type
+func (f *File) readObject(offset uint64, typ uint8) ([]byte, error) {
+	actual, size, err := f.readObjectHeader(offset)
+	if err != nil {
+		return nil, err
+	}
+	if actual != typ {
+		return nil, fmt.Errorf("expected object type %d at %d, found %d", typ, offset, actual)
+	}
+
+	buf := make([]byte, size)
+	_, err = f.f.ReadAt(buf, int64(offset))
+	if err != nil {
+		return nil, fmt.Errorf("reading object at %d: %s", offset, err)
+	}
+
+	return buf, nil
+}
+
+// entryOffset returns the offset of the i'th entry in the file
+func (f *File) entryOffset(i uint64) (uint64, error) {
+	if i >= f.header.nEntries {
+		return 0, fmt.Errorf("entry %d out of range", i)
+	}
+
+	// arrays grow geometrically, so there are only ever a few of them
+	for _, array := range f.arrays {
+		if i >= array.first+array.capacity {
+			continue
+		}
+
+		itemSize := f.entryArrayItemSize()
+		buf := make([]byte, itemSize)
+		_, err := f.f.ReadAt(buf, int64(array.offset+entryArrayItemsPos+(i-array.first)*itemSize))
+		if err != nil {
+			return 0, fmt.Errorf("reading entry array item: %s", err)
+		}
+
+		var offset uint64
+		if itemSize == 4 {
+			offset = uint64(binary.LittleEndian.Uint32(buf))
+		} else {
+			offset = binary.LittleEndian.Uint64(buf)
+		}
+		if offset == 0 {
+			return 0, fmt.Errorf("entry %d not linked yet", i)
+		}
+		return offset, nil
+	}
+
+	return 0, fmt.Errorf("entry %d not linked yet", i)
+}
+
+// linkedEntries returns the number of entries that can be read, which may lag
+// behind the entry count while the file is being written to
+func (f *File) linkedEntries() uint64 {
+	var covered uint64
+	if n := len(f.arrays); n > 0 {
+		covered = f.arrays[n-1].first + f.arrays[n-1].capacity
+	}
+	if covered < f.header.nEntries {
+		return covered
+	}
+	return f.header.nEntries
+}
+
+// location reads the parts of the i'th entry that determine its position in
+// the journal, without reading its fields
+func (f *File) location(i uint64) (uint64, *Location, error) {
+	offset, err := f.entryOffset(i)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	typ, _, err := f.readObjectHeader(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if typ != objectEntry {
+		return 0, nil, fmt.Errorf("expected entry object at %d, found %d", offset, typ)
+	}
+
+	buf := make([]byte, entryObjectSize)
+	_, err = f.f.ReadAt(buf, int64(offset))
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading entry at %d: %s", offset, err)
+	}
+
+	loc := &Location{
+		SeqnumID:  f.header.seqnumID,
+		Seqnum:    binary.LittleEndian.Uint64(buf[16:24]),
+		Realtime:  binary.LittleEndian.Uint64(buf[24:32]),
+		Monotonic: binary.LittleEndian.Uint64(buf[32:40]),
+		XorHash:   binary.LittleEndian.Uint64(buf[56:64]),
+	}
+	copy(loc.BootID[:], buf[40:56])
+
+	return offset, loc, nil
+}
+
+// Entry reads the i'th entry in the file
+func (f *File) Entry(i uint64) (*Entry, error) {
+	offset, loc, err := f.location(i)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := f.readObject(offset, objectEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	itemSize := uint64(16)
+	if f.compact() {
+		itemSize = 4
+	}
+
+	items := buf[entryObjectSize:]
+	entry := &Entry{
+		Location: *loc,
+		Fields:   make(map[string]string, uint64(len(items))/itemSize),
+	}
+
+	for len(items) >= int(itemSize) {
+		var dataOffset uint64
+		if itemSize == 4 {
+			dataOffset = uint64(binary.LittleEndian.Uint32(items))
+		} else {
+			dataOffset = binary.LittleEndian.Uint64(items)
+		}
+		items = items[itemSize:]
+
+		payload, err := f.dataPayload(dataOffset)
+		if err != nil {
+			return nil, err
+		}
+
+		eq := bytes.IndexByte(payload, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid field in data object at %d", dataOffset)
+		}
+		entry.Fields[string(payload[:eq])] = string(payload[eq+1:])
+	}
+
+	return entry, nil
+}
+
+// dataPayload reads and if needed decompresses the payload of a data object
+func (f *File) dataPayload(offset uint64) ([]byte, error) {
+	buf, err := f.readObject(offset, objectData)
+	if err != nil {
+		return nil, err
+	}
+
+	start := uint64(dataObjectSize)
+	if f.compact() {
+		start = compactDataSize
+	}
+	if uint64(len(buf)) < start {
+		return nil, fmt.Errorf("data object at %d too small", offset)
+	}
+
+	payload := buf[start:]
+
+	switch flags := buf[1] & objectCompressionMask; flags {
+	case 0:
+		return payload, nil
+	case objectCompressedXZ:
+		payload, err = decompressXZ(payload)
+	case objectCompressedLZ4:
+		payload, err = decompressLZ4(payload)
+	case objectCompressedZSTD:
+		payload, err = decompressZstd(payload)
+	default:
+		return nil, fmt.Errorf("invalid compression flags %#x in data object at %d", flags, offset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing data object at %d: %s", offset, err)
+	}
+
+	return payload, nil
+}
+
+func (f *File) hash(payload []byte) uint64 {
+	if f.header.incompatibleFlags&incompatibleKeyedHash != 0 {
+		return sipHash24(f.header.fileID, payload)
+	}
+	return jenkinsHash64(payload)
+}
+
+// FindData looks up the data object holding the given field, formatted as
+// FIELD=value, in the data hash table. It returns the offset of the object
+// and the number of entries referencing it, or false if there is none.
+func (f *File) FindData(field []byte) (uint64, uint64, bool, error) {
+	buckets := f.header.dataHashTableSize / hashItemSize
+	if buckets == 0 {
+		return 0, 0, false, nil
+	}
+
+	hash := f.hash(field)
+
+	buf := make([]byte, 8)
+	_, err := f.f.ReadAt(buf, int64(f.header.dataHashTableOff+(hash%buckets)*hashItemSize))
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("reading data hash table: %s", err)
+	}
+
+	offset := binary.LittleEndian.Uint64(buf)
+	for depth := 0; offset != 0; depth++ {
+		if uint64(depth) > f.header.arenaSize/dataObjectSize {
+			return 0, 0, false, fmt.Errorf("loop in data hash chain")
+		}
+
+		obj, err := f.readObject(offset, objectData)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		if binary.LittleEndian.Uint64(obj[16:24]) == hash {
+			payload, err := f.dataPayload(offset)
+			if err != nil {
+				return 0, 0, false, err
+			}
+			if bytes.Equal(payload, field) {
+				return offset, binary.LittleEndian.Uint64(obj[56:64]), true, nil
+			}
+		}
+
+		offset = binary.LittleEndian.Uint64(obj[24:32])
+	}
+
+	return 0, 0, false, nil
+}
@@ -0,0 +1,131 @@
+package journal
+
+import (
+	"encoding/binary"
+)
+
+// jenkinsHash64 is the 64 bit variant of Bob Jenkins' lookup3 hash used by
+// journal files without the keyed hash flag.
+// http://burtleburtle.net/bob/c/lookup3.c
+func jenkinsHash64(data []byte) uint64 {
+	rot := func(x uint32, k uint) uint32 {
+		return (x << k) | (x >> (32 - k))
+	}
+
+	a := 0xdeadbeef + uint32(len(data))
+	b, c := a, a
+
+	for len(data) > 12 {
+		a += binary.LittleEndian.Uint32(data[0:4])
+		b += binary.LittleEndian.Uint32(data[4:8])
+		c += binary.LittleEndian.Uint32(data[8:12])
+
+		a -= c
+		a ^= rot(c, 4)
+		c += b
+		b -= a
+		b ^= rot(a, 6)
+		a += c
+		c -= b
+		c ^= rot(b, 8)
+		b += a
+		a -= c
+		a ^= rot(c, 16)
+		c += b
+		b -= a
+		b ^= rot(a, 19)
+		a += c
+		c -= b
+		c ^= rot(b, 4)
+		b += a
+
+		data = data[12:]
+	}
+
+	if len(data) == 0 {
+		return uint64(c)<<32 | uint64(b)
+	}
+
+	var tail [12]byte
+	copy(tail[:], data)
+	a += binary.LittleEndian.Uint32(tail[0:4])
+	b += binary.LittleEndian.Uint32(tail[4:8])
+	c += binary.LittleEndian.Uint32(tail[8:12])
+
+	c ^= b
+	c -= rot(b, 14)
+	a ^= c
+	a -= rot(c, 11)
+	b ^= a
+	b -= rot(a, 25)
+	c ^= b
+	c -= rot(b, 16)
+	a ^= c
+	a -= rot(c, 4)
+	b ^= a
+	b -= rot(a, 14)
+	c ^= b
+	c -= rot(b, 24)
+
+	return uint64(c)<<32 | uint64(b)
+}
+
+// sipHash24 is SipHash-2-4, used by journal files with the keyed hash flag
+// with the file id as key.
+// https://131002.net/siphash/
+func sipHash24(key [16]byte, data []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	rotl := func(x uint64, b uint) uint64 {
+		return (x << b) | (x >> (64 - b))
+	}
+	round := func() {
+		v0 += v1
+		v1 = rotl(v1, 13)
+		v1 ^= v0
+		v0 = rotl(v0, 32)
+		v2 += v3
+		v3 = rotl(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = rotl(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = rotl(v1, 17)
+		v1 ^= v2
+		v2 = rotl(v2, 32)
+	}
+
+	length := len(data)
+	for len(data) >= 8 {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		data = data[8:]
+	}
+
+	var tail [8]byte
+	copy(tail[:], data)
+	m := binary.LittleEndian.Uint64(tail[:]) | uint64(length)<<56
+
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
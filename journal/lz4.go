@@ -0,0 +1,95 @@
+package journal
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// decompressLZ4 decompresses a data object payload compressed with LZ4, which
+// journald stores as the little endian uncompressed size followed by a single
+// LZ4 block.
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+func decompressLZ4(src []byte) ([]byte, error) {
+	if len(src) < 8 {
+		return nil, fmt.Errorf("lz4: payload too short")
+	}
+
+	size := binary.LittleEndian.Uint64(src)
+	if size > maxObjectSize {
+		return nil, fmt.Errorf("lz4: uncompressed size %d too large", size)
+	}
+	src = src[8:]
+
+	dst := make([]byte, 0, size)
+
+	readLength := func(length int) (int, error) {
+		if length != 15 {
+			return length, nil
+		}
+		for {
+			if len(src) == 0 {
+				return 0, fmt.Errorf("lz4: truncated length")
+			}
+			b := src[0]
+			src = src[1:]
+			length += int(b)
+			if b != 255 {
+				return length, nil
+			}
+		}
+	}
+
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
+
+		literals, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if literals > len(src) {
+			return nil, fmt.Errorf("lz4: truncated literals")
+		}
+		if uint64(len(dst)+literals) > size {
+			return nil, fmt.Errorf("lz4: output larger than %d bytes", size)
+		}
+		dst = append(dst, src[:literals]...)
+		src = src[literals:]
+
+		// the last sequence has no match
+		if len(src) == 0 {
+			break
+		}
+
+		if len(src) < 2 {
+			return nil, fmt.Errorf("lz4: truncated match offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(src))
+		src = src[2:]
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("lz4: invalid match offset %d", offset)
+		}
+
+		length, err := readLength(int(token & 0xf))
+		if err != nil {
+			return nil, err
+		}
+		length += 4
+
+		if uint64(len(dst)+length) > size {
+			return nil, fmt.Errorf("lz4: output larger than %d bytes", size)
+		}
+
+		// matches may overlap the output being written, so copy byte by byte
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != size {
+		return nil, fmt.Errorf("lz4: expected %d bytes, got %d", size, len(dst))
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,344 @@
+package journal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Reader reads entries from all journal files in a set of directories,
+// interleaving them in order. New files and entries appended to existing files
+// are picked up by Refresh.
+type Reader struct {
+	dirs  []string
+	files []*fileReader
+
+	// files that couldn't be opened, so they're only reported once while
+	// retrying
+	broken map[string]bool
+}
+
+type fileReader struct {
+	file *File
+	stat os.FileInfo
+	// index of the next entry to read
+	next uint64
+	// location of the next entry, if it has been read
+	peeked *Location
+}
+
+type journalPath struct {
+	path string
+	info os.FileInfo
+}
+
+// NewReader opens all journal files in dirs, positioned at the first entry
+func NewReader(dirs []string) (*Reader, error) {
+	r := &Reader{
+		dirs:   dirs,
+		broken: make(map[string]bool),
+	}
+
+	err := r.Refresh()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Close closes all open files
+func (r *Reader) Close() error {
+	for _, fr := range r.files {
+		fr.file.Close()
+	}
+	r.files = nil
+	return nil
+}
+
+// Refresh picks up new journal files and new entries in files already open.
+// Files that have been removed are closed once all their entries have been
+// read.
+func (r *Reader) Refresh() error {
+	paths, err := r.journalPaths()
+	if err != nil {
+		return err
+	}
+
+	matched := make([]bool, len(paths))
+	known := make(map[ID128]bool)
+
+	var files []*fileReader
+	for _, fr := range r.files {
+		err := fr.file.Refresh()
+		if err != nil {
+			return fmt.Errorf("journal: %s", err)
+		}
+		fr.peeked = nil
+
+		// journald renames files when archiving them, so match them up by
+		// inode rather than path
+		present := false
+		for i, p := range paths {
+			if os.SameFile(fr.stat, p.info) {
+				fr.file.path = p.path
+				matched[i] = true
+				present = true
+			}
+		}
+
+		if !present && fr.next >= fr.file.linkedEntries() {
+			fr.file.Close()
+			continue
+		}
+
+		files = append(files, fr)
+		known[fr.file.ID()] = true
+	}
+
+	for i, p := range paths {
+		if matched[i] {
+			continue
+		}
+
+		// journald hasn't written the header yet
+		if p.info.Size() < headerMinSize {
+			continue
+		}
+
+		file, err := OpenFile(p.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed since listing the directory
+				continue
+			}
+			if !r.broken[p.path] {
+				log.Warnf("journal: skipping unreadable file: %s", err)
+				r.broken[p.path] = true
+			}
+			continue
+		}
+		delete(r.broken, p.path)
+
+		stat, err := file.f.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("journal: unable to stat %s: %s", p.path, err)
+		}
+
+		if known[file.ID()] {
+			file.Close()
+			continue
+		}
+
+		files = append(files, &fileReader{file: file, stat: stat})
+		known[file.ID()] = true
+	}
+
+	r.files = files
+
+	return nil
+}
+
+// journalPaths lists journal files in the directories, and in any
+// subdirectories one level down, which is where journald keeps files per
+// machine id
+func (r *Reader) journalPaths() ([]journalPath, error) {
+	var paths []journalPath
+
+	for _, dir := range r.dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("journal: unable to list %s: %s", dir, err)
+		}
+
+		for _, info := range infos {
+			path := filepath.Join(dir, info.Name())
+
+			if !info.IsDir() {
+				if isJournalFile(info.Name()) {
+					paths = append(paths, journalPath{path, info})
+				}
+				continue
+			}
+
+			subInfos, err := ioutil.ReadDir(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, fmt.Errorf("journal: unable to list %s: %s", path, err)
+			}
+			for _, subInfo := range subInfos {
+				if !subInfo.IsDir() && isJournalFile(subInfo.Name()) {
+					paths = append(paths, journalPath{filepath.Join(path, subInfo.Name()), subInfo})
+				}
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// isJournalFile excludes files journald has set aside as corrupt (*.journal~)
+func isJournalFile(name string) bool {
+	return strings.HasSuffix(name, ".journal")
+}
+
+// Paths returns the paths of all open journal files
+func (r *Reader) Paths() []string {
+	var paths []string
+	for _, fr := range r.files {
+		paths = append(paths, fr.file.path)
+	}
+	return paths
+}
+
+func (fr *fileReader) peek() (*Location, error) {
+	if fr.peeked != nil {
+		return fr.peeked, nil
+	}
+	if fr.next >= fr.file.linkedEntries() {
+		return nil, nil
+	}
+
+	_, loc, err := fr.file.location(fr.next)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %s: %s", fr.file.path, err)
+	}
+	fr.peeked = loc
+
+	return loc, nil
+}
+
+// Next returns the next entry across all files, or nil if all entries
+// currently in the files have been read
+func (r *Reader) Next() (*Entry, error) {
+	var (
+		next    *fileReader
+		nextLoc *Location
+	)
+
+	for _, fr := range r.files {
+		loc, err := fr.peek()
+		if err != nil {
+			return nil, err
+		}
+		if loc == nil {
+			continue
+		}
+		if nextLoc == nil || compareLocations(loc, nextLoc) < 0 {
+			next = fr
+			nextLoc = loc
+		}
+	}
+
+	if next == nil {
+		return nil, nil
+	}
+
+	entry, err := next.file.Entry(next.next)
+	if err != nil {
+		return nil, fmt.Errorf("journal: %s: %s", next.file.path, err)
+	}
+
+	// the same entry can end up in more than one file, so skip over any
+	// duplicates
+	for _, fr := range r.files {
+		loc, err := fr.peek()
+		if err != nil {
+			return nil, err
+		}
+		if loc != nil && compareLocations(loc, nextLoc) == 0 {
+			fr.next++
+			fr.peeked = nil
+		}
+	}
+
+	return entry, nil
+}
+
+// SeekHead positions the reader at the first entry
+func (r *Reader) SeekHead() {
+	for _, fr := range r.files {
+		fr.next = 0
+		fr.peeked = nil
+	}
+}
+
+// SeekTail positions the reader after the last entry, so only entries written
+// from now on are read
+func (r *Reader) SeekTail() {
+	for _, fr := range r.files {
+		fr.next = fr.file.linkedEntries()
+		fr.peeked = nil
+	}
+}
+
+// SeekCursor positions the reader after the entry identified by cursor. The
+// entry itself doesn't need to exist anymore.
+func (r *Reader) SeekCursor(cursor string) error {
+	loc, err := ParseCursor(cursor)
+	if err != nil {
+		return err
+	}
+
+	for _, fr := range r.files {
+		// find the first entry after the cursor, entries in a file are in
+		// order so a binary search will do
+		var searchErr error
+		n := fr.file.linkedEntries()
+		i := sort.Search(int(n), func(i int) bool {
+			_, entryLoc, err := fr.file.location(uint64(i))
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			return compareLocations(entryLoc, loc) > 0
+		})
+		if searchErr != nil {
+			return fmt.Errorf("journal: %s: %s", fr.file.path, searchErr)
+		}
+
+		fr.next = uint64(i)
+		fr.peeked = nil
+	}
+
+	return nil
+}
+
+// SeekRealtime positions the reader at the first entry written at or after
+// the given wallclock time, in microseconds since the epoch
+func (r *Reader) SeekRealtime(usec uint64) error {
+	for _, fr := range r.files {
+		// wallclock time can go backwards, but entries are mostly in order
+		// which is good enough to start reading from
+		var searchErr error
+		n := fr.file.linkedEntries()
+		i := sort.Search(int(n), func(i int) bool {
+			_, entryLoc, err := fr.file.location(uint64(i))
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			return entryLoc.Realtime >= usec
+		})
+		if searchErr != nil {
+			return fmt.Errorf("journal: %s: %s", fr.file.path, searchErr)
+		}
+
+		fr.next = uint64(i)
+		fr.peeked = nil
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readExport reads entries written by journalctl --output export, which is
+// how the expected output in testdata was produced
+func readExport(t *testing.T, path string) []map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []map[string]string
+	entry := make(map[string]string)
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = line[:len(line)-1]
+
+		if line == "" {
+			entries = append(entries, entry)
+			entry = make(map[string]string)
+			continue
+		}
+
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			entry[kv[0]] = kv[1]
+			continue
+		}
+
+		var size uint64
+		err = binary.Read(reader, binary.LittleEndian, &size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := make([]byte, size+1)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry[line] = string(value[:size])
+	}
+}
+
+func readAll(t *testing.T, r *Reader) []*Entry {
+	var entries []*Entry
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			return entries
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func TestReaderMatchesJournalctl(t *testing.T) {
+	for _, dir := range []string{"compact", "legacy"} {
+		expected := readExport(t, filepath.Join("testdata", dir+".export"))
+
+		r, err := NewReader([]string{filepath.Join("testdata", dir)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := readAll(t, r)
+		r.Close()
+
+		if len(entries) != len(expected) {
+			t.Fatalf("%s: expected %d entries, read %d", dir, len(expected), len(entries))
+		}
+
+		for i, entry := range entries {
+			want := expected[i]
+
+			if entry.Cursor() != want["__CURSOR"] {
+				t.Errorf("%s: entry %d: expected cursor %s, was %s", dir, i, want["__CURSOR"], entry.Cursor())
+			}
+			if strconv.FormatUint(entry.Realtime, 10) != want["__REALTIME_TIMESTAMP"] {
+				t.Errorf("%s: entry %d: expected realtime %s, was %d", dir, i, want["__REALTIME_TIMESTAMP"], entry.Realtime)
+			}
+			if strconv.FormatUint(entry.Monotonic, 10) != want["__MONOTONIC_TIMESTAMP"] {
+				t.Errorf("%s: entry %d: expected monotonic %s, was %d", dir, i, want["__MONOTONIC_TIMESTAMP"], entry.Monotonic)
+			}
+
+			for k, v := range want {
+				if strings.HasPrefix(k, "__") {
+					continue
+				}
+				if entry.Fields[k] != v {
+					t.Errorf("%s: entry %d: expected %s=%q, was %q", dir, i, k, v, entry.Fields[k])
+				}
+			}
+			for k := range entry.Fields {
+				if _, ok := want[k]; !ok {
+					t.Errorf("%s: entry %d: unexpected field %s", dir, i, k)
+				}
+			}
+		}
+	}
+}
+
+func TestReaderSeekCursor(t *testing.T) {
+	r, err := NewReader([]string{"testdata/compact"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	entries := readAll(t, r)
+	if len(r.Paths()) != 2 {
+		t.Fatalf("expected entries to be read from 2 files, were %v", r.Paths())
+	}
+
+	for i, entry := range entries {
+		err := r.SeekCursor(entry.Cursor())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == len(entries)-1 {
+			if next != nil {
+				t.Errorf("expected no entries after the last cursor, read %s", next.Cursor())
+			}
+			continue
+		}
+		if next == nil || next.Cursor() != entries[i+1].Cursor() {
+			t.Errorf("expected entry after %s to be %s, was %v", entry.Cursor(), entries[i+1].Cursor(), next)
+		}
+	}
+
+	middle := entries[len(entries)/2]
+	err = r.SeekRealtime(middle.Realtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := r.Next(); entry == nil || entry.Cursor() != middle.Cursor() {
+		t.Errorf("expected %s after seeking to its time, read %v", middle.Cursor(), entry)
+	}
+
+	r.SeekTail()
+	if entry, _ := r.Next(); entry != nil {
+		t.Errorf("expected no entries after seeking to the tail, read %s", entry.Cursor())
+	}
+
+	r.SeekHead()
+	if entry, _ := r.Next(); entry == nil || entry.Cursor() != entries[0].Cursor() {
+		t.Errorf("expected first entry after seeking to the head, read %v", entry)
+	}
+}
+
+func TestFileFindData(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*/*.journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		f, err := OpenFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := uint64(0); i < f.Entries(); i++ {
+			entry, err := f.Entry(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range entry.Fields {
+				_, n, found, err := f.FindData([]byte(k + "=" + v))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !found || n == 0 {
+					t.Errorf("%s: expected to find %s in the hash table", path, k)
+				}
+			}
+		}
+
+		_, _, found, err := f.FindData([]byte("MESSAGE=not in the journal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Errorf("%s: expected not to find missing field", path)
+		}
+
+		f.Close()
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	cursor := "s=bbe71afbfc214be7aeffec29714c893d;i=1;b=6a8280c8ae924ebf9bab8cd91cd2de93;m=46224d6c;t=65e0384520007;x=c31620b2a5193a82"
+
+	loc, err := ParseCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Seqnum != 1 || loc.Monotonic != 0x46224d6c || loc.Realtime != 0x65e0384520007 {
+		t.Error("unexpected location", loc)
+	}
+	if loc.Cursor() != cursor {
+		t.Error("expected cursor to round trip, was", loc.Cursor())
+	}
+
+	_, err = ParseCursor("s=bbe71afbfc214be7aeffec29714c893d;i=1")
+	if err == nil {
+		t.Error("expected error for incomplete cursor")
+	}
+}
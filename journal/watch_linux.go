@@ -0,0 +1,154 @@
+//go:build linux
+// +build linux
+
+package journal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// journald writes to files through mmap, which doesn't generate inotify
+// events, but it truncates the file to its current size after each write to
+// trigger IN_MODIFY
+const watchMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE | unix.IN_ATTRIB
+
+// Watcher signals when files in a set of journal directories may have
+// changed. Directories that don't exist yet aren't watched, so it should be
+// combined with polling.
+type Watcher struct {
+	file    *os.File
+	changes chan struct{}
+
+	mu      sync.Mutex
+	watches map[int32]string
+}
+
+// NewWatcher watches dirs, and any subdirectories one level down
+func NewWatcher(dirs []string) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("journal: unable to initialise inotify: %s", err)
+	}
+
+	w := &Watcher{
+		// a non-blocking file is handled by the runtime poller, so closing
+		// it interrupts a pending read
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan struct{}, 1),
+		watches: make(map[int32]string),
+	}
+
+	for _, dir := range dirs {
+		err := w.add(dir)
+		if err != nil {
+			w.file.Close()
+			return nil, err
+		}
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			w.file.Close()
+			return nil, fmt.Errorf("journal: unable to list %s: %s", dir, err)
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+			err := w.add(filepath.Join(dir, info.Name()))
+			if err != nil {
+				w.file.Close()
+				return nil, err
+			}
+		}
+	}
+
+	go w.read(dirs)
+
+	return w, nil
+}
+
+func (w *Watcher) add(dir string) error {
+	wd, err := unix.InotifyAddWatch(int(w.file.Fd()), dir, watchMask)
+	if err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("journal: unable to watch %s: %s", dir, err)
+	}
+
+	w.mu.Lock()
+	w.watches[int32(wd)] = dir
+	w.mu.Unlock()
+
+	return nil
+}
+
+// Changes receives a value after files have changed. Changes are coalesced,
+// so there's at most one pending.
+func (w *Watcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
+
+func (w *Watcher) read(dirs []string) {
+	top := make(map[string]bool)
+	for _, dir := range dirs {
+		top[dir] = true
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				continue
+			}
+
+			// watch new per machine subdirectories
+			if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				w.mu.Lock()
+				dir, ok := w.watches[event.Wd]
+				w.mu.Unlock()
+
+				if ok && top[dir] && offset <= n {
+					name := string(buf[nameStart:offset])
+					for len(name) > 0 && name[len(name)-1] == 0 {
+						name = name[:len(name)-1]
+					}
+					err := w.add(filepath.Join(dir, name))
+					if err != nil {
+						log.Warnf("%s", err)
+					}
+				}
+			}
+		}
+
+		select {
+		case w.changes <- struct{}{}:
+		default:
+		}
+	}
+}
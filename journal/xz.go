@@ -0,0 +1,554 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// decompressXZ decompresses a data object payload compressed as an xz stream.
+// Only what journald produces is supported: a single stream made up of LZMA2
+// blocks with no other filters.
+// https://tukaani.org/xz/xz-file-format.txt
+func decompressXZ(src []byte) ([]byte, error) {
+	magic := []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	if len(src) < 12 || !bytes.Equal(src[:6], magic) {
+		return nil, fmt.Errorf("xz: invalid stream header")
+	}
+	if crc32.ChecksumIEEE(src[6:8]) != binary.LittleEndian.Uint32(src[8:12]) {
+		return nil, fmt.Errorf("xz: stream header checksum mismatch")
+	}
+	if src[6] != 0 || src[7]&0xf0 != 0 {
+		return nil, fmt.Errorf("xz: unsupported stream flags")
+	}
+	checkSize := xzCheckSizes[src[7]&0x0f]
+
+	var dst []byte
+
+	pos := 12
+	for {
+		if pos >= len(src) {
+			return nil, fmt.Errorf("xz: truncated stream")
+		}
+
+		// the index follows the last block, and the stream footer gives its
+		// size
+		if src[pos] == 0 {
+			footer := src[len(src)-12:]
+			if !bytes.Equal(footer[10:], []byte("YZ")) || !bytes.Equal(footer[8:10], src[6:8]) {
+				return nil, fmt.Errorf("xz: invalid stream footer")
+			}
+			if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) {
+				return nil, fmt.Errorf("xz: stream footer checksum mismatch")
+			}
+			indexSize := (int(binary.LittleEndian.Uint32(footer[4:])) + 1) * 4
+			if pos+indexSize+12 != len(src) {
+				return nil, fmt.Errorf("xz: invalid index size")
+			}
+			return dst, nil
+		}
+
+		headerSize := (int(src[pos]) + 1) * 4
+		if pos+headerSize > len(src) {
+			return nil, fmt.Errorf("xz: truncated block header")
+		}
+		header := src[pos : pos+headerSize]
+		if crc32.ChecksumIEEE(header[:headerSize-4]) != binary.LittleEndian.Uint32(header[headerSize-4:]) {
+			return nil, fmt.Errorf("xz: block header checksum mismatch")
+		}
+
+		err := parseXZBlockHeader(header[:headerSize-4])
+		if err != nil {
+			return nil, err
+		}
+
+		blockStart := pos
+		pos += headerSize
+
+		n, err := decodeLZMA2(src[pos:], &dst)
+		if err != nil {
+			return nil, err
+		}
+		pos += n
+
+		// blocks are padded to a multiple of four bytes, then followed by
+		// the check
+		for (pos-blockStart)%4 != 0 {
+			pos++
+		}
+		pos += checkSize
+	}
+}
+
+var xzCheckSizes = [16]int{0, 4, 4, 4, 8, 8, 8, 16, 16, 16, 32, 32, 32, 64, 64, 64}
+
+func parseXZBlockHeader(header []byte) error {
+	if len(header) < 2 {
+		return fmt.Errorf("xz: block header too short")
+	}
+
+	flags := header[1]
+	if flags&0x3c != 0 {
+		return fmt.Errorf("xz: unsupported block flags")
+	}
+	if flags&0x03 != 0 {
+		return fmt.Errorf("xz: only the LZMA2 filter is supported")
+	}
+
+	pos := 2
+	readVarint := func() (uint64, error) {
+		var v uint64
+		for i := uint(0); i < 9; i++ {
+			if pos >= len(header) {
+				return 0, fmt.Errorf("xz: truncated block header")
+			}
+			b := header[pos]
+			pos++
+			v |= uint64(b&0x7f) << (7 * i)
+			if b&0x80 == 0 {
+				return v, nil
+			}
+		}
+		return 0, fmt.Errorf("xz: invalid varint in block header")
+	}
+
+	// compressed and uncompressed sizes aren't needed
+	if flags&0x40 != 0 {
+		if _, err := readVarint(); err != nil {
+			return err
+		}
+	}
+	if flags&0x80 != 0 {
+		if _, err := readVarint(); err != nil {
+			return err
+		}
+	}
+
+	id, err := readVarint()
+	if err != nil {
+		return err
+	}
+	if id != 0x21 {
+		return fmt.Errorf("xz: unsupported filter %#x", id)
+	}
+
+	return nil
+}
+
+// decodeLZMA2 decodes LZMA2 chunks, appending to dst, and returns the number
+// of bytes of src consumed
+func decodeLZMA2(src []byte, dst *[]byte) (int, error) {
+	d := &lzmaDecoder{}
+	pos := 0
+	needProps := true
+
+	for {
+		if pos >= len(src) {
+			return 0, fmt.Errorf("xz: truncated lzma2 data")
+		}
+		control := src[pos]
+		pos++
+
+		switch {
+		case control == 0x00:
+			return pos, nil
+
+		case control == 0x01 || control == 0x02:
+			if control == 0x01 {
+				d.dictStart = len(*dst)
+			}
+			if pos+2 > len(src) {
+				return 0, fmt.Errorf("xz: truncated lzma2 chunk header")
+			}
+			size := int(binary.BigEndian.Uint16(src[pos:])) + 1
+			pos += 2
+			if pos+size > len(src) {
+				return 0, fmt.Errorf("xz: truncated uncompressed chunk")
+			}
+			*dst = append(*dst, src[pos:pos+size]...)
+			pos += size
+
+		case control >= 0x80:
+			if pos+4 > len(src) {
+				return 0, fmt.Errorf("xz: truncated lzma2 chunk header")
+			}
+			unpacked := int(control&0x1f)<<16 + int(binary.BigEndian.Uint16(src[pos:])) + 1
+			packed := int(binary.BigEndian.Uint16(src[pos+2:])) + 1
+			pos += 4
+
+			reset := (control >> 5) & 0x03
+			if reset == 3 {
+				d.dictStart = len(*dst)
+			}
+			if reset >= 2 {
+				if pos >= len(src) {
+					return 0, fmt.Errorf("xz: truncated lzma2 chunk header")
+				}
+				err := d.setProperties(src[pos])
+				if err != nil {
+					return 0, err
+				}
+				pos++
+				needProps = false
+			}
+			if needProps {
+				return 0, fmt.Errorf("xz: lzma2 chunk without properties")
+			}
+			if reset >= 1 {
+				d.reset()
+			}
+
+			if pos+packed > len(src) {
+				return 0, fmt.Errorf("xz: truncated lzma2 chunk")
+			}
+			err := d.decode(src[pos:pos+packed], dst, unpacked)
+			if err != nil {
+				return 0, err
+			}
+			pos += packed
+
+		default:
+			return 0, fmt.Errorf("xz: invalid lzma2 control byte %#x", control)
+		}
+	}
+}
+
+const (
+	lzmaStates         = 12
+	lzmaPosBitsMax     = 4
+	lzmaLenToPosStates = 4
+	lzmaEndPosModel    = 14
+	lzmaFullDistances  = 128
+	lzmaAlignBits      = 4
+	lzmaMatchMinLen    = 2
+)
+
+type lzmaLenDecoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [1 << lzmaPosBitsMax][1 << 3]uint16
+	mid     [1 << lzmaPosBitsMax][1 << 3]uint16
+	high    [1 << 8]uint16
+}
+
+type lzmaDecoder struct {
+	lc, lp, pb uint
+
+	dictStart int
+
+	state uint32
+	reps  [4]uint32
+
+	literal    []uint16
+	isMatch    [lzmaStates << lzmaPosBitsMax]uint16
+	isRep      [lzmaStates]uint16
+	isRepG0    [lzmaStates]uint16
+	isRepG1    [lzmaStates]uint16
+	isRepG2    [lzmaStates]uint16
+	isRep0Long [lzmaStates << lzmaPosBitsMax]uint16
+	posSlot    [lzmaLenToPosStates][1 << 6]uint16
+	posSpecial [1 + lzmaFullDistances - lzmaEndPosModel]uint16
+	align      [1 << lzmaAlignBits]uint16
+	lenDecoder lzmaLenDecoder
+	repLen     lzmaLenDecoder
+
+	rc lzmaRangeDecoder
+}
+
+func (d *lzmaDecoder) setProperties(props byte) error {
+	if props >= 9*5*5 {
+		return fmt.Errorf("xz: invalid lzma properties")
+	}
+	d.lc = uint(props % 9)
+	props /= 9
+	d.lp = uint(props % 5)
+	d.pb = uint(props / 5)
+	if d.lc+d.lp > 4 {
+		return fmt.Errorf("xz: invalid lzma2 properties")
+	}
+	d.literal = make([]uint16, 0x300<<(d.lc+d.lp))
+	return nil
+}
+
+func (d *lzmaDecoder) reset() {
+	const initial = 1 << 10
+
+	d.state = 0
+	d.reps = [4]uint32{}
+
+	fill := func(probs []uint16) {
+		for i := range probs {
+			probs[i] = initial
+		}
+	}
+	fillLen := func(l *lzmaLenDecoder) {
+		l.choice = initial
+		l.choice2 = initial
+		for i := range l.low {
+			fill(l.low[i][:])
+			fill(l.mid[i][:])
+		}
+		fill(l.high[:])
+	}
+
+	fill(d.literal)
+	fill(d.isMatch[:])
+	fill(d.isRep[:])
+	fill(d.isRepG0[:])
+	fill(d.isRepG1[:])
+	fill(d.isRepG2[:])
+	fill(d.isRep0Long[:])
+	for i := range d.posSlot {
+		fill(d.posSlot[i][:])
+	}
+	fill(d.posSpecial[:])
+	fill(d.align[:])
+	fillLen(&d.lenDecoder)
+	fillLen(&d.repLen)
+}
+
+// decode decodes a single LZMA chunk producing unpacked bytes
+func (d *lzmaDecoder) decode(src []byte, dst *[]byte, unpacked int) error {
+	err := d.rc.init(src)
+	if err != nil {
+		return err
+	}
+
+	out := *dst
+	end := len(out) + unpacked
+	if end > maxObjectSize {
+		return fmt.Errorf("xz: output too large")
+	}
+
+	rc := &d.rc
+	for len(out) < end {
+		pos := uint32(len(out) - d.dictStart)
+		posState := pos & (1<<d.pb - 1)
+
+		if rc.bit(&d.isMatch[d.state<<lzmaPosBitsMax+posState]) == 0 {
+			var prev uint32
+			if len(out) > d.dictStart {
+				prev = uint32(out[len(out)-1])
+			}
+			litState := (pos&(1<<d.lp-1))<<d.lc + prev>>(8-d.lc)
+			probs := d.literal[0x300*litState : 0x300*(litState+1)]
+
+			symbol := uint32(1)
+			if d.state >= 7 {
+				if int(d.reps[0]) >= len(out)-d.dictStart {
+					return fmt.Errorf("xz: invalid match distance")
+				}
+				match := uint32(out[len(out)-int(d.reps[0])-1])
+				for symbol < 0x100 {
+					matchBit := (match >> 7) & 1
+					match <<= 1
+					bit := rc.bit(&probs[((1+matchBit)<<8)+symbol])
+					symbol = symbol<<1 | bit
+					if matchBit != bit {
+						break
+					}
+				}
+			}
+			for symbol < 0x100 {
+				symbol = symbol<<1 | rc.bit(&probs[symbol])
+			}
+			out = append(out, byte(symbol))
+
+			switch {
+			case d.state < 4:
+				d.state = 0
+			case d.state < 10:
+				d.state -= 3
+			default:
+				d.state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&d.isRep[d.state]) == 0 {
+			d.reps[3], d.reps[2], d.reps[1] = d.reps[2], d.reps[1], d.reps[0]
+			length = d.lenDecoder.decode(rc, posState)
+			if d.state < 7 {
+				d.state = 7
+			} else {
+				d.state = 10
+			}
+			d.reps[0] = d.distance(length)
+			if d.reps[0] == 0xffffffff {
+				return fmt.Errorf("xz: unexpected end marker")
+			}
+		} else {
+			if rc.bit(&d.isRepG0[d.state]) == 0 {
+				if rc.bit(&d.isRep0Long[d.state<<lzmaPosBitsMax+posState]) == 0 {
+					if d.state < 7 {
+						d.state = 9
+					} else {
+						d.state = 11
+					}
+					if int(d.reps[0]) >= len(out)-d.dictStart {
+						return fmt.Errorf("xz: invalid match distance")
+					}
+					out = append(out, out[len(out)-int(d.reps[0])-1])
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&d.isRepG1[d.state]) == 0 {
+					dist = d.reps[1]
+				} else {
+					if rc.bit(&d.isRepG2[d.state]) == 0 {
+						dist = d.reps[2]
+					} else {
+						dist = d.reps[3]
+						d.reps[3] = d.reps[2]
+					}
+					d.reps[2] = d.reps[1]
+				}
+				d.reps[1] = d.reps[0]
+				d.reps[0] = dist
+			}
+			length = d.repLen.decode(rc, posState)
+			if d.state < 7 {
+				d.state = 8
+			} else {
+				d.state = 11
+			}
+		}
+
+		n := int(length) + lzmaMatchMinLen
+		dist := int(d.reps[0]) + 1
+		if dist > len(out)-d.dictStart {
+			return fmt.Errorf("xz: invalid match distance")
+		}
+		if len(out)+n > end {
+			return fmt.Errorf("xz: match exceeds chunk size")
+		}
+		start := len(out) - dist
+		for i := 0; i < n; i++ {
+			out = append(out, out[start+i])
+		}
+	}
+
+	*dst = out
+
+	if rc.err != nil {
+		return rc.err
+	}
+	return nil
+}
+
+func (d *lzmaDecoder) distance(length uint32) uint32 {
+	rc := &d.rc
+
+	lenState := length
+	if lenState > lzmaLenToPosStates-1 {
+		lenState = lzmaLenToPosStates - 1
+	}
+
+	slot := rc.bitTree(d.posSlot[lenState][:], 6)
+	if slot < 4 {
+		return slot
+	}
+
+	directBits := (slot >> 1) - 1
+	dist := (2 | (slot & 1)) << directBits
+	if slot < lzmaEndPosModel {
+		return dist + rc.reverseBitTree(d.posSpecial[dist-slot:], directBits)
+	}
+
+	dist += rc.direct(directBits-lzmaAlignBits) << lzmaAlignBits
+	return dist + rc.reverseBitTree(d.align[:], lzmaAlignBits)
+}
+
+func (l *lzmaLenDecoder) decode(rc *lzmaRangeDecoder, posState uint32) uint32 {
+	if rc.bit(&l.choice) == 0 {
+		return rc.bitTree(l.low[posState][:], 3)
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 8 + rc.bitTree(l.mid[posState][:], 3)
+	}
+	return 16 + rc.bitTree(l.high[:], 8)
+}
+
+type lzmaRangeDecoder struct {
+	src   []byte
+	rng   uint32
+	code  uint32
+	err   error
+	extra int
+}
+
+func (rc *lzmaRangeDecoder) init(src []byte) error {
+	if len(src) < 5 || src[0] != 0 {
+		return fmt.Errorf("xz: invalid range coder data")
+	}
+	rc.rng = 0xffffffff
+	rc.code = binary.BigEndian.Uint32(src[1:5])
+	rc.src = src[5:]
+	rc.err = nil
+	return nil
+}
+
+func (rc *lzmaRangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		var b byte
+		if len(rc.src) > 0 {
+			b = rc.src[0]
+			rc.src = rc.src[1:]
+		} else if rc.err == nil {
+			rc.err = fmt.Errorf("xz: truncated lzma data")
+		}
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+func (rc *lzmaRangeDecoder) bit(prob *uint16) uint32 {
+	bound := (rc.rng >> 11) * uint32(*prob)
+	var bit uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*prob += (1<<11 - *prob) >> 5
+	} else {
+		rc.rng -= bound
+		rc.code -= bound
+		*prob -= *prob >> 5
+		bit = 1
+	}
+	rc.normalize()
+	return bit
+}
+
+func (rc *lzmaRangeDecoder) bitTree(probs []uint16, bits uint32) uint32 {
+	m := uint32(1)
+	for i := uint32(0); i < bits; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<bits
+}
+
+func (rc *lzmaRangeDecoder) reverseBitTree(probs []uint16, bits uint32) uint32 {
+	m := uint32(1)
+	var symbol uint32
+	for i := uint32(0); i < bits; i++ {
+		bit := rc.bit(&probs[m])
+		m = m<<1 | bit
+		symbol |= bit << i
+	}
+	return symbol
+}
+
+func (rc *lzmaRangeDecoder) direct(bits uint32) uint32 {
+	var result uint32
+	for i := uint32(0); i < bits; i++ {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		rc.normalize()
+		result = result<<1 + t + 1
+	}
+	return result
+}
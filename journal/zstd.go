@@ -0,0 +1,898 @@
+package journal
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// decompressZstd decompresses a data object payload compressed with zstd.
+// Dictionaries aren't supported, and content checksums aren't verified.
+// https://www.rfc-editor.org/rfc/rfc8878
+func decompressZstd(src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, fmt.Errorf("zstd: empty payload")
+	}
+
+	var dst []byte
+
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, fmt.Errorf("zstd: truncated frame")
+		}
+
+		magic := binary.LittleEndian.Uint32(src)
+		switch {
+		case magic == zstdMagic:
+			n, err := decodeZstdFrame(src[4:], &dst)
+			if err != nil {
+				return nil, err
+			}
+			src = src[4+n:]
+
+		case magic&0xfffffff0 == zstdSkippableMagic:
+			if len(src) < 8 {
+				return nil, fmt.Errorf("zstd: truncated skippable frame")
+			}
+			size := uint64(binary.LittleEndian.Uint32(src[4:]))
+			if uint64(len(src)) < 8+size {
+				return nil, fmt.Errorf("zstd: truncated skippable frame")
+			}
+			src = src[8+size:]
+
+		default:
+			return nil, fmt.Errorf("zstd: invalid magic number %#x", magic)
+		}
+	}
+
+	return dst, nil
+}
+
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+
+	zstdMaxBlockSize = 128 << 10
+
+	zstdMaxLLAccuracy      = 9
+	zstdMaxMLAccuracy      = 9
+	zstdMaxOFAccuracy      = 8
+	zstdMaxHuffmanAccuracy = 6
+	zstdMaxHuffmanBits     = 11
+)
+
+// zstdFrame holds the state that carries over between blocks of a frame
+type zstdFrame struct {
+	start   int
+	huffman *huffmanTable
+	ll      *fseTable
+	of      *fseTable
+	ml      *fseTable
+	offsets [3]uint64
+}
+
+func decodeZstdFrame(src []byte, dst *[]byte) (int, error) {
+	if len(src) < 1 {
+		return 0, fmt.Errorf("zstd: truncated frame header")
+	}
+
+	descriptor := src[0]
+	pos := 1
+
+	if descriptor&0x08 != 0 {
+		return 0, fmt.Errorf("zstd: reserved bit set in frame header")
+	}
+	singleSegment := descriptor&0x20 != 0
+	checksum := descriptor&0x04 != 0
+
+	if !singleSegment {
+		// window size, not needed since the whole output is kept
+		pos++
+	}
+
+	dictIDSize := [4]int{0, 1, 2, 4}[descriptor&0x03]
+	if pos+dictIDSize > len(src) {
+		return 0, fmt.Errorf("zstd: truncated frame header")
+	}
+	for i := 0; i < dictIDSize; i++ {
+		if src[pos+i] != 0 {
+			return 0, fmt.Errorf("zstd: dictionaries are not supported")
+		}
+	}
+	pos += dictIDSize
+
+	contentSizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeSize == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	pos += contentSizeSize
+	if pos > len(src) {
+		return 0, fmt.Errorf("zstd: truncated frame header")
+	}
+
+	frame := &zstdFrame{
+		start:   len(*dst),
+		offsets: [3]uint64{1, 4, 8},
+	}
+
+	for {
+		if pos+3 > len(src) {
+			return 0, fmt.Errorf("zstd: truncated block header")
+		}
+		header := uint32(src[pos]) | uint32(src[pos+1])<<8 | uint32(src[pos+2])<<16
+		pos += 3
+
+		last := header&1 != 0
+		size := int(header >> 3)
+
+		switch (header >> 1) & 0x03 {
+		case 0:
+			if pos+size > len(src) {
+				return 0, fmt.Errorf("zstd: truncated raw block")
+			}
+			*dst = append(*dst, src[pos:pos+size]...)
+			pos += size
+
+		case 1:
+			if pos+1 > len(src) || size > zstdMaxBlockSize {
+				return 0, fmt.Errorf("zstd: invalid rle block")
+			}
+			for i := 0; i < size; i++ {
+				*dst = append(*dst, src[pos])
+			}
+			pos++
+
+		case 2:
+			if pos+size > len(src) || size > zstdMaxBlockSize {
+				return 0, fmt.Errorf("zstd: invalid compressed block")
+			}
+			err := frame.decodeBlock(src[pos:pos+size], dst)
+			if err != nil {
+				return 0, err
+			}
+			pos += size
+
+		default:
+			return 0, fmt.Errorf("zstd: reserved block type")
+		}
+
+		if len(*dst) > maxObjectSize {
+			return 0, fmt.Errorf("zstd: output too large")
+		}
+
+		if last {
+			break
+		}
+	}
+
+	if checksum {
+		pos += 4
+		if pos > len(src) {
+			return 0, fmt.Errorf("zstd: truncated checksum")
+		}
+	}
+
+	return pos, nil
+}
+
+func (f *zstdFrame) decodeBlock(src []byte, dst *[]byte) error {
+	literals, n, err := f.decodeLiterals(src)
+	if err != nil {
+		return err
+	}
+	src = src[n:]
+
+	if len(src) < 1 {
+		return fmt.Errorf("zstd: truncated sequences section")
+	}
+
+	var sequences int
+	switch b0 := int(src[0]); {
+	case b0 < 128:
+		sequences = b0
+		src = src[1:]
+	case b0 < 255:
+		if len(src) < 2 {
+			return fmt.Errorf("zstd: truncated sequences section")
+		}
+		sequences = (b0-128)<<8 + int(src[1])
+		src = src[2:]
+	default:
+		if len(src) < 3 {
+			return fmt.Errorf("zstd: truncated sequences section")
+		}
+		sequences = int(src[1]) + int(src[2])<<8 + 0x7f00
+		src = src[3:]
+	}
+
+	if sequences == 0 {
+		*dst = append(*dst, literals...)
+		return nil
+	}
+
+	if len(src) < 1 {
+		return fmt.Errorf("zstd: truncated sequences section")
+	}
+	modes := src[0]
+	src = src[1:]
+	if modes&0x03 != 0 {
+		return fmt.Errorf("zstd: reserved bits set in compression modes")
+	}
+
+	tables := []struct {
+		mode       byte
+		table      **fseTable
+		predefined *fseTable
+		accuracy   uint
+		maxSymbol  int
+	}{
+		{modes >> 6, &f.ll, zstdPredefinedLL, zstdMaxLLAccuracy, 35},
+		{(modes >> 4) & 0x03, &f.of, zstdPredefinedOF, zstdMaxOFAccuracy, 31},
+		{(modes >> 2) & 0x03, &f.ml, zstdPredefinedML, zstdMaxMLAccuracy, 52},
+	}
+	for _, t := range tables {
+		switch t.mode {
+		case 0:
+			*t.table = t.predefined
+		case 1:
+			if len(src) < 1 {
+				return fmt.Errorf("zstd: truncated rle table")
+			}
+			if int(src[0]) > t.maxSymbol {
+				return fmt.Errorf("zstd: invalid rle symbol")
+			}
+			*t.table = rleFSETable(src[0])
+			src = src[1:]
+		case 2:
+			table, n, err := readFSETable(src, t.accuracy, t.maxSymbol)
+			if err != nil {
+				return err
+			}
+			*t.table = table
+			src = src[n:]
+		case 3:
+			if *t.table == nil {
+				return fmt.Errorf("zstd: repeat table without previous table")
+			}
+		}
+	}
+
+	return f.executeSequences(src, sequences, literals, dst)
+}
+
+func (f *zstdFrame) decodeLiterals(src []byte) ([]byte, int, error) {
+	if len(src) < 1 {
+		return nil, 0, fmt.Errorf("zstd: truncated literals section")
+	}
+
+	b0 := int(src[0])
+	litType := b0 & 0x03
+	sizeFormat := (b0 >> 2) & 0x03
+
+	if litType == 0 || litType == 1 {
+		var size, headerSize int
+		switch sizeFormat {
+		case 0, 2:
+			size, headerSize = b0>>3, 1
+		case 1:
+			if len(src) < 2 {
+				return nil, 0, fmt.Errorf("zstd: truncated literals header")
+			}
+			size, headerSize = b0>>4+int(src[1])<<4, 2
+		case 3:
+			if len(src) < 3 {
+				return nil, 0, fmt.Errorf("zstd: truncated literals header")
+			}
+			size, headerSize = b0>>4+int(src[1])<<4+int(src[2])<<12, 3
+		}
+
+		if litType == 0 {
+			if headerSize+size > len(src) {
+				return nil, 0, fmt.Errorf("zstd: truncated raw literals")
+			}
+			return src[headerSize : headerSize+size], headerSize + size, nil
+		}
+
+		if headerSize+1 > len(src) || size > zstdMaxBlockSize {
+			return nil, 0, fmt.Errorf("zstd: invalid rle literals")
+		}
+		literals := make([]byte, size)
+		for i := range literals {
+			literals[i] = src[headerSize]
+		}
+		return literals, headerSize + 1, nil
+	}
+
+	var (
+		headerSize int
+		sizeBits   uint
+		streams    = 4
+	)
+	switch sizeFormat {
+	case 0:
+		headerSize, sizeBits, streams = 3, 10, 1
+	case 1:
+		headerSize, sizeBits = 3, 10
+	case 2:
+		headerSize, sizeBits = 4, 14
+	case 3:
+		headerSize, sizeBits = 5, 18
+	}
+	if len(src) < headerSize {
+		return nil, 0, fmt.Errorf("zstd: truncated literals header")
+	}
+
+	var header uint64
+	for i := headerSize - 1; i >= 0; i-- {
+		header = header<<8 | uint64(src[i])
+	}
+	mask := uint64(1)<<sizeBits - 1
+	regenerated := int((header >> 4) & mask)
+	compressed := int((header >> (4 + sizeBits)) & mask)
+
+	if headerSize+compressed > len(src) || regenerated > zstdMaxBlockSize {
+		return nil, 0, fmt.Errorf("zstd: invalid compressed literals")
+	}
+	data := src[headerSize : headerSize+compressed]
+
+	if litType == 2 {
+		table, n, err := readHuffmanTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		f.huffman = table
+		data = data[n:]
+	} else if f.huffman == nil {
+		return nil, 0, fmt.Errorf("zstd: treeless literals without previous table")
+	}
+
+	literals := make([]byte, 0, regenerated)
+
+	if streams == 1 {
+		var err error
+		literals, err = f.huffman.decodeStream(data, literals)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		if len(data) < 6 {
+			return nil, 0, fmt.Errorf("zstd: truncated literals jump table")
+		}
+		sizes := [4]int{
+			int(binary.LittleEndian.Uint16(data[0:])),
+			int(binary.LittleEndian.Uint16(data[2:])),
+			int(binary.LittleEndian.Uint16(data[4:])),
+		}
+		data = data[6:]
+		sizes[3] = len(data) - sizes[0] - sizes[1] - sizes[2]
+		if sizes[3] < 0 {
+			return nil, 0, fmt.Errorf("zstd: invalid literals jump table")
+		}
+
+		for _, size := range sizes {
+			var err error
+			literals, err = f.huffman.decodeStream(data[:size], literals)
+			if err != nil {
+				return nil, 0, err
+			}
+			data = data[size:]
+		}
+	}
+
+	if len(literals) != regenerated {
+		return nil, 0, fmt.Errorf("zstd: expected %d literals, decoded %d", regenerated, len(literals))
+	}
+
+	return literals, headerSize + compressed, nil
+}
+
+var (
+	zstdLLBaselines = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLLExtraBits = [36]uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMLBaselines = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMLExtraBits = [53]uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	zstdPredefinedLL = mustFSETable([]int{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}, 6)
+	zstdPredefinedML = mustFSETable([]int{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6)
+	zstdPredefinedOF = mustFSETable([]int{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}, 5)
+)
+
+func (f *zstdFrame) executeSequences(src []byte, sequences int, literals []byte, dst *[]byte) error {
+	br, err := newBackwardBitReader(src)
+	if err != nil {
+		return err
+	}
+
+	llState := br.read(f.ll.accuracy)
+	ofState := br.read(f.of.accuracy)
+	mlState := br.read(f.ml.accuracy)
+
+	out := *dst
+	for i := 0; i < sequences; i++ {
+		ofCode := f.of.symbols[ofState]
+		llCode := f.ll.symbols[llState]
+		mlCode := f.ml.symbols[mlState]
+
+		if ofCode > 31 || int(llCode) >= len(zstdLLBaselines) || int(mlCode) >= len(zstdMLBaselines) {
+			return fmt.Errorf("zstd: invalid sequence codes")
+		}
+
+		offsetValue := uint64(1)<<ofCode + br.read(uint(ofCode))
+		matchLength := uint64(zstdMLBaselines[mlCode]) + br.read(zstdMLExtraBits[mlCode])
+		literalLength := uint64(zstdLLBaselines[llCode]) + br.read(zstdLLExtraBits[llCode])
+
+		if i != sequences-1 {
+			llState = f.ll.next(llState, br)
+			mlState = f.ml.next(mlState, br)
+			ofState = f.of.next(ofState, br)
+		}
+
+		var offset uint64
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			f.offsets[2], f.offsets[1], f.offsets[0] = f.offsets[1], f.offsets[0], offset
+		} else {
+			idx := offsetValue - 1
+			if literalLength == 0 {
+				idx++
+			}
+			switch idx {
+			case 0:
+				offset = f.offsets[0]
+			case 3:
+				offset = f.offsets[0] - 1
+			default:
+				offset = f.offsets[idx]
+			}
+			if idx > 0 {
+				if idx > 1 {
+					f.offsets[2] = f.offsets[1]
+				}
+				f.offsets[1] = f.offsets[0]
+				f.offsets[0] = offset
+			}
+		}
+
+		if literalLength > uint64(len(literals)) {
+			return fmt.Errorf("zstd: sequence literals exceed literals section")
+		}
+		out = append(out, literals[:literalLength]...)
+		literals = literals[literalLength:]
+
+		if offset == 0 || offset > uint64(len(out)-f.start) {
+			return fmt.Errorf("zstd: invalid match offset %d", offset)
+		}
+		if matchLength > zstdMaxBlockSize {
+			return fmt.Errorf("zstd: invalid match length %d", matchLength)
+		}
+		start := len(out) - int(offset)
+		for j := 0; j < int(matchLength); j++ {
+			out = append(out, out[start+j])
+		}
+	}
+
+	if br.offset != 0 {
+		return fmt.Errorf("zstd: sequences bitstream not fully consumed")
+	}
+
+	*dst = append(out, literals...)
+	return nil
+}
+
+// backwardBitReader reads a bitstream from the end towards the start, as
+// used by both huffman and FSE coded data. The last byte has a marker bit
+// above the final bit of data. Reading past the start yields zeros and makes
+// the offset negative.
+type backwardBitReader struct {
+	src    []byte
+	offset int
+}
+
+func newBackwardBitReader(src []byte) (*backwardBitReader, error) {
+	if len(src) == 0 || src[len(src)-1] == 0 {
+		return nil, fmt.Errorf("zstd: invalid bitstream")
+	}
+	return &backwardBitReader{
+		src:    src,
+		offset: len(src)*8 - (8 - highestBit(uint32(src[len(src)-1]))),
+	}, nil
+}
+
+func (br *backwardBitReader) read(bits uint) uint64 {
+	if bits == 0 {
+		return 0
+	}
+
+	br.offset -= int(bits)
+	offset := br.offset
+	actual := int(bits)
+	if offset < 0 {
+		actual += offset
+		offset = 0
+	}
+
+	var v uint64
+	if actual > 0 {
+		v = readBitsLE(br.src, uint(actual), offset)
+	}
+	if br.offset < 0 {
+		shift := uint(-br.offset)
+		if shift >= 64 {
+			return 0
+		}
+		v <<= shift
+	}
+	return v
+}
+
+// readBitsLE reads bits starting at the given bit offset, least significant
+// bit first
+func readBitsLE(src []byte, bits uint, offset int) uint64 {
+	var v uint64
+	var shift uint
+	for bits > 0 {
+		index := offset / 8
+		bitOffset := uint(offset % 8)
+		available := 8 - bitOffset
+		if available > bits {
+			available = bits
+		}
+		var b byte
+		if index < len(src) {
+			b = src[index]
+		}
+		v |= uint64((b>>bitOffset)&(1<<available-1)) << shift
+		shift += available
+		bits -= available
+		offset += int(available)
+	}
+	return v
+}
+
+// highestBit returns the position of the most significant set bit
+func highestBit(v uint32) int {
+	n := -1
+	for v != 0 {
+		v >>= 1
+		n++
+	}
+	return n
+}
+
+type fseTable struct {
+	accuracy uint
+	symbols  []uint8
+	bits     []uint8
+	base     []uint16
+}
+
+func (t *fseTable) next(state uint64, br *backwardBitReader) uint64 {
+	return uint64(t.base[state]) + br.read(uint(t.bits[state]))
+}
+
+func rleFSETable(symbol byte) *fseTable {
+	return &fseTable{
+		symbols: []uint8{symbol},
+		bits:    []uint8{0},
+		base:    []uint16{0},
+	}
+}
+
+func mustFSETable(probabilities []int, accuracy uint) *fseTable {
+	t, err := buildFSETable(probabilities, accuracy)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// readFSETable reads a table description, returning the table and the number
+// of bytes consumed
+func readFSETable(src []byte, maxAccuracy uint, maxSymbol int) (*fseTable, int, error) {
+	offset := 0
+	read := func(bits uint) int {
+		v := readBitsLE(src, bits, offset)
+		offset += int(bits)
+		return int(v)
+	}
+
+	accuracy := uint(read(4)) + 5
+	if accuracy > maxAccuracy {
+		return nil, 0, fmt.Errorf("zstd: fse accuracy %d too large", accuracy)
+	}
+
+	remaining := 1 << accuracy
+	var probabilities []int
+
+	for remaining > 0 && len(probabilities) <= maxSymbol {
+		bits := uint(highestBit(uint32(remaining+1)) + 1)
+		value := read(bits)
+
+		lowerMask := 1<<(bits-1) - 1
+		threshold := 1<<bits - 1 - (remaining + 1)
+		if value&lowerMask < threshold {
+			offset--
+			value &= lowerMask
+		} else if value > lowerMask {
+			value -= threshold
+		}
+
+		probability := value - 1
+		if probability < 0 {
+			remaining += probability
+		} else {
+			remaining -= probability
+		}
+		probabilities = append(probabilities, probability)
+
+		if probability == 0 {
+			for {
+				repeat := read(2)
+				for i := 0; i < repeat && len(probabilities) <= maxSymbol; i++ {
+					probabilities = append(probabilities, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+	}
+
+	if remaining != 0 || len(probabilities) > maxSymbol+1 {
+		return nil, 0, fmt.Errorf("zstd: invalid fse table description")
+	}
+
+	n := (offset + 7) / 8
+	if n > len(src) {
+		return nil, 0, fmt.Errorf("zstd: truncated fse table description")
+	}
+
+	t, err := buildFSETable(probabilities, accuracy)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return t, n, nil
+}
+
+func buildFSETable(probabilities []int, accuracy uint) (*fseTable, error) {
+	size := 1 << accuracy
+	t := &fseTable{
+		accuracy: accuracy,
+		symbols:  make([]uint8, size),
+		bits:     make([]uint8, size),
+		base:     make([]uint16, size),
+	}
+
+	next := make([]int, len(probabilities))
+
+	// symbols with a "less than one" probability get a single cell each at
+	// the end of the table
+	high := size
+	for s, p := range probabilities {
+		if p == -1 {
+			high--
+			t.symbols[high] = uint8(s)
+			next[s] = 1
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	mask := size - 1
+	pos := 0
+	for s, p := range probabilities {
+		if p <= 0 {
+			continue
+		}
+		next[s] = p
+		for i := 0; i < p; i++ {
+			t.symbols[pos] = uint8(s)
+			for {
+				pos = (pos + step) & mask
+				if pos < high {
+					break
+				}
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, fmt.Errorf("zstd: invalid fse table")
+	}
+
+	for i := 0; i < size; i++ {
+		s := t.symbols[i]
+		state := next[s]
+		next[s]++
+		t.bits[i] = uint8(int(accuracy) - highestBit(uint32(state)))
+		t.base[i] = uint16(state<<t.bits[i] - size)
+	}
+
+	return t, nil
+}
+
+type huffmanTable struct {
+	maxBits uint
+	symbols []uint8
+	bits    []uint8
+}
+
+// readHuffmanTable reads a huffman tree description, returning the table and
+// the number of bytes consumed
+func readHuffmanTable(src []byte) (*huffmanTable, int, error) {
+	if len(src) < 1 {
+		return nil, 0, fmt.Errorf("zstd: truncated huffman tree description")
+	}
+
+	var (
+		weights []uint8
+		n       int
+	)
+
+	header := int(src[0])
+	if header < 128 {
+		// weights are FSE compressed, using two interleaved states
+		n = 1 + header
+		if n > len(src) {
+			return nil, 0, fmt.Errorf("zstd: truncated huffman weights")
+		}
+		data := src[1:n]
+
+		table, tableSize, err := readFSETable(data, zstdMaxHuffmanAccuracy, 255)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		br, err := newBackwardBitReader(data[tableSize:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		state1 := br.read(table.accuracy)
+		state2 := br.read(table.accuracy)
+		for len(weights) < 255 {
+			weights = append(weights, table.symbols[state1])
+			state1 = table.next(state1, br)
+			if br.offset < 0 {
+				weights = append(weights, table.symbols[state2])
+				break
+			}
+
+			weights = append(weights, table.symbols[state2])
+			state2 = table.next(state2, br)
+			if br.offset < 0 {
+				weights = append(weights, table.symbols[state1])
+				break
+			}
+		}
+	} else {
+		count := header - 127
+		n = 1 + (count+1)/2
+		if n > len(src) {
+			return nil, 0, fmt.Errorf("zstd: truncated huffman weights")
+		}
+		for i := 0; i < count; i++ {
+			b := src[1+i/2]
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+			} else {
+				weights = append(weights, b&0x0f)
+			}
+		}
+	}
+
+	if len(weights) > 255 {
+		return nil, 0, fmt.Errorf("zstd: too many huffman weights")
+	}
+
+	// the weight of the last symbol is implied by the others summing to a
+	// power of two
+	var sum uint32
+	for _, w := range weights {
+		if w > zstdMaxHuffmanBits {
+			return nil, 0, fmt.Errorf("zstd: invalid huffman weight %d", w)
+		}
+		if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+	if sum == 0 {
+		return nil, 0, fmt.Errorf("zstd: invalid huffman weights")
+	}
+
+	maxBits := uint(highestBit(sum) + 1)
+	left := uint32(1)<<maxBits - sum
+	if left&(left-1) != 0 || maxBits > zstdMaxHuffmanBits {
+		return nil, 0, fmt.Errorf("zstd: invalid huffman weights")
+	}
+	weights = append(weights, uint8(highestBit(left)+1))
+
+	bits := make([]uint8, len(weights))
+	var counts [zstdMaxHuffmanBits + 1]int
+	for i, w := range weights {
+		if w > 0 {
+			bits[i] = uint8(maxBits + 1 - uint(w))
+			counts[bits[i]]++
+		}
+	}
+
+	t := &huffmanTable{
+		maxBits: maxBits,
+		symbols: make([]uint8, 1<<maxBits),
+		bits:    make([]uint8, 1<<maxBits),
+	}
+
+	// codes are assigned to the longest codes first
+	var starts [zstdMaxHuffmanBits + 2]int
+	for b := maxBits; b >= 1; b-- {
+		starts[b-1] = starts[b] + counts[b]*(1<<(maxBits-b))
+		for i := starts[b]; i < starts[b-1]; i++ {
+			t.bits[i] = uint8(b)
+		}
+	}
+	for symbol, b := range bits {
+		if b == 0 {
+			continue
+		}
+		length := 1 << (maxBits - uint(b))
+		for i := 0; i < length; i++ {
+			t.symbols[starts[b]+i] = uint8(symbol)
+		}
+		starts[b] += length
+	}
+
+	return t, n, nil
+}
+
+func (t *huffmanTable) decodeStream(src []byte, dst []byte) ([]byte, error) {
+	br, err := newBackwardBitReader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := uint64(1)<<t.maxBits - 1
+	state := br.read(t.maxBits)
+	for br.offset > -int(t.maxBits) {
+		dst = append(dst, t.symbols[state])
+		bits := uint(t.bits[state])
+		state = (state<<bits + br.read(bits)) & mask
+
+		if len(dst) > zstdMaxBlockSize {
+			return nil, fmt.Errorf("zstd: too many literals")
+		}
+	}
+
+	if br.offset != -int(t.maxBits) {
+		return nil, fmt.Errorf("zstd: corrupt huffman stream")
+	}
+
+	return dst, nil
+}
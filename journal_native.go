@@ -0,0 +1,132 @@
+package loglet
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/uswitch/loglet/journal"
+)
+
+// how often to look for changes to journal files in case inotify missed them,
+// e.g. because the journal directory didn't exist yet
+const journalPollInterval = 5 * time.Second
+
+// journalFileFollower reads entries straight from the journal files, rather
+// than through journalctl
+type journalFileFollower struct {
+	ret     chan error
+	entries chan *JournalEntry
+}
+
+func NewJournalFileFollower(dirs []string, start StartPosition, done <-chan struct{}) JournalFollower {
+	ret := make(chan error, 1)
+	entries := make(chan *JournalEntry, stageBuffer)
+
+	follower := &journalFileFollower{
+		ret:     ret,
+		entries: entries,
+	}
+	go follower.loop(dirs, start, done)
+
+	return follower
+}
+
+func (j *journalFileFollower) Ret() <-chan error {
+	return j.ret
+}
+
+func (j *journalFileFollower) Entries() <-chan *JournalEntry {
+	return j.entries
+}
+
+func (j *journalFileFollower) loop(dirs []string, start StartPosition, done <-chan struct{}) {
+	defer close(j.ret)
+	defer close(j.entries)
+
+	// start watching before reading, so no changes are missed in between
+	watcher, err := journal.NewWatcher(dirs)
+	if err != nil {
+		j.ret <- err
+		return
+	}
+	defer watcher.Close()
+
+	reader, err := journal.NewReader(dirs)
+	if err != nil {
+		j.ret <- err
+		return
+	}
+	defer reader.Close()
+
+	switch {
+	case start.Cursor != "":
+		err := reader.SeekCursor(start.Cursor)
+		if err != nil {
+			j.ret <- fmt.Errorf("journal: unable to seek to cursor: %s", err)
+			return
+		}
+	case start.Head:
+		reader.SeekHead()
+	case !start.Since.IsZero():
+		err := reader.SeekRealtime(uint64(start.Since.UnixNano() / 1000))
+		if err != nil {
+			j.ret <- fmt.Errorf("journal: unable to seek to %s: %s", start.Since, err)
+			return
+		}
+	default:
+		reader.SeekTail()
+	}
+
+	poll := time.NewTicker(journalPollInterval)
+	defer poll.Stop()
+
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			j.ret <- err
+			return
+		}
+
+		if entry == nil {
+			select {
+			case <-done:
+				return
+			case <-watcher.Changes():
+			case <-poll.C:
+			}
+
+			err := reader.Refresh()
+			if err != nil {
+				j.ret <- err
+				return
+			}
+			continue
+		}
+
+		journalEntriesRead.Inc()
+
+		select {
+		case <-done:
+			return
+		case j.entries <- toJournalEntry(entry):
+			continue
+		}
+	}
+}
+
+// toJournalEntry adds the same address fields journalctl does in its export
+// format
+func toJournalEntry(entry *journal.Entry) *JournalEntry {
+	cursor := entry.Cursor()
+
+	fields := entry.Fields
+	fields["__CURSOR"] = cursor
+	fields["__REALTIME_TIMESTAMP"] = strconv.FormatUint(entry.Realtime, 10)
+	fields["__MONOTONIC_TIMESTAMP"] = strconv.FormatUint(entry.Monotonic, 10)
+
+	return &JournalEntry{
+		Cursor: cursor,
+		Fields: fields,
+	}
+}
@@ -0,0 +1,172 @@
+package loglet
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	kafka "github.com/Shopify/sarama"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/metrics"
+	"github.com/uswitch/loglet/types"
+)
+
+var messageKeyMissing = metrics.NewCounter("loglet_message_key_missing_total", "Messages sent without a key because a key field was missing.")
+
+// messageKeyer picks the kafka message key for each message, either by
+// joining the values of a list of fields or from a template. Messages with
+// the same key go to the same partition, so ordering is kept per key.
+type messageKeyer struct {
+	fields   []string
+	template *template.Template
+}
+
+// keySeparator joins the values of key fields
+const keySeparator = "/"
+
+func newMessageKeyer(loglet *options.Loglet) (*messageKeyer, error) {
+	if len(loglet.KeyFields) > 0 && loglet.KafkaKey != "" {
+		return nil, fmt.Errorf("only one of --key-field and --key can be used")
+	}
+
+	keyer := &messageKeyer{fields: loglet.KeyFields}
+
+	if loglet.KafkaKey != "" {
+		key, err := template.New("key").Option("missingkey=error").Parse(loglet.KafkaKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key template '%s': %s", loglet.KafkaKey, err)
+		}
+		keyer.template = key
+	}
+
+	return keyer, nil
+}
+
+// key returns the key for a message, or nil if no key is configured or a
+// field it needs is missing, in which case the partitioner picks a partition
+// without one
+func (k *messageKeyer) key(m *types.LogMessage) []byte {
+	var buf bytes.Buffer
+
+	switch {
+	case k.template != nil:
+		err := k.template.Execute(&buf, m.Fields)
+		if err != nil {
+			messageKeyMissing.Inc()
+			return nil
+		}
+
+	case len(k.fields) > 0:
+		for i, field := range k.fields {
+			val, ok := m.Fields[field]
+			if !ok {
+				messageKeyMissing.Inc()
+				return nil
+			}
+			if i > 0 {
+				buf.WriteString(keySeparator)
+			}
+			fmt.Fprint(&buf, val)
+		}
+
+	default:
+		return nil
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+// newPartitioner returns the constructor for a partitioner by name:
+//
+//	hash       FNV-1a hash of the key, as sarama does by default
+//	murmur2    murmur2 hash of the key, matching the java client
+//	roundrobin ignores the key and spreads messages over partitions in turn
+//	random     ignores the key
+//
+// Messages without a key go to a random partition with hash and murmur2.
+func newPartitioner(name string) (kafka.PartitionerConstructor, error) {
+	switch name {
+	case "hash", "":
+		return kafka.NewHashPartitioner, nil
+	case "murmur2":
+		return newMurmur2Partitioner, nil
+	case "roundrobin":
+		return kafka.NewRoundRobinPartitioner, nil
+	case "random":
+		return kafka.NewRandomPartitioner, nil
+	}
+	return nil, fmt.Errorf("unknown partitioner '%s'", name)
+}
+
+// murmur2Partitioner partitions messages the same way as the default
+// partitioner in the java client, so messages with the same key end up on the
+// same partition whichever client produced them
+type murmur2Partitioner struct {
+	random kafka.Partitioner
+}
+
+func newMurmur2Partitioner(topic string) kafka.Partitioner {
+	return &murmur2Partitioner{random: kafka.NewRandomPartitioner(topic)}
+}
+
+func (p *murmur2Partitioner) Partition(message *kafka.ProducerMessage, numPartitions int32) (int32, error) {
+	if message.Key == nil {
+		return p.random.Partition(message, numPartitions)
+	}
+	key, err := message.Key.Encode()
+	if err != nil {
+		return -1, err
+	}
+	// the java client masks off the sign bit rather than taking the
+	// absolute value
+	return (murmur2(key) & 0x7fffffff) % numPartitions, nil
+}
+
+func (p *murmur2Partitioner) RequiresConsistency() bool {
+	return true
+}
+
+// murmur2 is the 32 bit murmur2 hash with the seed used by the java client
+// (org.apache.kafka.common.utils.Utils.murmur2)
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+
+	for ; len(data) >= 4; data = data[4:] {
+		k := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
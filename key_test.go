@@ -0,0 +1,105 @@
+package loglet
+
+import (
+	"testing"
+
+	kafka "github.com/Shopify/sarama"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/types"
+)
+
+func TestMessageKeyer(t *testing.T) {
+	fields := map[string]interface{}{
+		"hostname":     "host-1",
+		"systemd_unit": "kubelet.service",
+		"priority":     6,
+	}
+
+	tests := []struct {
+		keyFields []string
+		key       string
+		expected  string
+	}{
+		{nil, "", ""},
+		{[]string{"systemd_unit"}, "", "kubelet.service"},
+		{[]string{"hostname", "systemd_unit", "priority"}, "", "host-1/kubelet.service/6"},
+		{[]string{"hostname", "container_id"}, "", ""},
+		{nil, "{{.hostname}}-{{.systemd_unit}}", "host-1-kubelet.service"},
+		{nil, "{{.container_id}}", ""},
+	}
+
+	for _, test := range tests {
+		loglet := options.NewLoglet()
+		loglet.KeyFields = test.keyFields
+		loglet.KafkaKey = test.key
+
+		keyer, err := newMessageKeyer(loglet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := keyer.key(&types.LogMessage{Fields: fields})
+		if string(key) != test.expected {
+			t.Errorf("expected key %q for fields %v, template %q, was %q", test.expected, test.keyFields, test.key, key)
+		}
+		if test.expected == "" && key != nil {
+			t.Errorf("expected nil key for fields %v, template %q", test.keyFields, test.key)
+		}
+	}
+
+	loglet := options.NewLoglet()
+	loglet.KeyFields = []string{"hostname"}
+	loglet.KafkaKey = "{{.hostname}}"
+	_, err := newMessageKeyer(loglet)
+	if err == nil {
+		t.Error("expected error using both key fields and a key template")
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// from the java client's tests
+	tests := []struct {
+		key      string
+		expected int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+
+	for _, test := range tests {
+		hash := murmur2([]byte(test.key))
+		if hash != test.expected {
+			t.Errorf("expected murmur2(%q) to be %d, was %d", test.key, test.expected, hash)
+		}
+	}
+}
+
+func TestMurmur2Partitioner(t *testing.T) {
+	p := newMurmur2Partitioner("logs")
+
+	for _, key := range []string{"21", "foobar", "abc"} {
+		partition, err := p.Partition(&kafka.ProducerMessage{Key: kafka.StringEncoder(key)}, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := (murmur2([]byte(key)) & 0x7fffffff) % 7
+		if partition != expected {
+			t.Errorf("expected key %s on partition %d, was %d", key, expected, partition)
+		}
+	}
+
+	partition, err := p.Partition(&kafka.ProducerMessage{}, 7)
+	if err != nil || partition < 0 || partition >= 7 {
+		t.Errorf("expected random partition for message without key, was %d: %v", partition, err)
+	}
+
+	_, err = newPartitioner("consistent")
+	if err == nil {
+		t.Error("expected error for unknown partitioner")
+	}
+}
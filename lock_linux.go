@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package loglet
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive lock on the file, failing straight away if
+// another process holds it
+func lockFile(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file: %s", err)
+	}
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is locked by another process", filename)
+		}
+		return nil, fmt.Errorf("unable to lock %s: %s", filename, err)
+	}
+
+	return f, nil
+}
+
+func unlockFile(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package loglet
+
+import (
+	"os"
+)
+
+// lockFile only opens the file, locking is only implemented for linux
+func lockFile(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+}
+
+func unlockFile(f *os.File) error {
+	return f.Close()
+}
@@ -5,68 +5,232 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/uswitch/loglet/cmd/loglet/options"
 )
 
+// stageBuffer is how many entries or messages each stage of the pipeline
+// can get ahead of the next by, so the backlog metrics show where it's
+// held up
+const stageBuffer = 100
+
 func Run(loglet *options.Loglet) error {
 	var returnErr error
+
+	// stop is closed to stop reading the journal, after which the rest of
+	// the pipeline drains as each stage's input is closed. done is closed
+	// to make every stage return straight away.
+	stop := make(chan struct{})
 	done := make(chan struct{})
 
-	cursorState := NewCursorState(loglet.CursorFile)
+	if loglet.CursorRecovery == "since" && loglet.CursorRecoverySince.IsZero() {
+		return fmt.Errorf("--cursor-recovery=since requires --cursor-recovery-since")
+	}
+
+	cursorState, err := NewCursorState(loglet.CursorFile)
+	if err != nil {
+		return fmt.Errorf("unable to lock cursor state: %s", err)
+	}
+	defer cursorState.Close()
+
 	cursor, err := cursorState.Cursor()
 	if err != nil {
 		return fmt.Errorf("unable to read cursor state: %s", err)
 	}
+	start := startPosition(loglet, cursor)
+
+	var rets []<-chan error
 
-	journal := NewJournalFollower(cursor, done)
+	// metrics are served while the pipeline drains, so aren't waited for
+	// along with the rest of it
+	var metricsRet <-chan error
+	if loglet.MetricsListen != "" {
+		server, err := NewMetricsServer(loglet.MetricsListen, done)
+		if err != nil {
+			return err
+		}
+		metricsRet = server.Ret()
+	}
+
+	var spool *diskSpool
+	if loglet.SpoolDir != "" {
+		spool, err = OpenSpool(loglet.SpoolDir, loglet.SpoolSegmentSize, loglet.SpoolMaxSize, start.Cursor)
+		if err != nil {
+			return fmt.Errorf("unable to open spool: %s", err)
+		}
+		defer spool.Close()
+
+		// anything up to the last spooled message will be replayed from
+		// the spool rather than the journal
+		if spooledCursor := spool.LastCursor(); spooledCursor != "" {
+			start = StartPosition{Cursor: spooledCursor}
+		}
+	}
+
+	var journal JournalFollower
+	switch loglet.JournalReader {
+	case "native":
+		journal = NewJournalFileFollower(loglet.JournalDirs, start, stop)
+	default:
+		journal = NewJournalFollower(start, stop)
+	}
 
 	filter, err := NewJournalEntryFilter(loglet, journal.Entries(), done)
 	if err != nil {
 		return fmt.Errorf("unable to create filter: %s", err)
 	}
 
-	transformer := NewJournalEntryTransformer(loglet, filter.Entries(), done)
+	rets = append(rets, journal.Ret(), filter.Ret())
+	recordBacklog("journal", func() int { return len(journal.Entries()) })
+	recordBacklog("filter", func() int { return len(filter.Entries()) })
+
+	entries := filter.Entries()
+	if loglet.PartialMessages {
+		joiner := NewJournalEntryJoiner(loglet, entries, done)
+		rets = append(rets, joiner.Ret())
+		entries = joiner.Entries()
+		recordBacklog("joiner", func() int { return len(joiner.Entries()) })
+	}
 
-	publisher, err := NewKafkaPublisher(loglet, transformer.Messages(), done)
+	if len(loglet.MultilineRules) > 0 {
+		multiline, err := NewJournalEntryMultiline(loglet, entries, done)
+		if err != nil {
+			return fmt.Errorf("unable to create multiline: %s", err)
+		}
+		rets = append(rets, multiline.Ret())
+		entries = multiline.Entries()
+		recordBacklog("multiline", func() int { return len(multiline.Entries()) })
+	}
+
+	transformer, err := NewJournalEntryTransformer(loglet, entries, done)
+	if err != nil {
+		return fmt.Errorf("unable to create transformer: %s", err)
+	}
+	rets = append(rets, transformer.Ret())
+	recordBacklog("transformer", func() int { return len(transformer.Messages()) })
+
+	messages := transformer.Messages()
+	if spool != nil {
+		spooler := NewSpooler(spool, messages, done)
+		rets = append(rets, spooler.Ret())
+		messages = spooler.Messages()
+		recordBacklog("spooler", func() int { return len(spooler.Messages()) })
+	}
+
+	publisher, err := NewOutputs(loglet, messages, done)
 	if err != nil {
 		return fmt.Errorf("unable to create publisher: %s", err)
 	}
+	rets = append(rets, publisher.Ret())
+
+	published := publisher.Published()
+	if spool != nil {
+		acknowledger := NewSpoolAcknowledger(spool, published, done)
+		rets = append(rets, acknowledger.Ret())
+		published = acknowledger.Published()
+	}
+
+	committer := NewCursorCommitter(cursorState, published, done)
+	rets = append(rets, committer.Ret())
+
+	merged := merge(rets...)
 
-	committer := NewCursorCommitter(cursorState, publisher.Published(), done)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
 
-	rets := merge(journal.Ret(), filter.Ret(), transformer.Ret(), publisher.Ret(), committer.Ret())
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
 
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
+	configChanges := watchConfigFile(loglet.ConfigFile, stop)
 
-	// wait for either sigint, or a process exiting prematurely
-	log.Infof("started")
-	select {
-	case <-sigint:
-	case returnErr = <-rets:
-		if returnErr != nil {
-			log.Errorf("service: process exited prematurely with error: %s", returnErr)
-		} else {
-			log.Debugf("service: process exited without error")
+	// wait for either a signal, or a process exiting prematurely,
+	// reloading the configuration in the meantime when asked to
+	log.Infof("started, reading journal from %s", start)
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			log.Infof("service: received %s", sig)
+			break wait
+		case returnErr = <-merged:
+			if returnErr != nil {
+				log.Errorf("service: process exited prematurely with error: %s", returnErr)
+			} else {
+				log.Debugf("service: process exited without error")
+			}
+			break wait
+		case returnErr = <-metricsRet:
+			log.Errorf("service: %s", returnErr)
+			break wait
+		case <-hangups:
+			log.Infof("service: received hangup, reloading configuration")
+			reloadPipeline(loglet, filter, transformer)
+		case <-configChanges:
+			log.Infof("service: config file changed, reloading configuration")
+			reloadPipeline(loglet, filter, transformer)
 		}
 	}
 
 	log.Infof("exiting")
 
-	// we're done
-	close(done)
+	close(stop)
 
-	// wait for remaining processes
-	for err := range rets {
-		if err != nil {
-			log.Errorf("service: process returned with error: %s", err)
-		}
+	// after an error the pipeline can't be expected to drain, but the
+	// committer will still commit what has been published
+	drainTimeout := time.After(loglet.DrainTimeout)
+	if returnErr != nil {
+		close(done)
+		drainTimeout = nil
 	}
 
-	return returnErr
+	// wait for remaining processes, giving up on draining after the timeout
+	// or another signal
+	for {
+		select {
+		case err, ok := <-merged:
+			if !ok {
+				if drainTimeout != nil {
+					close(done)
+				}
+				return returnErr
+			}
+			if err != nil {
+				log.Errorf("service: process returned with error: %s", err)
+				// including the final commit of the cursor, so failing to
+				// save progress isn't reported as a clean exit
+				if returnErr == nil {
+					returnErr = err
+				}
+			}
+
+		case err := <-metricsRet:
+			metricsRet = nil
+			if err != nil {
+				log.Errorf("service: %s", err)
+				if returnErr == nil {
+					returnErr = err
+				}
+			}
+
+		case <-drainTimeout:
+			log.Warnf("service: pipeline didn't drain within %s, stopping", loglet.DrainTimeout)
+			close(done)
+			drainTimeout = nil
+
+		case sig := <-signals:
+			if drainTimeout != nil {
+				log.Warnf("service: received %s while draining, stopping", sig)
+				close(done)
+				drainTimeout = nil
+			}
+		}
+	}
 }
 
 func merge(cs ...<-chan error) <-chan error {
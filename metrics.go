@@ -0,0 +1,113 @@
+package loglet
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/journal"
+	"github.com/uswitch/loglet/metrics"
+)
+
+var (
+	journalEntriesRead = metrics.NewCounter("loglet_journal_entries_read_total", "Entries read from the journal.")
+
+	filterEntriesDropped = metrics.NewCounterVec("loglet_filter_entries_dropped_total", "Entries dropped by include or exclude filters.", "filter")
+	includeDropped       = filterEntriesDropped.WithLabelValues("include")
+	excludeDropped       = filterEntriesDropped.WithLabelValues("exclude")
+
+	partialMessages = metrics.NewCounterVec("loglet_partial_messages_total", "Messages docker split into pieces, by whether they were joined or sent early after a timeout or reaching the size limit.", "result")
+	multilineEvents = metrics.NewCounterVec("loglet_multiline_events_total", "Events joined from several lines, by what ended them: the next event, a timeout or reaching the line limit.", "end")
+
+	transformErrors = metrics.NewCounter("loglet_transform_errors_total", "Entries that couldn't be transformed into messages.")
+
+	kafkaProduceLatency  = metrics.NewHistogramVec("loglet_kafka_produce_latency_seconds", "Time from a message being queued for kafka to it being acknowledged.", metrics.DefaultBuckets, "output")
+	kafkaProduceSuccess  = metrics.NewCounterVec("loglet_kafka_produce_successes_total", "Messages acknowledged by kafka.", "output")
+	kafkaProduceFailures = metrics.NewCounterVec("loglet_kafka_produce_failures_total", "Failed attempts to produce messages to kafka.", "output", "retriable")
+	kafkaPending         = metrics.NewGaugeVec("loglet_kafka_pending_messages", "Messages accepted by the publisher but not yet acknowledged by kafka.", "output")
+
+	outputSendLatency      = metrics.NewHistogramVec("loglet_output_send_latency_seconds", "Time taken to deliver a batch of messages to an output.", metrics.DefaultBuckets, "output")
+	outputMessagesSent     = metrics.NewCounterVec("loglet_output_messages_sent_total", "Messages delivered to an output.", "output")
+	outputMessagesDropped  = metrics.NewCounterVec("loglet_output_messages_dropped_total", "Messages dropped because an output rejected them.", "output")
+	outputMessagesFiltered = metrics.NewCounterVec("loglet_output_messages_filtered_total", "Messages not sent to an output because they didn't match its filter.", "output")
+	outputSendFailures     = metrics.NewCounterVec("loglet_output_send_failures_total", "Failed attempts to deliver a batch of messages to an output.", "output", "retriable")
+
+	stageBacklog = metrics.NewGaugeVec("loglet_stage_backlog", "Entries or messages waiting in the channel out of each pipeline stage, sampled when scraped.", "stage")
+
+	spoolBytes = metrics.NewGauge("loglet_spool_bytes", "Size of messages held in the spool.")
+
+	cursorCommitTime     = metrics.NewGauge("loglet_cursor_last_commit_timestamp_seconds", "When the cursor was last committed.")
+	cursorCommittedEntry = metrics.NewGauge("loglet_cursor_committed_entry_timestamp_seconds", "Journal time of the entry at the last committed cursor.")
+)
+
+// recordCommit updates the cursor metrics after committing a cursor
+func recordCommit(cursor string) {
+	cursorCommitTime.Set(float64(time.Now().UnixNano()) / 1e9)
+
+	loc, err := journal.ParseCursor(cursor)
+	if err != nil {
+		return
+	}
+	cursorCommittedEntry.Set(float64(loc.Realtime) / 1e6)
+}
+
+// recordBacklog reports the entries or messages waiting to be read from a
+// pipeline stage
+func recordBacklog(stage string, backlog func() int) {
+	stageBacklog.SetFunc(func() float64 { return float64(backlog()) }, stage)
+}
+
+type MetricsServer interface {
+	Ret() <-chan error
+}
+
+type metricsServer struct {
+	ret    chan error
+	server *http.Server
+}
+
+// NewMetricsServer starts serving metrics on /metrics. It listens straight
+// away, so that a bad address is reported before anything else starts.
+func NewMetricsServer(addr string, done <-chan struct{}) (MetricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: unable to listen on %s: %s", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry)
+
+	s := &metricsServer{
+		ret:    make(chan error, 1),
+		server: &http.Server{Handler: mux},
+	}
+	go s.serve(listener, done)
+
+	log.Infof("metrics: listening on %s", listener.Addr())
+
+	return s, nil
+}
+
+func (s *metricsServer) Ret() <-chan error {
+	return s.ret
+}
+
+func (s *metricsServer) serve(listener net.Listener, done <-chan struct{}) {
+	defer close(s.ret)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.server.Serve(listener)
+	}()
+
+	select {
+	case <-done:
+		s.server.Close()
+		<-served
+	case err := <-served:
+		s.ret <- fmt.Errorf("metrics: server stopped: %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounterVec("requests_total", "Requests handled.", "code")
+	requests.WithLabelValues("200").Add(3)
+	requests.WithLabelValues("500").Inc()
+
+	r.NewGauge("temperature", "Current temperature.\nIn celsius.").Set(-1.5)
+	r.NewGaugeFunc("answer", "Computed when scraped.", func() float64 { return 42 })
+	queued := r.NewGaugeVec("queued", "Computed per queue when scraped.", "queue")
+	queued.SetFunc(func() float64 { return 1 }, "a")
+	queued.SetFunc(func() float64 { return 2 }, "a")
+	queued.WithLabelValues("b").Set(3)
+	r.NewCounterVec("escaped_total", "Label escaping.", "path").WithLabelValues("a\"b\\c\n").Inc()
+
+	latency := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(0.5)
+	latency.Observe(2)
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("unexpected content type", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP answer Computed when scraped.
+# TYPE answer gauge
+answer 42
+# HELP escaped_total Label escaping.
+# TYPE escaped_total counter
+escaped_total{path="a\"b\\c\n"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.65
+latency_seconds_count 4
+# HELP queued Computed per queue when scraped.
+# TYPE queued gauge
+queued{queue="a"} 2
+queued{queue="b"} 3
+# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="500"} 1
+# HELP temperature Current temperature.\nIn celsius.
+# TYPE temperature gauge
+temperature -1.5
+`
+	if string(body) != expected {
+		t.Errorf("unexpected exposition:\n%s\nexpected:\n%s", body, expected)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering the same name twice to panic")
+		}
+	}()
+	r.NewGauge("requests_total", "")
+}
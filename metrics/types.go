@@ -0,0 +1,273 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a value that only goes up
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.store(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.value.add(v)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.value.load()
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	// upper bounds, in increasing order
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     atomicFloat
+}
+
+// DefaultBuckets suit latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(v)
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+type family struct {
+	metricName string
+	help       string
+	typ        string
+	labels     []string
+
+	mu       sync.Mutex
+	children map[string]*child
+	fn       func() float64
+}
+
+type child struct {
+	values    []string
+	counter   *Counter
+	gauge     *Gauge
+	gaugeFn   func() float64
+	histogram *Histogram
+}
+
+func newFamily(r *Registry, name, help, typ string, labels []string) *family {
+	f := &family{
+		metricName: name,
+		help:       help,
+		typ:        typ,
+		labels:     labels,
+		children:   make(map[string]*child),
+	}
+	r.register(f)
+	return f
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) child(values []string, create func() *child) *child {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.children[key]
+	if !ok {
+		c = create()
+		c.values = append([]string(nil), values...)
+		f.children[key] = c
+	}
+	return c
+}
+
+func (f *family) write(w io.Writer) {
+	writeHeader(w, f.metricName, f.help, f.typ)
+
+	if f.fn != nil {
+		writeSample(w, f.metricName, nil, nil, f.fn())
+		return
+	}
+
+	// copies, as functions of gauges may be replaced meanwhile
+	f.mu.Lock()
+	children := make([]child, 0, len(f.children))
+	for _, c := range f.children {
+		children = append(children, *c)
+	}
+	f.mu.Unlock()
+
+	sort.Slice(children, func(i, j int) bool {
+		return strings.Join(children[i].values, "\xff") < strings.Join(children[j].values, "\xff")
+	})
+
+	for _, c := range children {
+		switch {
+		case c.gaugeFn != nil:
+			writeSample(w, f.metricName, f.labels, c.values, c.gaugeFn())
+		case c.counter != nil:
+			writeSample(w, f.metricName, f.labels, c.values, float64(c.counter.Value()))
+		case c.gauge != nil:
+			writeSample(w, f.metricName, f.labels, c.values, c.gauge.Value())
+		case c.histogram != nil:
+			h := c.histogram
+			labels := append(append([]string(nil), f.labels...), "le")
+			var cumulative uint64
+			for i, bound := range h.buckets {
+				cumulative += atomic.LoadUint64(&h.counts[i])
+				writeSample(w, f.metricName+"_bucket", labels, append(append([]string(nil), c.values...), formatFloat(bound)), float64(cumulative))
+			}
+			count := h.Count()
+			writeSample(w, f.metricName+"_bucket", labels, append(append([]string(nil), c.values...), "+Inf"), float64(count))
+			writeSample(w, f.metricName+"_sum", f.labels, c.values, h.sum.load())
+			writeSample(w, f.metricName+"_count", f.labels, c.values, float64(count))
+		}
+	}
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	f *family
+}
+
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.f.child(values, func() *child { return &child{counter: &Counter{}} }).counter
+}
+
+// GaugeVec is a set of gauges partitioned by label values
+type GaugeVec struct {
+	f *family
+}
+
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return v.f.child(values, func() *child { return &child{gauge: &Gauge{}} }).gauge
+}
+
+// SetFunc makes the gauge with the label values read its value from fn when
+// collected, replacing any function set before
+func (v *GaugeVec) SetFunc(fn func() float64, values ...string) {
+	c := v.f.child(values, func() *child { return &child{gauge: &Gauge{}} })
+
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	c.gaugeFn = fn
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	f       *family
+	buckets []float64
+}
+
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.f.child(values, func() *child { return &child{histogram: newHistogram(v.buckets)} }).histogram
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).WithLabelValues()
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newFamily(r, name, help, "counter", labels)}
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).WithLabelValues()
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newFamily(r, name, help, "gauge", labels)}
+}
+
+// NewGaugeFunc creates a gauge whose value is read from fn when collected
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	f := newFamily(r, name, help, "gauge", nil)
+	f.fn = fn
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).WithLabelValues()
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets are not sorted", name))
+	}
+	return &HistogramVec{newFamily(r, name, help, "histogram", labels), buckets}
+}
+
+func NewCounter(name, help string) *Counter {
+	return DefaultRegistry.NewCounter(name, help)
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help)
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) {
+	DefaultRegistry.NewGaugeFunc(name, help, fn)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
@@ -0,0 +1,106 @@
+package loglet
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/metrics"
+)
+
+func scrape(t *testing.T) string {
+	server := httptest.NewServer(metrics.DefaultRegistry)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestFilterDropMetrics(t *testing.T) {
+	includedBefore := includeDropped.Value()
+	excludedBefore := excludeDropped.Value()
+
+	loglet := options.NewLoglet()
+	loglet.IncludeFilters = []string{`has(MESSAGE)`}
+	loglet.ExcludeFilters = []string{`PRIORITY > 6`}
+
+	entries := make(chan *JournalEntry)
+	done := make(chan struct{})
+	filter, err := NewJournalEntryFilter(loglet, entries, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		entries <- &JournalEntry{Fields: map[string]string{"PRIORITY": "3"}}
+		entries <- &JournalEntry{Fields: map[string]string{"MESSAGE": "debug", "PRIORITY": "7"}}
+		entries <- &JournalEntry{Fields: map[string]string{"MESSAGE": "info", "PRIORITY": "6"}}
+		close(entries)
+	}()
+
+	var passed []*JournalEntry
+	for entry := range filter.Entries() {
+		passed = append(passed, entry)
+	}
+
+	if len(passed) != 1 || passed[0].Fields["MESSAGE"] != "info" {
+		t.Error("expected only the info entry to pass, was", passed)
+	}
+	if includeDropped.Value()-includedBefore != 1 {
+		t.Error("expected 1 entry dropped by include filters, was", includeDropped.Value()-includedBefore)
+	}
+	if excludeDropped.Value()-excludedBefore != 1 {
+		t.Error("expected 1 entry dropped by exclude filters, was", excludeDropped.Value()-excludedBefore)
+	}
+
+	body := scrape(t)
+	for _, name := range []string{
+		`loglet_filter_entries_dropped_total{filter="include"}`,
+		`loglet_filter_entries_dropped_total{filter="exclude"}`,
+		`loglet_journal_entries_read_total`,
+		`loglet_spool_bytes`,
+		`loglet_cursor_committed_entry_timestamp_seconds`,
+	} {
+		if !strings.Contains(body, "\n"+name+" ") {
+			t.Errorf("expected %s in metrics", name)
+		}
+	}
+}
+
+func TestRecordCommit(t *testing.T) {
+	recordCommit("s=bbe71afbfc214be7aeffec29714c893d;i=1;b=6a8280c8ae924ebf9bab8cd91cd2de93;m=46224d6c;t=65e0384520007;x=c31620b2a5193a82")
+
+	if cursorCommittedEntry.Value() != 1792219058.143239 {
+		t.Error("expected committed entry time to come from the cursor, was", cursorCommittedEntry.Value())
+	}
+	if cursorCommitTime.Value() == 0 {
+		t.Error("expected commit time to be set")
+	}
+}
+
+func TestRecordBacklog(t *testing.T) {
+	entries := make(chan *JournalEntry, stageBuffer)
+	entries <- &JournalEntry{}
+	entries <- &JournalEntry{}
+	recordBacklog("test", func() int { return len(entries) })
+
+	if !strings.Contains(scrape(t), "\n"+`loglet_stage_backlog{stage="test"} 2`+"\n") {
+		t.Error("expected backlog of 2 entries in metrics")
+	}
+
+	<-entries
+	if !strings.Contains(scrape(t), "\n"+`loglet_stage_backlog{stage="test"} 1`+"\n") {
+		t.Error("expected backlog sampled when scraped")
+	}
+}
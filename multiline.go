@@ -0,0 +1,198 @@
+package loglet
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/filters"
+)
+
+const systemdUnitField = "_SYSTEMD_UNIT"
+
+// JournalEntryMultiline joins events logged over several entries, like
+// stack traces, into single entries. Entries from each container, or
+// otherwise each systemd unit, are joined according to the first rule
+// whose filter matches the entry starting an event, given as an optional filter expression over journal
+// fields and either the pattern lines starting an event match, or the
+// pattern lines continuing one match:
+//
+//	_SYSTEMD_UNIT == "app.service" => start:^\d{4}-\d{2}-\d{2}
+//	continue:^(\s|Caused by:)
+type JournalEntryMultiline interface {
+	Ret() <-chan error
+	Entries() <-chan *JournalEntry
+}
+
+type journalEntryMultiline struct {
+	ret     chan error
+	entries chan *JournalEntry
+
+	rules    []multilineRule
+	maxLines int
+	// events still being read, by container or unit
+	events *entryGroups
+}
+
+type multilineRule struct {
+	filter filters.Expr
+	// whether the pattern matches lines starting an event, rather than lines
+	// continuing one
+	start   bool
+	pattern *regexp.Regexp
+}
+
+// what ended an event, for metrics
+const (
+	multilineNext    = "next"
+	multilineTimeout = "timeout"
+	multilineLines   = "lines"
+)
+
+func NewJournalEntryMultiline(loglet *options.Loglet, lines <-chan *JournalEntry, done <-chan struct{}) (JournalEntryMultiline, error) {
+	ret := make(chan error, 2)
+	events := make(chan *JournalEntry, stageBuffer)
+
+	rules, err := parseMultilineRules(loglet.MultilineRules)
+	if err != nil {
+		return nil, err
+	}
+	if loglet.MultilineMaxLines < 1 {
+		return nil, fmt.Errorf("invalid multiline max lines %d, must be at least 1", loglet.MultilineMaxLines)
+	}
+
+	multiline := &journalEntryMultiline{
+		ret:      ret,
+		entries:  events,
+		rules:    rules,
+		maxLines: loglet.MultilineMaxLines,
+		events:   newEntryGroups(loglet.MultilineTimeout),
+	}
+
+	go multiline.start(lines, done)
+
+	return multiline, nil
+}
+
+func (j *journalEntryMultiline) Ret() <-chan error {
+	return j.ret
+}
+
+func (j *journalEntryMultiline) Entries() <-chan *JournalEntry {
+	return j.entries
+}
+
+func (j *journalEntryMultiline) start(lines <-chan *JournalEntry, done <-chan struct{}) {
+	defer close(j.ret)
+	defer close(j.entries)
+
+	j.events.run(lines, j.entries, done, j.add, func(event *entryGroup) {
+		j.flush(event, multilineTimeout)
+	})
+}
+
+func (j *journalEntryMultiline) add(position uint64, entry *JournalEntry) {
+	key, ok := entry.Fields[containerIDField]
+	if !ok {
+		key, ok = entry.Fields[systemdUnitField]
+	}
+	if !ok {
+		j.events.send(position, entry)
+		return
+	}
+
+	// lines are joined to an event by the rule it started with, as filters
+	// of other rules could match some of its lines
+	event, pending := j.events.get(key)
+	if pending && event.rule.continues(entry.Fields[journalMessageField]) {
+		j.addLine(key, position, entry)
+		return
+	}
+	if pending {
+		j.flush(event, multilineNext)
+	}
+
+	rule := j.rule(entry.Fields)
+	if rule == nil {
+		j.events.send(position, entry)
+		return
+	}
+	j.addLine(key, position, entry).rule = rule
+}
+
+// addLine adds an entry to the event for key, starting one if there isn't
+// one, and flushes the event once it reaches the maximum number of lines
+func (j *journalEntryMultiline) addLine(key string, position uint64, entry *JournalEntry) *entryGroup {
+	event := j.events.add(key, position, entry)
+	if len(event.lines) >= j.maxLines {
+		j.flush(event, multilineLines)
+	}
+	return event
+}
+
+// flush joins the lines of an event into its last entry, which carries the
+// cursor forward, dated from its first
+func (j *journalEntryMultiline) flush(event *entryGroup, end string) {
+	fields := j.events.remove(event, "\n")
+
+	multilineEvents.WithLabelValues(end).Inc()
+	j.events.send(event.last, &JournalEntry{Cursor: event.entry.Cursor, Fields: fields})
+}
+
+func (j *journalEntryMultiline) rule(fields map[string]string) *multilineRule {
+	for i, rule := range j.rules {
+		if rule.filter == nil || rule.filter.Match(fields) {
+			return &j.rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *multilineRule) continues(line string) bool {
+	return r.pattern.MatchString(line) != r.start
+}
+
+func parseMultilineRules(rawRules []string) ([]multilineRule, error) {
+	var rules []multilineRule
+
+	for _, rawRule := range rawRules {
+		var filterExpr string
+		pattern := rawRule
+		// the filter comes first, so split on the first arrow in case the
+		// pattern contains one
+		if i := strings.Index(rawRule, "=>"); i >= 0 {
+			filterExpr, pattern = strings.TrimSpace(rawRule[:i]), strings.TrimSpace(rawRule[i+2:])
+		}
+
+		var rule multilineRule
+
+		if filterExpr != "" {
+			filter, err := filters.Compile(filterExpr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid multiline rule '%s': %s", rawRule, err)
+			}
+			rule.filter = filter
+		}
+
+		switch {
+		case strings.HasPrefix(pattern, "start:"):
+			rule.start = true
+			pattern = strings.TrimPrefix(pattern, "start:")
+		case strings.HasPrefix(pattern, "continue:"):
+			pattern = strings.TrimPrefix(pattern, "continue:")
+		default:
+			return nil, fmt.Errorf("invalid multiline rule '%s', expected: [<filter> =>] start:<pattern> or continue:<pattern>", rawRule)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiline rule '%s': %s", rawRule, err)
+		}
+		rule.pattern = re
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
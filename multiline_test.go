@@ -0,0 +1,192 @@
+package loglet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func unitEntry(cursor, unit, message string) *JournalEntry {
+	return &JournalEntry{Cursor: cursor, Fields: map[string]string{"_SYSTEMD_UNIT": unit, "MESSAGE": message}}
+}
+
+// multilineEntries sends entries through the multiline stage and returns
+// everything it sends on
+func multilineEntries(t *testing.T, loglet *options.Loglet, entries ...*JournalEntry) []*JournalEntry {
+	lines := make(chan *JournalEntry)
+	done := make(chan struct{})
+	defer close(done)
+
+	multiline, err := NewJournalEntryMultiline(loglet, lines, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for _, entry := range entries {
+			lines <- entry
+		}
+		close(lines)
+	}()
+
+	var events []*JournalEntry
+	for entry := range multiline.Entries() {
+		events = append(events, entry)
+	}
+	return events
+}
+
+func TestJournalEntryMultilineContinue(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.MultilineRules = []string{`_SYSTEMD_UNIT == "app.service" => continue:^(\s|Caused by:)`}
+
+	events := multilineEntries(t, loglet,
+		unitEntry("c1", "app.service", "Exception in thread \"main\" java.lang.RuntimeException"),
+		unitEntry("c2", "app.service", "\tat Main.main(Main.java:5)"),
+		unitEntry("c3", "other.service", "  not joined"),
+		unitEntry("c4", "app.service", "Caused by: java.io.IOException"),
+		unitEntry("c5", "app.service", "\t... 1 more"),
+		unitEntry("c6", "app.service", "next event"),
+		unitEntry("c7", "other.service", "  still not joined"),
+	)
+
+	expected := []*JournalEntry{
+		unitEntry("c3", "other.service", "  not joined"),
+		unitEntry("c5", "app.service", "Exception in thread \"main\" java.lang.RuntimeException\n\tat Main.main(Main.java:5)\nCaused by: java.io.IOException\n\t... 1 more"),
+		unitEntry("c6", "app.service", "next event"),
+		unitEntry("c7", "other.service", "  still not joined"),
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+}
+
+func TestJournalEntryMultilineStart(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.MultilineRules = []string{`start:^\d{4}-\d{2}-\d{2}`}
+
+	events := multilineEntries(t, loglet,
+		unitEntry("c1", "app.service", "2017-01-02 Traceback (most recent call last):"),
+		unitEntry("c2", "app.service", `  File "app.py", line 1`),
+		unitEntry("c3", "web.service", "2017-01-02 request"),
+		unitEntry("c4", "app.service", "ValueError"),
+		unitEntry("c5", "app.service", "2017-01-02 next event"),
+	)
+
+	var cursors []string
+	for _, event := range events {
+		cursors = append(cursors, event.Cursor)
+	}
+	// events are sent in order of their last line
+	expected := []string{"c3", "c4", "c5"}
+	if !reflect.DeepEqual(cursors, expected) {
+		t.Errorf("expected cursors %v, got %v", expected, cursors)
+	}
+	if events[1].Fields["MESSAGE"] != "2017-01-02 Traceback (most recent call last):\n  File \"app.py\", line 1\nValueError" {
+		t.Errorf("expected joined traceback, got %q", events[1].Fields["MESSAGE"])
+	}
+}
+
+func TestJournalEntryMultilineMaxLines(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.MultilineRules = []string{`continue:^\s`}
+	loglet.MultilineMaxLines = 2
+
+	events := multilineEntries(t, loglet,
+		unitEntry("c1", "app.service", "a"),
+		unitEntry("c2", "app.service", " b"),
+		unitEntry("c3", "app.service", " c"),
+	)
+
+	expected := []*JournalEntry{
+		unitEntry("c2", "app.service", "a\n b"),
+		unitEntry("c3", "app.service", " c"),
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+}
+
+func TestJournalEntryMultilineRulePerEvent(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.MultilineRules = []string{
+		`PRIORITY == 3 => continue:^\s`,
+		`continue:^Caused by:`,
+	}
+
+	line := func(cursor, priority, message string) *JournalEntry {
+		entry := unitEntry(cursor, "app.service", message)
+		entry.Fields["PRIORITY"] = priority
+		return entry
+	}
+
+	// the stack trace is logged at a different priority to the line
+	// starting it, so matches the filter of the other rule
+	events := multilineEntries(t, loglet,
+		line("c1", "3", "Exception in thread \"main\""),
+		line("c2", "6", "\tat Main.main(Main.java:5)"),
+		line("c3", "6", "Caused by: java.io.IOException"),
+		line("c4", "6", "Caused by: java.net.SocketException"),
+	)
+
+	expected := []*JournalEntry{
+		line("c2", "6", "Exception in thread \"main\"\n\tat Main.main(Main.java:5)"),
+		line("c4", "6", "Caused by: java.io.IOException\nCaused by: java.net.SocketException"),
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+}
+
+func TestParseMultilineRulesInvalid(t *testing.T) {
+	for _, rule := range []string{
+		`^\s`,
+		`continue:(`,
+		`_SYSTEMD_UNIT == => continue:^\s`,
+	} {
+		_, err := parseMultilineRules([]string{rule})
+		if err == nil {
+			t.Errorf("%s: expected error", rule)
+		}
+	}
+}
+
+func TestJournalEntryMultilineTimestamps(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.MultilineRules = []string{`continue:^\s`}
+
+	line := func(cursor, message, realtime string) *JournalEntry {
+		entry := unitEntry(cursor, "app.service", message)
+		entry.Fields["__REALTIME_TIMESTAMP"] = realtime
+		return entry
+	}
+	last := line("c2", " at Main.main", "1500000000000002")
+	last.Fields["_SOURCE_REALTIME_TIMESTAMP"] = "1500000000000001"
+
+	events := multilineEntries(t, loglet, line("c1", "Exception", "1500000000000000"), last)
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %v", events)
+	}
+	event := events[0]
+	if event.Cursor != "c2" {
+		t.Errorf("expected cursor of the last line, got %s", event.Cursor)
+	}
+	if event.Fields["__REALTIME_TIMESTAMP"] != "1500000000000000" {
+		t.Errorf("expected timestamp of the first line, got %s", event.Fields["__REALTIME_TIMESTAMP"])
+	}
+	if source, ok := event.Fields["_SOURCE_REALTIME_TIMESTAMP"]; ok {
+		t.Errorf("expected no source timestamp, as the first line had none, got %s", source)
+	}
+}
+
+func TestNewJournalEntryMultilineInvalidMaxLines(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.MultilineRules = []string{`continue:^\s`}
+	loglet.MultilineMaxLines = 0
+
+	_, err := NewJournalEntryMultiline(loglet, make(chan *JournalEntry), make(chan struct{}))
+	if err == nil {
+		t.Error("expected error for max lines of 0")
+	}
+}
@@ -0,0 +1,290 @@
+package loglet
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+// OutputConstructor creates a publisher that sends messages to an output,
+// publishing the cursor of each message once it has been delivered
+type OutputConstructor func(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error)
+
+var outputs = map[string]OutputConstructor{
+	"kafka": NewKafkaPublisher,
+}
+
+// registerOutput makes an output available to --output
+func registerOutput(name string, constructor OutputConstructor) {
+	if _, ok := outputs[name]; ok {
+		panic(fmt.Sprintf("output %s registered twice", name))
+	}
+	outputs[name] = constructor
+}
+
+// OutputNames returns the names of all available outputs
+func OutputNames() []string {
+	var names []string
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewPublisher creates the publisher for the output chosen by --output
+func NewPublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error) {
+	constructor, ok := outputs[loglet.Output]
+	if !ok {
+		return nil, fmt.Errorf("unknown output '%s', expected one of: %s", loglet.Output, strings.Join(OutputNames(), ", "))
+	}
+	return constructor(loglet, msgs, done)
+}
+
+// batchSender delivers batches of messages for a batchPublisher
+type batchSender interface {
+	// send delivers a batch of messages, returning an error if it
+	// couldn't be. The batch is sent again after a backoff unless the
+	// error is permanent.
+	send(batch []*EncodedMessage) error
+	close() error
+}
+
+// permanentError is a failure to send a batch that will never succeed no
+// matter how many times it's sent again, so the batch is dropped
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// partialError is a failure to deliver some of the messages in a batch, so
+// only those are sent again. The rest were either sent or dropped.
+type partialError struct {
+	err   error
+	sent  int
+	retry []*EncodedMessage
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error()
+}
+
+// tooLargeError is a failure to send a batch because the output wouldn't
+// take that much at once, so it's sent again in smaller batches
+type tooLargeError struct {
+	err error
+}
+
+func (e *tooLargeError) Error() string {
+	return e.err.Error()
+}
+
+// throttledError is a failure to send a batch because the output asked for
+// fewer requests, so it's not sent again for at least the given time
+type throttledError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return e.err.Error()
+}
+
+type batchOptions struct {
+	// name of the output from --named-output, or default, for logs and
+	// metrics
+	name string
+	// a batch is sent once it reaches count messages or size bytes, or
+	// delay after its first message. With no delay a batch is sent as
+	// soon as there are no more messages waiting.
+	count int
+	size  int
+	delay time.Duration
+	// initial backoff before retrying a failed batch, minRetryBackoff if
+	// not set
+	backoff time.Duration
+}
+
+// batchPublisher collects messages into batches for outputs that deliver
+// them synchronously, retrying failed batches with a backoff
+type batchPublisher struct {
+	opts      batchOptions
+	sender    batchSender
+	ret       chan error
+	published chan string
+}
+
+func newBatchPublisher(opts batchOptions, sender batchSender, msgs <-chan *EncodedMessage, done <-chan struct{}) Publisher {
+	p := &batchPublisher{
+		opts:      opts,
+		sender:    sender,
+		ret:       make(chan error),
+		published: make(chan string),
+	}
+
+	go p.loop(msgs, done)
+
+	return p
+}
+
+func (p *batchPublisher) Ret() <-chan error {
+	return p.ret
+}
+
+func (p *batchPublisher) Published() <-chan string {
+	return p.published
+}
+
+func (p *batchPublisher) loop(msgs <-chan *EncodedMessage, done <-chan struct{}) {
+	defer close(p.ret)
+	defer close(p.published)
+	defer func() {
+		err := p.sender.close()
+		if err != nil {
+			log.Warnf("output %s: error closing output: %v", p.opts.name, err)
+		}
+	}()
+
+	var (
+		batch []*EncodedMessage
+		size  int
+		flush <-chan time.Time
+	)
+
+	add := func(m *EncodedMessage, ok bool) {
+		if !ok {
+			msgs = nil
+			return
+		}
+		if len(batch) == 0 && p.opts.delay > 0 {
+			flush = time.After(p.opts.delay)
+		}
+		batch = append(batch, m)
+		size += len(m.Message)
+	}
+
+	for msgs != nil || len(batch) > 0 {
+		full := len(batch) > 0 && ((p.opts.count > 0 && len(batch) >= p.opts.count) || (p.opts.size > 0 && size >= p.opts.size))
+
+		switch {
+		case full || msgs == nil:
+
+		case p.opts.delay == 0 && len(batch) > 0:
+			// without a delay, send as soon as nothing else is waiting
+			select {
+			case <-done:
+				return
+			case m, ok := <-msgs:
+				add(m, ok)
+				continue
+			default:
+			}
+
+		default:
+			select {
+			case <-done:
+				return
+			case m, ok := <-msgs:
+				add(m, ok)
+				continue
+			case <-flush:
+			}
+		}
+
+		if !p.sendBatch(batch, done) {
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case p.published <- batch[len(batch)-1].Cursor:
+		}
+
+		batch, size, flush = nil, 0, nil
+	}
+}
+
+// sendBatch sends a batch until it's either delivered or fails permanently,
+// returning false if stopped while retrying
+func (p *batchPublisher) sendBatch(batch []*EncodedMessage, done <-chan struct{}) bool {
+	backoff := p.opts.backoff
+	if backoff == 0 {
+		backoff = minRetryBackoff
+	}
+
+	for {
+		start := time.Now()
+		err := p.sender.send(batch)
+		if err == nil {
+			outputSendLatency.WithLabelValues(p.opts.name).Observe(time.Since(start).Seconds())
+			outputMessagesSent.WithLabelValues(p.opts.name).Add(uint64(len(batch)))
+			return true
+		}
+
+		if _, ok := err.(*tooLargeError); ok {
+			if len(batch) > 1 {
+				outputSendFailures.WithLabelValues(p.opts.name, "true").Inc()
+				log.Warnf("output %s: %d messages too large to send at once, sending in halves: %v", p.opts.name, len(batch), err)
+				half := len(batch) / 2
+				return p.sendBatch(batch[:half], done) && p.sendBatch(batch[half:], done)
+			}
+			err = &permanentError{err}
+		}
+
+		if _, ok := err.(*permanentError); ok {
+			outputSendFailures.WithLabelValues(p.opts.name, "false").Inc()
+			outputMessagesDropped.WithLabelValues(p.opts.name).Add(uint64(len(batch)))
+			log.Errorf("output %s: dropping %d messages that can't be sent: %v", p.opts.name, len(batch), err)
+			return true
+		}
+
+		if partial, ok := err.(*partialError); ok {
+			outputMessagesSent.WithLabelValues(p.opts.name).Add(uint64(partial.sent))
+			if len(partial.retry) == 0 {
+				outputSendLatency.WithLabelValues(p.opts.name).Observe(time.Since(start).Seconds())
+				return true
+			}
+			batch = partial.retry
+		}
+		if throttled, ok := err.(*throttledError); ok && throttled.after > backoff {
+			backoff = throttled.after
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+
+		outputSendFailures.WithLabelValues(p.opts.name, "true").Inc()
+		log.Warnf("output %s: unable to send %d messages, retrying in %s: %v", p.opts.name, len(batch), backoff, err)
+
+		select {
+		case <-done:
+			return false
+		case <-time.After(backoff):
+		}
+
+		backoff = backoff * 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// decodeMessage decodes the fields of a message for outputs that need them
+func decodeMessage(m *EncodedMessage) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal(m.Message, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("message isn't a JSON object: %s", err)
+	}
+	return fields, nil
+}
@@ -0,0 +1,328 @@
+package loglet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func init() {
+	registerOutput("elasticsearch", NewElasticsearchPublisher)
+}
+
+// elasticsearch doesn't allow these characters, or upper case, in index
+// names, or names starting with -, _ or +
+var indexNameRe = regexp.MustCompile(`^[^-_+A-Z\\/*?"<>| ,#:][^A-Z\\/*?"<>| ,#:]{0,254}$`)
+
+// NewElasticsearchPublisher indexes batches of messages with the _bulk API
+// of the cluster at --output-url. Items that fail in a bulk request are sent
+// again on their own unless elasticsearch rejected them, e.g. for not
+// matching the index mapping.
+func NewElasticsearchPublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error) {
+	sender, err := newElasticsearchSender(loglet)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := batchOptions{
+		name:  loglet.OutputName,
+		count: loglet.MaxMessageCount,
+		size:  loglet.MaxMessageSize,
+		delay: loglet.MaxMessageDelay,
+	}
+	return newBatchPublisher(opts, sender, msgs, done), nil
+}
+
+type elasticsearchSender struct {
+	*httpSender
+	index      *template.Template
+	timestamps *timestampFormat
+}
+
+func newElasticsearchSender(loglet *options.Loglet) (*elasticsearchSender, error) {
+	sender, err := newHTTPSender(loglet, "application/x-ndjson")
+	if err != nil {
+		return nil, err
+	}
+	sender.url = strings.TrimSuffix(sender.url, "/") + "/_bulk"
+
+	index, err := parseIndexTemplate(loglet.ElasticsearchIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps, err := newTimestampFormat(loglet.TimestampFormat, loglet.TimestampPrecision)
+	if err != nil {
+		return nil, err
+	}
+
+	return &elasticsearchSender{
+		httpSender: sender,
+		index:      index,
+		timestamps: timestamps,
+	}, nil
+}
+
+// parseIndexTemplate parses an index name template over message fields. The
+// date function formats the message's @timestamp with a go time layout,
+// e.g. logs-{{date "2006.01.02"}}.
+func parseIndexTemplate(index string) (*template.Template, error) {
+	t, err := template.New("index").Option("missingkey=error").Funcs(template.FuncMap{
+		"date": indexDate,
+	}).Parse(index)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index template '%s': %s", index, err)
+	}
+	passData(t.Tree.Root, "date")
+	return t, nil
+}
+
+// indexDate formats the time rendering data's index name is for, which is
+// given to it as the first argument by passData
+func indexDate(data map[string]interface{}, layout string) string {
+	timestamp, _ := data["@timestamp"].(time.Time)
+	return timestamp.Format(layout)
+}
+
+// passData rewrites calls to the function fn in a template to take the
+// template's data as their first argument, so fn can get at it wherever
+// it's called from
+func passData(node parse.Node, fn string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, node := range n.Nodes {
+			passData(node, fn)
+		}
+	case *parse.ActionNode:
+		passData(n.Pipe, fn)
+	case *parse.TemplateNode:
+		passData(n.Pipe, fn)
+	case *parse.IfNode:
+		passData(n.Pipe, fn)
+		passData(n.List, fn)
+		passData(n.ElseList, fn)
+	case *parse.RangeNode:
+		passData(n.Pipe, fn)
+		passData(n.List, fn)
+		passData(n.ElseList, fn)
+	case *parse.WithNode:
+		passData(n.Pipe, fn)
+		passData(n.List, fn)
+		passData(n.ElseList, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			passData(cmd, fn)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			passData(arg, fn)
+		}
+		if ident, ok := n.Args[0].(*parse.IdentifierNode); ok && ident.Ident == fn {
+			data := &parse.VariableNode{NodeType: parse.NodeVariable, Pos: ident.Pos, Ident: []string{"$"}}
+			n.Args = append([]parse.Node{ident, data}, n.Args[1:]...)
+		}
+	}
+}
+
+// indexName renders the index template for a message
+func (s *elasticsearchSender) indexName(m *EncodedMessage) (string, error) {
+	fields, err := decodeMessage(m)
+	if err != nil {
+		return "", err
+	}
+	// parsed for the date function
+	fields["@timestamp"] = s.timestamps.messageTime(m)
+
+	var buf bytes.Buffer
+	err = s.index.Execute(&buf, fields)
+	if err != nil {
+		return "", fmt.Errorf("unable to render index name: %s", err)
+	}
+
+	name := buf.String()
+	if !indexNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid index name '%s'", name)
+	}
+	return name, nil
+}
+
+type bulkAction struct {
+	Index bulkActionMeta `json:"index"`
+}
+
+type bulkActionMeta struct {
+	Index string `json:"_index"`
+}
+
+type bulkResponse struct {
+	Errors bool       `json:"errors"`
+	Items  []bulkItem `json:"items"`
+}
+
+type bulkItem map[string]struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// decodeBulkResponse decodes a bulk response. A response cut off at
+// maxResponseSize is decoded as far as it goes, returning the items read
+// and false for not being complete.
+func decodeBulkResponse(body []byte, cutOff bool) (*bulkResponse, bool, error) {
+	var resp bulkResponse
+	err := json.Unmarshal(body, &resp)
+	if err == nil {
+		return &resp, true, nil
+	}
+	if !cutOff {
+		return nil, false, fmt.Errorf("invalid bulk response: %s", err)
+	}
+
+	// errors comes before items, so it's known as long as any items are
+	resp = bulkResponse{Errors: true}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return &resp, false, nil
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			break
+		}
+		if key != "items" {
+			var value json.RawMessage
+			if dec.Decode(&value) != nil {
+				break
+			}
+			if key == "errors" {
+				json.Unmarshal(value, &resp.Errors)
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			break
+		}
+		for dec.More() {
+			var item bulkItem
+			if dec.Decode(&item) != nil {
+				break
+			}
+			resp.Items = append(resp.Items, item)
+		}
+		break
+	}
+	return &resp, false, nil
+}
+
+func (s *elasticsearchSender) send(batch []*EncodedMessage) error {
+	var (
+		body    bytes.Buffer
+		items   []*EncodedMessage
+		dropped int
+	)
+
+	enc := json.NewEncoder(&body)
+	for _, m := range batch {
+		index, err := s.indexName(m)
+		if err != nil {
+			log.Errorf("elasticsearch: dropping message %s: %s", m.Cursor, err)
+			dropped++
+			continue
+		}
+
+		err = enc.Encode(bulkAction{bulkActionMeta{index}})
+		if err != nil {
+			return &permanentError{err}
+		}
+		body.Write(m.Message)
+		body.WriteByte('\n')
+
+		items = append(items, m)
+	}
+	outputMessagesDropped.WithLabelValues(s.name).Add(uint64(dropped))
+
+	if len(items) == 0 {
+		return &partialError{err: fmt.Errorf("%d messages dropped", dropped)}
+	}
+
+	respBody, err := s.post(s.url, &body)
+	if err != nil {
+		return err
+	}
+
+	err = s.bulkResult(items, respBody, len(respBody) >= maxResponseSize)
+	if err == nil && dropped > 0 {
+		return &partialError{err: fmt.Errorf("%d messages dropped", dropped), sent: len(items)}
+	}
+	return err
+}
+
+// bulkResult checks the response to a bulk request for items, returning a
+// partialError with the items to send again if any failed
+func (s *elasticsearchSender) bulkResult(items []*EncodedMessage, respBody []byte, cutOff bool) error {
+	resp, complete, err := decodeBulkResponse(respBody, cutOff)
+	if err != nil {
+		return err
+	}
+	if complete && !resp.Errors {
+		return nil
+	}
+	if complete && len(resp.Items) != len(items) {
+		return fmt.Errorf("bulk response has %d items, expected %d", len(resp.Items), len(items))
+	}
+	if len(resp.Items) > len(items) {
+		return fmt.Errorf("bulk response has more than the %d items expected", len(items))
+	}
+
+	var (
+		sent      int
+		retry     []*EncodedMessage
+		retryErr  string
+		rejected  int
+		rejectErr string
+	)
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status < 300 {
+				sent++
+				continue
+			}
+			if isRetriableStatus(result.Status) {
+				retry = append(retry, items[i])
+				retryErr = string(result.Error)
+			} else {
+				rejected++
+				rejectErr = string(result.Error)
+			}
+		}
+	}
+
+	if rejected > 0 {
+		outputMessagesDropped.WithLabelValues(s.name).Add(uint64(rejected))
+		log.Errorf("elasticsearch: dropping %d messages rejected by elasticsearch: %s", rejected, truncate([]byte(rejectErr), 512))
+	}
+
+	err = fmt.Errorf("%d of %d items failed: %s", len(retry), len(items), truncate([]byte(retryErr), 512))
+	if !complete {
+		// items past the end of what was read may or may not have been
+		// indexed, so are sent again
+		retry = append(retry, items[len(resp.Items):]...)
+		err = fmt.Errorf("bulk response cut off after %d of %d items, sending %d again", len(resp.Items), len(items), len(retry))
+	}
+
+	return &partialError{err: err, sent: sent, retry: retry}
+}
@@ -0,0 +1,234 @@
+package loglet
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+// fakeBulk is an elasticsearch _bulk endpoint that fails items with the
+// statuses given for each message, by its id field, in successive requests
+type fakeBulk struct {
+	statuses map[string][]int
+	// ids and indexes of the items in each request
+	requests [][]string
+}
+
+func (f *fakeBulk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		items  []string
+		result []map[string]interface{}
+		errors bool
+	)
+
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var action bulkAction
+		json.Unmarshal(scanner.Bytes(), &action)
+		if !scanner.Scan() {
+			http.Error(w, "missing document", http.StatusBadRequest)
+			return
+		}
+		var doc map[string]string
+		json.Unmarshal(scanner.Bytes(), &doc)
+
+		id := doc["id"]
+		items = append(items, id+"@"+action.Index.Index)
+
+		status := http.StatusCreated
+		if statuses := f.statuses[id]; len(statuses) > 0 {
+			status = statuses[0]
+			f.statuses[id] = statuses[1:]
+		}
+		item := map[string]interface{}{"status": status}
+		if status >= 300 {
+			item["error"] = map[string]string{"type": "failed"}
+			errors = true
+		}
+		result = append(result, map[string]interface{}{"index": item})
+	}
+	f.requests = append(f.requests, items)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errors, "items": result})
+}
+
+func TestElasticsearchOutput(t *testing.T) {
+	bulk := &fakeBulk{
+		statuses: map[string][]int{
+			"2": {http.StatusTooManyRequests, http.StatusServiceUnavailable},
+			"3": {http.StatusBadRequest},
+		},
+	}
+	server := httptest.NewServer(bulk)
+	defer server.Close()
+
+	loglet := options.NewLoglet()
+	loglet.OutputURL = server.URL + "/"
+	loglet.ElasticsearchIndex = `logs-{{.app}}-{{date "2006.01.02"}}`
+	loglet.MaxMessageCount = 4
+	loglet.OutputName = "search"
+	droppedBefore := outputMessagesDropped.WithLabelValues("search").Value()
+	sentBefore := outputMessagesSent.WithLabelValues("search").Value()
+
+	sender, err := newElasticsearchSender(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	defer close(done)
+	publisher := newBatchPublisher(batchOptions{name: "search", count: 4, delay: time.Hour, backoff: time.Millisecond}, sender, msgs, done)
+
+	go func() {
+		for i, ts := range []string{"2026-10-16T23:59:59.999Z", "2026-10-17T00:00:00.000Z", "2026-10-17T12:00:00.000Z", "2026-10-18T00:00:00.000Z"} {
+			msgs <- &EncodedMessage{
+				Cursor:  fmt.Sprintf("c%d", i+1),
+				Message: []byte(fmt.Sprintf(`{"id":"%d","app":"web","@timestamp":"%s"}`, i+1, ts)),
+			}
+		}
+		close(msgs)
+	}()
+
+	var published []string
+	for cursor := range publisher.Published() {
+		published = append(published, cursor)
+		// the cursor is only published once the failed item is indexed
+		if len(bulk.requests) != 3 {
+			t.Errorf("published %s after %d requests", cursor, len(bulk.requests))
+		}
+	}
+
+	expected := [][]string{
+		{"1@logs-web-2026.10.16", "2@logs-web-2026.10.17", "3@logs-web-2026.10.17", "4@logs-web-2026.10.18"},
+		{"2@logs-web-2026.10.17"},
+		{"2@logs-web-2026.10.17"},
+	}
+	if !reflect.DeepEqual(bulk.requests, expected) {
+		t.Errorf("expected requests %v, got %v", expected, bulk.requests)
+	}
+	if !reflect.DeepEqual(published, []string{"c4"}) {
+		t.Errorf("expected to publish c4, got %v", published)
+	}
+	if dropped := outputMessagesDropped.WithLabelValues("search").Value() - droppedBefore; dropped != 1 {
+		t.Errorf("expected 1 message dropped by the search output, got %d", dropped)
+	}
+	if sent := outputMessagesSent.WithLabelValues("search").Value() - sentBefore; sent != 3 {
+		t.Errorf("expected 3 messages sent by the search output, got %d", sent)
+	}
+}
+
+func TestElasticsearchCutOffResponse(t *testing.T) {
+	var items []*EncodedMessage
+	for i := 0; i < 4; i++ {
+		items = append(items, &EncodedMessage{Cursor: fmt.Sprintf("c%d", i), Message: []byte(`{"@timestamp":"2026-10-17T10:00:00.000Z"}`)})
+	}
+
+	full := `{"took":3,"errors":true,"items":[{"index":{"status":201}},{"index":{"status":429,"error":{"type":"failed"}}},{"index":{"status":201}},{"index":{"status":201}}]}`
+	loglet := options.NewLoglet()
+	loglet.OutputURL = "http://localhost:9200"
+	sender, err := newElasticsearchSender(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, complete, err := decodeBulkResponse([]byte(full), false)
+	if err != nil || !complete || len(resp.Items) != 4 {
+		t.Fatalf("expected complete response with 4 items, got %v %v %v", resp, complete, err)
+	}
+
+	// cut off in the middle of the third item
+	cutOff := full[:strings.Index(full, `{"index":{"status":201}},{"index":{"status":201}}]`)+len(`{"index":{"stat`)]
+	resp, complete, err = decodeBulkResponse([]byte(cutOff), true)
+	if err != nil || complete || !resp.Errors || len(resp.Items) != 2 {
+		t.Fatalf("expected 2 items from cut off response, got %v %v %v", resp, complete, err)
+	}
+
+	_, _, err = decodeBulkResponse([]byte(cutOff), false)
+	if err == nil {
+		t.Error("expected error for invalid response that wasn't cut off")
+	}
+
+	err = sender.bulkResult(items, []byte(cutOff), true)
+	partial, ok := err.(*partialError)
+	if !ok {
+		t.Fatalf("expected partial error, got %v", err)
+	}
+	if partial.sent != 1 {
+		t.Errorf("expected 1 item sent, got %d", partial.sent)
+	}
+	var retried []string
+	for _, m := range partial.retry {
+		retried = append(retried, m.Cursor)
+	}
+	if !reflect.DeepEqual(retried, []string{"c1", "c2", "c3"}) {
+		t.Errorf("expected c1, c2 and c3 to be sent again, got %v", retried)
+	}
+}
+
+func TestElasticsearchIndexName(t *testing.T) {
+	tests := []struct {
+		template string
+		message  string
+		index    string
+	}{
+		{`logs-{{date "2006.01.02"}}`, `{"@timestamp":"2026-10-17T10:00:00.000Z"}`, "logs-2026.10.17"},
+		{`logs-{{date "2006.01"}}`, `{"@timestamp":"2026-10-17T10:00:00.000+02:00"}`, "logs-2026.10"},
+		{`{{.unit}}`, `{"unit":"nginx"}`, "nginx"},
+		{`{{with .unit}}{{.}}-{{date "2006"}}{{end}}`, `{"unit":"nginx","@timestamp":"2026-10-17T10:00:00.000Z"}`, "nginx-2026"},
+		{`logs-{{"2006.01" | date}}`, `{"@timestamp":"2026-10-17T10:00:00.000Z"}`, "logs-2026.10"},
+		// missing field
+		{`{{.unit}}`, `{}`, ""},
+		// upper case isn't allowed
+		{`{{.unit}}`, `{"unit":"Nginx"}`, ""},
+		{`_{{.unit}}`, `{"unit":"nginx"}`, ""},
+		{`logs`, `not json`, ""},
+	}
+
+	for _, test := range tests {
+		loglet := options.NewLoglet()
+		loglet.OutputURL = "http://localhost:9200"
+		loglet.ElasticsearchIndex = test.template
+
+		sender, err := newElasticsearchSender(loglet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index, err := sender.indexName(&EncodedMessage{Message: []byte(test.message)})
+		if test.index == "" {
+			if err == nil {
+				t.Errorf("%s %s: expected error, got %s", test.template, test.message, index)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %s", test.template, test.message, err)
+			continue
+		}
+		if index != test.index {
+			t.Errorf("%s %s: expected %s, got %s", test.template, test.message, test.index, index)
+		}
+	}
+
+	loglet := options.NewLoglet()
+	loglet.OutputURL = "http://localhost:9200"
+	loglet.ElasticsearchIndex = "logs-{{"
+	_, err := newElasticsearchSender(loglet)
+	if err == nil || !strings.Contains(err.Error(), "invalid index template") {
+		t.Errorf("expected invalid index template error, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package loglet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func init() {
+	registerOutput("stdout", NewStdoutPublisher)
+	registerOutput("file", NewFilePublisher)
+}
+
+// NewStdoutPublisher writes messages to stdout, one per line
+func NewStdoutPublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error) {
+	opts := batchOptions{
+		name:  loglet.OutputName,
+		count: loglet.MaxMessageCount,
+		size:  loglet.MaxMessageSize,
+	}
+	return newBatchPublisher(opts, &writerSender{w: os.Stdout}, msgs, done), nil
+}
+
+// NewFilePublisher appends messages to a file, one per line. A message is
+// only published once it has been synced to disk. The file is reopened if
+// it's moved or removed, so it can be rotated.
+func NewFilePublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error) {
+	if loglet.OutputFile == "" {
+		return nil, fmt.Errorf("file output requires --output-file")
+	}
+
+	sender := &fileSender{path: loglet.OutputFile}
+	err := sender.open()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := batchOptions{
+		name:  loglet.OutputName,
+		count: loglet.MaxMessageCount,
+		size:  loglet.MaxMessageSize,
+	}
+	return newBatchPublisher(opts, sender, msgs, done), nil
+}
+
+// writeLines writes each message in a batch followed by a newline
+func writeLines(w io.Writer, batch []*EncodedMessage) error {
+	buf := bufio.NewWriter(w)
+	for _, m := range batch {
+		buf.Write(m.Message)
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
+
+type writerSender struct {
+	w io.Writer
+}
+
+func (s *writerSender) send(batch []*EncodedMessage) error {
+	return writeLines(s.w, batch)
+}
+
+func (s *writerSender) close() error {
+	return nil
+}
+
+type fileSender struct {
+	path string
+	f    *os.File
+}
+
+func (s *fileSender) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open output file: %s", err)
+	}
+	s.f = f
+	return nil
+}
+
+// rotated returns whether the path no longer refers to the open file
+func (s *fileSender) rotated() bool {
+	pathInfo, err := os.Stat(s.path)
+	if err != nil {
+		return true
+	}
+	fileInfo, err := s.f.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(pathInfo, fileInfo)
+}
+
+func (s *fileSender) send(batch []*EncodedMessage) error {
+	if s.f == nil || s.rotated() {
+		if s.f != nil {
+			s.f.Close()
+			s.f = nil
+		}
+		err := s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writeLines(s.f, batch)
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileSender) close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
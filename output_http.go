@@ -0,0 +1,153 @@
+package loglet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func init() {
+	registerOutput("http", NewHTTPPublisher)
+}
+
+// NewHTTPPublisher posts batches of messages to a URL as newline delimited
+// JSON. Batches are retried unless the server rejects them as bad requests,
+// and sent in halves if it rejects them as too large.
+func NewHTTPPublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error) {
+	sender, err := newHTTPSender(loglet, "application/x-ndjson")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := batchOptions{
+		name:  loglet.OutputName,
+		count: loglet.MaxMessageCount,
+		size:  loglet.MaxMessageSize,
+		delay: loglet.MaxMessageDelay,
+	}
+	return newBatchPublisher(opts, sender, msgs, done), nil
+}
+
+type httpSender struct {
+	// name of the output, for metrics
+	name        string
+	client      *http.Client
+	url         string
+	contentType string
+	headers     map[string]string
+}
+
+func newHTTPSender(loglet *options.Loglet, contentType string) (*httpSender, error) {
+	if loglet.OutputURL == "" {
+		return nil, fmt.Errorf("%s output requires --output-url", loglet.Output)
+	}
+	u, err := url.Parse(loglet.OutputURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid output url '%s'", loglet.OutputURL)
+	}
+
+	return &httpSender{
+		name:        loglet.OutputName,
+		client:      &http.Client{Timeout: loglet.OutputTimeout},
+		url:         loglet.OutputURL,
+		contentType: contentType,
+		headers:     loglet.OutputHeaders,
+	}, nil
+}
+
+func (s *httpSender) send(batch []*EncodedMessage) error {
+	var body bytes.Buffer
+	err := writeLines(&body, batch)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	_, err = s.post(s.url, &body)
+	return err
+}
+
+// post sends a request body, returning the response body if the request
+// succeeded
+func (s *httpSender) post(url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(truncate(respBody, 512)))
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return nil, &tooLargeError{err}
+		}
+		if !isRetriableStatus(resp.StatusCode) {
+			return nil, &permanentError{err}
+		}
+		if after := retryAfter(resp.Header.Get("Retry-After")); after > 0 {
+			return nil, &throttledError{err, after}
+		}
+		return nil, err
+	}
+
+	return respBody, nil
+}
+
+// maxResponseSize limits how much of a response is read, bulk responses
+// list every item so can be large
+const maxResponseSize = 64 << 20
+
+func (s *httpSender) close() error {
+	return nil
+}
+
+// isRetriableStatus returns false for client errors other than timeouts and
+// rate limiting, which won't succeed when sent again
+func isRetriableStatus(status int) bool {
+	if status >= 400 && status < 500 {
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// retryAfter parses a Retry-After header, given either in seconds or as a
+// date, returning 0 if there isn't one
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return t.Sub(time.Now())
+	}
+	return 0
+}
+
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
@@ -0,0 +1,284 @@
+package loglet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/golang/snappy"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func init() {
+	registerOutput("loki", NewLokiPublisher)
+}
+
+// loki label names follow prometheus
+var lokiLabelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// NewLokiPublisher pushes batches of messages to the loki at --output-url,
+// grouped into streams by the values of the --loki-label fields
+func NewLokiPublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done <-chan struct{}) (Publisher, error) {
+	sender, err := newLokiSender(loglet)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := batchOptions{
+		name:  loglet.OutputName,
+		count: loglet.MaxMessageCount,
+		size:  loglet.MaxMessageSize,
+		delay: loglet.MaxMessageDelay,
+	}
+	return newBatchPublisher(opts, sender, msgs, done), nil
+}
+
+type lokiSender struct {
+	*httpSender
+	labels       []string
+	staticLabels map[string]string
+	encode       func(streams []*lokiStream) ([]byte, error)
+	timestamps   *timestampFormat
+}
+
+type lokiStream struct {
+	// labels in loki's format, e.g. {hostname="a", systemd_unit="b"}
+	labels  string
+	values  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      []byte
+}
+
+func newLokiSender(loglet *options.Loglet) (*lokiSender, error) {
+	for _, name := range loglet.LokiLabels {
+		if !lokiLabelNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid loki label '%s'", name)
+		}
+	}
+	for name := range loglet.LokiStaticLabels {
+		if !lokiLabelNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid loki label '%s'", name)
+		}
+	}
+
+	var (
+		contentType string
+		encode      func([]*lokiStream) ([]byte, error)
+	)
+	switch loglet.LokiFormat {
+	case "protobuf":
+		contentType, encode = "application/x-protobuf", encodeLokiProtobuf
+	case "json":
+		contentType, encode = "application/json", encodeLokiJSON
+	default:
+		return nil, fmt.Errorf("unknown loki format '%s', expected protobuf or json", loglet.LokiFormat)
+	}
+
+	sender, err := newHTTPSender(loglet, contentType)
+	if err != nil {
+		return nil, err
+	}
+	sender.url = strings.TrimSuffix(sender.url, "/") + "/loki/api/v1/push"
+
+	timestamps, err := newTimestampFormat(loglet.TimestampFormat, loglet.TimestampPrecision)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lokiSender{
+		httpSender:   sender,
+		labels:       loglet.LokiLabels,
+		staticLabels: loglet.LokiStaticLabels,
+		encode:       encode,
+		timestamps:   timestamps,
+	}, nil
+}
+
+// streamLabels picks the labels of the stream a message belongs to. Loki
+// needs at least one label, so messages with none are labelled job=loglet.
+func (s *lokiSender) streamLabels(fields map[string]interface{}) map[string]string {
+	labels := make(map[string]string, len(s.labels)+len(s.staticLabels))
+	for k, v := range s.staticLabels {
+		labels[k] = v
+	}
+	for _, name := range s.labels {
+		v, ok := fields[name]
+		if !ok || v == nil {
+			continue
+		}
+		if str, ok := v.(string); ok {
+			labels[name] = str
+		} else {
+			labels[name] = fmt.Sprint(v)
+		}
+	}
+	if len(labels) == 0 {
+		labels["job"] = "loglet"
+	}
+	return labels
+}
+
+// formatLabels formats labels as loki expects them in push requests
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(strconv.Quote(labels[name]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// streams groups a batch into streams, in the order they first appear.
+// Entries are sorted by timestamp, as loki rejects entries older than the
+// one before in a stream, keeping the order of the journal for entries
+// logged at the same time.
+func (s *lokiSender) streams(batch []*EncodedMessage) []*lokiStream {
+	var (
+		streams []*lokiStream
+		byLabel = make(map[string]*lokiStream)
+		dropped int
+	)
+
+	for _, m := range batch {
+		fields, err := decodeMessage(m)
+		if err != nil {
+			log.Errorf("loki: dropping message %s: %s", m.Cursor, err)
+			dropped++
+			continue
+		}
+
+		values := s.streamLabels(fields)
+		labels := formatLabels(values)
+
+		stream, ok := byLabel[labels]
+		if !ok {
+			stream = &lokiStream{labels: labels, values: values}
+			byLabel[labels] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntry{s.timestamps.messageTime(m), m.Message})
+	}
+	outputMessagesDropped.WithLabelValues(s.name).Add(uint64(dropped))
+
+	for _, stream := range streams {
+		entries := stream.entries
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].timestamp.Before(entries[j].timestamp)
+		})
+	}
+
+	return streams
+}
+
+func (s *lokiSender) send(batch []*EncodedMessage) error {
+	streams := s.streams(batch)
+	if len(streams) == 0 {
+		return nil
+	}
+
+	body, err := s.encode(streams)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	_, err = s.post(s.url, bytes.NewReader(body))
+	return err
+}
+
+// encodeLokiJSON encodes a push request as JSON
+func encodeLokiJSON(streams []*lokiStream) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []stream `json:"streams"`
+	}{}
+
+	for _, s := range streams {
+		values := make([][2]string, len(s.entries))
+		for i, e := range s.entries {
+			values[i] = [2]string{strconv.FormatInt(e.timestamp.UnixNano(), 10), string(e.line)}
+		}
+		req.Streams = append(req.Streams, stream{s.values, values})
+	}
+
+	return json.Marshal(req)
+}
+
+// encodeLokiProtobuf encodes a push request as snappy compressed protobuf,
+// following loki's logproto.PushRequest:
+//
+//	message PushRequest { repeated Stream streams = 1; }
+//	message Stream { string labels = 1; repeated Entry entries = 2; }
+//	message Entry { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeLokiProtobuf(streams []*lokiStream) ([]byte, error) {
+	var req, stream, entry, ts []byte
+
+	for _, s := range streams {
+		stream = appendProtoBytes(stream[:0], 1, []byte(s.labels))
+		for _, e := range s.entries {
+			ts = ts[:0]
+			if seconds := e.timestamp.Unix(); seconds != 0 {
+				ts = appendProtoVarint(ts, 1, uint64(seconds))
+			}
+			if nanos := e.timestamp.Nanosecond(); nanos != 0 {
+				ts = appendProtoVarint(ts, 2, uint64(nanos))
+			}
+
+			entry = appendProtoBytes(entry[:0], 1, ts)
+			entry = appendProtoBytes(entry, 2, e.line)
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+		req = appendProtoBytes(req, 1, stream)
+	}
+
+	return snappy.Encode(nil, req), nil
+}
+
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field<<3|protoVarint))
+	return appendVarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|protoBytes))
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
@@ -0,0 +1,291 @@
+package loglet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+type protoField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+// decodeProto splits a protobuf message into its fields
+func decodeProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+
+	varint := func() (uint64, error) {
+		var v uint64
+		for shift := uint(0); len(b) > 0; shift += 7 {
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v, nil
+			}
+		}
+		return 0, fmt.Errorf("truncated varint")
+	}
+
+	for len(b) > 0 {
+		tag, err := varint()
+		if err != nil {
+			return nil, err
+		}
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case protoVarint:
+			f.varint, err = varint()
+		case protoBytes:
+			var n uint64
+			n, err = varint()
+			if err == nil && n > uint64(len(b)) {
+				err = fmt.Errorf("truncated field")
+			}
+			if err == nil {
+				f.bytes, b = b[:n], b[n:]
+			}
+		default:
+			err = fmt.Errorf("unexpected wire type %d", tag&7)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// lokiPush is a decoded push request, as stream labels followed by each
+// entry's timestamp and line
+type lokiPush [][]string
+
+// decodeLokiProtobuf decodes a push request the way loki does
+func decodeLokiProtobuf(body []byte) (lokiPush, error) {
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var push lokiPush
+	streams, err := decodeProto(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		fields, err := decodeProto(s.bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		var stream []string
+		for _, f := range fields {
+			switch f.num {
+			case 1:
+				stream = append(stream, string(f.bytes))
+			case 2:
+				entry, err := decodeProto(f.bytes)
+				if err != nil {
+					return nil, err
+				}
+				ts, err := decodeProto(entry[0].bytes)
+				if err != nil {
+					return nil, err
+				}
+				var seconds, nanos int64
+				for _, f := range ts {
+					if f.num == 1 {
+						seconds = int64(f.varint)
+					} else {
+						nanos = int64(f.varint)
+					}
+				}
+				stream = append(stream, time.Unix(seconds, nanos).UTC().Format(time.RFC3339Nano), string(entry[1].bytes))
+			}
+		}
+		push = append(push, stream)
+	}
+
+	return push, nil
+}
+
+func decodeLokiJSON(body []byte) (lokiPush, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	var push lokiPush
+	for _, s := range req.Streams {
+		stream := []string{formatLabels(s.Stream)}
+		for _, v := range s.Values {
+			var ns int64
+			fmt.Sscan(v[0], &ns)
+			stream = append(stream, time.Unix(0, ns).UTC().Format(time.RFC3339Nano), v[1])
+		}
+		push = append(push, stream)
+	}
+	return push, nil
+}
+
+func TestLokiOutput(t *testing.T) {
+	for _, test := range []struct {
+		format      string
+		contentType string
+		decode      func([]byte) (lokiPush, error)
+	}{
+		{"protobuf", "application/x-protobuf", decodeLokiProtobuf},
+		{"json", "application/json", decodeLokiJSON},
+	} {
+		var pushes []lokiPush
+		throttled := false
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("Content-Type") != test.contentType || r.Header.Get("X-Scope-OrgID") != "team" {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			if !throttled {
+				throttled = true
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(r.Body)
+			push, err := test.decode(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pushes = append(pushes, push)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		loglet := options.NewLoglet()
+		loglet.OutputURL = server.URL
+		loglet.OutputHeaders = map[string]string{"X-Scope-OrgID": "team"}
+		loglet.LokiFormat = test.format
+		loglet.LokiStaticLabels = map[string]string{"env": "test"}
+
+		sender, err := newLokiSender(loglet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msgs := make(chan *EncodedMessage)
+		done := make(chan struct{})
+		publisher := newBatchPublisher(batchOptions{name: "loki", count: 3, delay: time.Hour, backoff: time.Millisecond}, sender, msgs, done)
+
+		lines := []string{
+			`{"hostname":"a","systemd_unit":"x.service","@timestamp":"2026-10-17T10:00:00.001Z"}`,
+			`{"hostname":"b","@timestamp":"2026-10-17T10:00:00.002Z"}`,
+			`{"hostname":"a","systemd_unit":"x.service","@timestamp":"2026-10-17T10:00:00.003Z"}`,
+		}
+		go func() {
+			for i, line := range lines {
+				msgs <- &EncodedMessage{Cursor: fmt.Sprintf("c%d", i+1), Message: []byte(line)}
+			}
+			close(msgs)
+		}()
+
+		start := time.Now()
+		var published []string
+		for cursor := range publisher.Published() {
+			published = append(published, cursor)
+		}
+		close(done)
+		server.Close()
+
+		if time.Since(start) < time.Second {
+			t.Errorf("%s: sent again before Retry-After", test.format)
+		}
+		if !reflect.DeepEqual(published, []string{"c3"}) {
+			t.Errorf("%s: expected to publish c3, got %v", test.format, published)
+		}
+
+		expected := []lokiPush{{
+			{`{env="test", hostname="a", systemd_unit="x.service"}`, "2026-10-17T10:00:00.001Z", lines[0], "2026-10-17T10:00:00.003Z", lines[2]},
+			{`{env="test", hostname="b"}`, "2026-10-17T10:00:00.002Z", lines[1]},
+		}}
+		if !reflect.DeepEqual(pushes, expected) {
+			t.Errorf("%s: expected %q, got %q", test.format, expected, pushes)
+		}
+	}
+}
+
+func TestLokiStreamLabels(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.OutputURL = "http://localhost:3100"
+
+	sender, err := newLokiSender(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := formatLabels(sender.streamLabels(map[string]interface{}{"hostname": "a", "systemd_unit": `quo"te`, "priority": 3}))
+	if labels != `{hostname="a", systemd_unit="quo\"te"}` {
+		t.Errorf("unexpected labels %s", labels)
+	}
+
+	labels = formatLabels(sender.streamLabels(map[string]interface{}{}))
+	if labels != `{job="loglet"}` {
+		t.Errorf("expected job label for a message without labels, got %s", labels)
+	}
+
+	loglet.LokiLabels = []string{"@timestamp"}
+	_, err = newLokiSender(loglet)
+	if err == nil {
+		t.Errorf("expected error for invalid label name")
+	}
+}
+
+func TestLokiStreamsSortedByTimestamp(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.OutputURL = "http://localhost:3100"
+
+	sender, err := newLokiSender(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch []*EncodedMessage
+	for i, ts := range []string{"10:00:00.002", "10:00:00.001", "10:00:00.002", "10:00:00.000"} {
+		batch = append(batch, &EncodedMessage{
+			Cursor:  fmt.Sprintf("c%d", i+1),
+			Message: []byte(fmt.Sprintf(`{"hostname":"a","id":%d,"@timestamp":"2026-10-17T%sZ"}`, i+1, ts)),
+		})
+	}
+
+	streams := sender.streams(batch)
+	if len(streams) != 1 {
+		t.Fatalf("expected 1 stream, got %d", len(streams))
+	}
+
+	var order []string
+	for _, e := range streams[0].entries {
+		order = append(order, string(e.line[len(`{"hostname":"a","id":`)]))
+	}
+	// entries logged at the same time keep the order of the journal
+	if !reflect.DeepEqual(order, []string{"4", "2", "1", "3"}) {
+		t.Errorf("expected entries in timestamp order, got %v", order)
+	}
+}
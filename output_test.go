@@ -0,0 +1,245 @@
+package loglet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+type recordingSender struct {
+	batches [][]string
+	// errors to return from successive sends
+	errs []error
+}
+
+func (s *recordingSender) send(batch []*EncodedMessage) error {
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+
+	var cursors []string
+	for _, m := range batch {
+		cursors = append(cursors, m.Cursor)
+	}
+	s.batches = append(s.batches, cursors)
+	return nil
+}
+
+func (s *recordingSender) close() error {
+	return nil
+}
+
+// publishAll sends messages with the given cursors through a publisher,
+// closes its input and returns the cursors it published
+func publishAll(publisher Publisher, msgs chan<- *EncodedMessage, cursors ...string) []string {
+	go func() {
+		for _, cursor := range cursors {
+			msgs <- &EncodedMessage{Cursor: cursor, Message: []byte("{}")}
+		}
+		close(msgs)
+	}()
+
+	var published []string
+	for cursor := range publisher.Published() {
+		published = append(published, cursor)
+	}
+	return published
+}
+
+func TestBatchPublisherBatchesByCount(t *testing.T) {
+	sender := &recordingSender{}
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	defer close(done)
+
+	publisher := newBatchPublisher(batchOptions{name: "test", count: 2, delay: time.Hour}, sender, msgs, done)
+	published := publishAll(publisher, msgs, "a", "b", "c", "d", "e")
+
+	expected := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if !reflect.DeepEqual(sender.batches, expected) {
+		t.Error("unexpected batches", sender.batches)
+	}
+	if !reflect.DeepEqual(published, []string{"b", "d", "e"}) {
+		t.Error("expected last cursor of each batch to be published, was", published)
+	}
+}
+
+func TestBatchPublisherRetriesFailedBatches(t *testing.T) {
+	sender := &recordingSender{errs: []error{
+		fmt.Errorf("unavailable"),
+		nil,
+		&permanentError{fmt.Errorf("rejected")},
+	}}
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	defer close(done)
+
+	publisher := newBatchPublisher(batchOptions{name: "test", count: 1, backoff: time.Millisecond}, sender, msgs, done)
+	published := publishAll(publisher, msgs, "a", "b", "c")
+
+	// a is retried, b is dropped
+	expected := [][]string{{"a"}, {"c"}}
+	if !reflect.DeepEqual(sender.batches, expected) {
+		t.Error("unexpected batches", sender.batches)
+	}
+	if !reflect.DeepEqual(published, []string{"a", "b", "c"}) {
+		t.Error("expected every cursor to be published, was", published)
+	}
+}
+
+func TestBatchPublisherSplitsTooLargeBatches(t *testing.T) {
+	tooLarge := &tooLargeError{fmt.Errorf("413 Request Entity Too Large")}
+	sender := &recordingSender{errs: []error{tooLarge, tooLarge, nil, nil, nil, tooLarge}}
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	defer close(done)
+
+	publisher := newBatchPublisher(batchOptions{name: "test", count: 4, delay: time.Hour, backoff: time.Millisecond}, sender, msgs, done)
+	published := publishAll(publisher, msgs, "a", "b", "c", "d", "e")
+
+	// halves are split again until they fit, and e alone is dropped
+	expected := [][]string{{"a"}, {"b"}, {"c", "d"}}
+	if !reflect.DeepEqual(sender.batches, expected) {
+		t.Error("unexpected batches", sender.batches)
+	}
+	if !reflect.DeepEqual(published, []string{"d", "e"}) {
+		t.Error("expected last cursor of each batch to be published, was", published)
+	}
+}
+
+func TestFilePublisherReopensRotatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	loglet := options.NewLoglet()
+	loglet.OutputFile = filepath.Join(dir, "loglet.log")
+
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	defer close(done)
+
+	publisher, err := NewFilePublisher(loglet, msgs, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs <- &EncodedMessage{Cursor: "a", Message: []byte(`{"a":1}`)}
+	if cursor := <-publisher.Published(); cursor != "a" {
+		t.Fatal("expected a to be published, was", cursor)
+	}
+
+	err = os.Rename(loglet.OutputFile, loglet.OutputFile+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs <- &EncodedMessage{Cursor: "b", Message: []byte(`{"b":2}`)}
+	if cursor := <-publisher.Published(); cursor != "b" {
+		t.Fatal("expected b to be published, was", cursor)
+	}
+
+	for path, expected := range map[string]string{
+		loglet.OutputFile + ".1": "{\"a\":1}\n",
+		loglet.OutputFile:        "{\"b\":2}\n",
+	} {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Errorf("expected %s to contain %q, was %q", path, expected, contents)
+		}
+	}
+
+	loglet.OutputFile = ""
+	_, err = NewFilePublisher(loglet, msgs, done)
+	if err == nil {
+		t.Error("expected error without an output file")
+	}
+}
+
+func TestHTTPSender(t *testing.T) {
+	var (
+		statuses = []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusBadRequest, http.StatusRequestEntityTooLarge}
+		bodies   []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Content-Type") != "application/x-ndjson" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Error("unexpected headers", r.Header)
+		}
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer server.Close()
+
+	loglet := options.NewLoglet()
+	loglet.Output = "http"
+	loglet.OutputURL = server.URL
+	loglet.OutputHeaders = map[string]string{"Authorization": "Bearer token"}
+
+	sender, err := newHTTPSender(loglet, "application/x-ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := []*EncodedMessage{{Message: []byte(`{"a":1}`)}, {Message: []byte(`{"b":2}`)}}
+
+	err = sender.send(batch)
+	if err != nil {
+		t.Error("expected batch to be sent, got", err)
+	}
+	if bodies[0] != "{\"a\":1}\n{\"b\":2}\n" {
+		t.Errorf("unexpected body %q", bodies[0])
+	}
+
+	err = sender.send(batch)
+	if _, permanent := err.(*permanentError); err == nil || permanent {
+		t.Error("expected retriable error for unavailable server, got", err)
+	}
+
+	err = sender.send(batch)
+	if _, permanent := err.(*permanentError); !permanent {
+		t.Error("expected permanent error for bad request, got", err)
+	}
+
+	err = sender.send(batch)
+	if _, tooLarge := err.(*tooLargeError); !tooLarge {
+		t.Error("expected too large error for request entity too large, got", err)
+	}
+
+	for _, url := range []string{"", "ftp://example.com", "http://"} {
+		loglet.OutputURL = url
+		_, err := newHTTPSender(loglet, "application/x-ndjson")
+		if err == nil || !strings.Contains(err.Error(), "url") {
+			t.Errorf("expected error for url %q, got %v", url, err)
+		}
+	}
+}
+
+func TestNewPublisherUnknownOutput(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.Output = "carrier-pigeon"
+
+	_, err := NewPublisher(loglet, nil, nil)
+	if err == nil {
+		t.Error("expected error for unknown output")
+	}
+}
@@ -0,0 +1,107 @@
+package loglet
+
+import "github.com/uswitch/loglet/cmd/loglet/options"
+
+const (
+	containerIDField     = "CONTAINER_ID"
+	partialMessageField  = "CONTAINER_PARTIAL_MESSAGE"
+	journalMessageField  = "MESSAGE"
+	partialMessageMarker = "true"
+)
+
+// JournalEntryJoiner joins the pieces docker's journald log driver splits
+// long lines into back into single entries
+type JournalEntryJoiner interface {
+	Ret() <-chan error
+	Entries() <-chan *JournalEntry
+}
+
+type journalEntryJoiner struct {
+	ret     chan error
+	entries chan *JournalEntry
+
+	maxSize int
+	// messages still missing pieces, by container
+	partial *entryGroups
+}
+
+func NewJournalEntryJoiner(loglet *options.Loglet, splitEntries <-chan *JournalEntry, done <-chan struct{}) JournalEntryJoiner {
+	ret := make(chan error, 2)
+	joinedEntries := make(chan *JournalEntry, stageBuffer)
+
+	joiner := &journalEntryJoiner{
+		ret:     ret,
+		entries: joinedEntries,
+		maxSize: loglet.PartialMessageMaxSize,
+		partial: newEntryGroups(loglet.PartialMessageTimeout),
+	}
+
+	go joiner.start(splitEntries, done)
+
+	return joiner
+}
+
+func (j *journalEntryJoiner) Ret() <-chan error {
+	return j.ret
+}
+
+func (j *journalEntryJoiner) Entries() <-chan *JournalEntry {
+	return j.entries
+}
+
+func (j *journalEntryJoiner) start(splitEntries <-chan *JournalEntry, done <-chan struct{}) {
+	defer close(j.ret)
+	defer close(j.entries)
+
+	j.partial.run(splitEntries, j.entries, done, j.add, func(partial *entryGroup) {
+		j.flush(partial, partialTimedOut)
+	})
+}
+
+func (j *journalEntryJoiner) add(position uint64, entry *JournalEntry) {
+	container, ok := entry.Fields[containerIDField]
+	if !ok {
+		j.partial.send(position, entry)
+		return
+	}
+
+	isPartial := entry.Fields[partialMessageField] == partialMessageMarker
+
+	partial, pending := j.partial.get(container)
+	if pending && partial.size+len(entry.Fields[journalMessageField]) > j.maxSize {
+		// send what there is so far and start again with this piece
+		j.flush(partial, partialTooLarge)
+		pending = false
+	}
+
+	switch {
+	case isPartial:
+		j.partial.add(container, position, entry)
+	case pending:
+		j.flush(j.partial.add(container, position, entry), partialJoined)
+	default:
+		j.partial.send(position, entry)
+	}
+}
+
+// how a message came to be sent, for metrics
+const (
+	partialJoined   = "joined"
+	partialTimedOut = "timeout"
+	partialTooLarge = "size"
+)
+
+// flush joins the pieces of a message into the last of them, which carries
+// the cursor forward, dated from the first. Messages sent before their last piece is read are
+// left marked as partial.
+func (j *journalEntryJoiner) flush(partial *entryGroup, result string) {
+	fields := j.partial.remove(partial, "")
+	if result == partialJoined {
+		delete(fields, partialMessageField)
+	} else {
+		fields[partialMessageField] = partialMessageMarker
+	}
+
+	partialMessages.WithLabelValues(result).Inc()
+	j.partial.send(partial.last, &JournalEntry{Cursor: partial.entry.Cursor, Fields: fields})
+}
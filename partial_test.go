@@ -0,0 +1,137 @@
+package loglet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func dockerEntry(cursor, container, message string, partial bool) *JournalEntry {
+	fields := map[string]string{"MESSAGE": message}
+	if container != "" {
+		fields["CONTAINER_ID"] = container
+	}
+	if partial {
+		fields["CONTAINER_PARTIAL_MESSAGE"] = "true"
+	}
+	return &JournalEntry{Cursor: cursor, Fields: fields}
+}
+
+// joinEntries sends entries through a joiner and returns everything it sends on
+func joinEntries(loglet *options.Loglet, entries ...*JournalEntry) []*JournalEntry {
+	split := make(chan *JournalEntry)
+	done := make(chan struct{})
+	defer close(done)
+
+	joiner := NewJournalEntryJoiner(loglet, split, done)
+	go func() {
+		for _, entry := range entries {
+			split <- entry
+		}
+		close(split)
+	}()
+
+	var joined []*JournalEntry
+	for entry := range joiner.Entries() {
+		joined = append(joined, entry)
+	}
+	return joined
+}
+
+func TestJournalEntryJoiner(t *testing.T) {
+	loglet := options.NewLoglet()
+
+	joined := joinEntries(loglet,
+		dockerEntry("c1", "aaa", `{"a":`, true),
+		dockerEntry("c2", "bbb", "other container", false),
+		dockerEntry("c3", "aaa", `"long`, true),
+		dockerEntry("c4", "", "not a container", false),
+		dockerEntry("c5", "aaa", ` line"}`, false),
+		dockerEntry("c6", "aaa", "short line", false),
+	)
+
+	expected := []*JournalEntry{
+		dockerEntry("c2", "bbb", "other container", false),
+		dockerEntry("c4", "", "not a container", false),
+		dockerEntry("c5", "aaa", `{"a":"long line"}`, false),
+		dockerEntry("c6", "aaa", "short line", false),
+	}
+	if !reflect.DeepEqual(joined, expected) {
+		t.Errorf("expected %v, got %v", expected, joined)
+	}
+}
+
+func TestJournalEntryJoinerCursorsStayInOrder(t *testing.T) {
+	loglet := options.NewLoglet()
+
+	// entries read after a message's first piece can't be committed until it
+	// has been sent, so they're held back until then
+	joined := joinEntries(loglet,
+		dockerEntry("c1", "aaa", "a1", true),
+		dockerEntry("c2", "bbb", "b1", true),
+		dockerEntry("c3", "ccc", "complete", false),
+		dockerEntry("c4", "bbb", "b2", false),
+		dockerEntry("c5", "aaa", "a2", false),
+	)
+
+	var cursors []string
+	for _, entry := range joined {
+		cursors = append(cursors, entry.Cursor)
+	}
+	expected := []string{"c3", "c4", "c5"}
+	if !reflect.DeepEqual(cursors, expected) {
+		t.Errorf("expected cursors %v, got %v", expected, cursors)
+	}
+	if joined[1].Fields["MESSAGE"] != "b1b2" || joined[2].Fields["MESSAGE"] != "a1a2" {
+		t.Errorf("expected joined messages, got %v", joined)
+	}
+}
+
+func TestJournalEntryJoinerMaxSize(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.PartialMessageMaxSize = 4
+
+	joined := joinEntries(loglet,
+		dockerEntry("c1", "aaa", "12", true),
+		dockerEntry("c2", "aaa", "34", true),
+		dockerEntry("c3", "aaa", "56", true),
+		dockerEntry("c4", "aaa", "7", false),
+	)
+
+	expected := []*JournalEntry{
+		dockerEntry("c2", "aaa", "1234", true),
+		dockerEntry("c4", "aaa", "567", false),
+	}
+	if !reflect.DeepEqual(joined, expected) {
+		t.Errorf("expected %v, got %v", expected, joined)
+	}
+}
+
+func TestJournalEntryJoinerTimeout(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.PartialMessageTimeout = 10 * time.Millisecond
+
+	split := make(chan *JournalEntry)
+	done := make(chan struct{})
+	defer close(done)
+
+	joiner := NewJournalEntryJoiner(loglet, split, done)
+	split <- dockerEntry("c1", "aaa", "never", true)
+	split <- dockerEntry("c2", "bbb", "held back", false)
+
+	for _, expected := range []*JournalEntry{
+		dockerEntry("c1", "aaa", "never", true),
+		dockerEntry("c2", "bbb", "held back", false),
+	} {
+		select {
+		case entry := <-joiner.Entries():
+			if !reflect.DeepEqual(entry, expected) {
+				t.Errorf("expected %v, got %v", expected, entry)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %v to be sent after the timeout", expected)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package loglet
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	kafka "github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
 
 	"github.com/uswitch/loglet/cmd/loglet/options"
 )
@@ -15,7 +17,9 @@ type Publisher interface {
 }
 
 type kafkaPublisher struct {
-	producer  kafka.SyncProducer
+	name     string
+	producer kafka.AsyncProducer
+	// topic for messages that weren't routed
 	topic     string
 	ret       chan error
 	published chan string
@@ -29,10 +33,11 @@ func NewKafkaPublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done
 	}
 
 	publisher := &kafkaPublisher{
+		name:      loglet.OutputName,
 		ret:       make(chan error),
 		published: make(chan string),
 		producer:  producer,
-		topic:     loglet.KafkaTopic,
+		topic:     loglet.FallbackTopic,
 	}
 
 	go publisher.loop(msgs, done)
@@ -40,18 +45,115 @@ func NewKafkaPublisher(loglet *options.Loglet, msgs <-chan *EncodedMessage, done
 	return publisher, nil
 }
 
-func createProducer(loglet *options.Loglet) (kafka.SyncProducer, error) {
+func createProducer(loglet *options.Loglet) (kafka.AsyncProducer, error) {
+	config, err := newProducerConfig(loglet)
+	if err != nil {
+		return nil, err
+	}
+
 	if loglet.FakeKafka {
 		return nil, nil
 	}
 
+	return kafka.NewAsyncProducer(loglet.KafkaBrokers, config)
+}
+
+var (
+	requiredAcks = map[string]kafka.RequiredAcks{
+		"none":  kafka.NoResponse,
+		"local": kafka.WaitForLocal,
+		"all":   kafka.WaitForAll,
+	}
+	compressionCodecs = map[string]kafka.CompressionCodec{
+		"none":   kafka.CompressionNone,
+		"gzip":   kafka.CompressionGZIP,
+		"snappy": kafka.CompressionSnappy,
+		"lz4":    kafka.CompressionLZ4,
+		"zstd":   kafka.CompressionZSTD,
+	}
+)
+
+// newProducerConfig builds and validates the producer configuration, so
+// that mistakes are reported on startup rather than when first connecting
+func newProducerConfig(loglet *options.Loglet) (*kafka.Config, error) {
+	partitioner, err := newPartitioner(loglet.Partitioner)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(loglet)
+	if err != nil {
+		return nil, err
+	}
+
+	acks, ok := requiredAcks[loglet.RequiredAcks]
+	if !ok {
+		return nil, fmt.Errorf("unknown acks '%s', expected none, local or all", loglet.RequiredAcks)
+	}
+
+	compression, ok := compressionCodecs[loglet.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression '%s', expected none, gzip, snappy, lz4 or zstd", loglet.Compression)
+	}
+
+	version, err := kafka.ParseKafkaVersion(loglet.KafkaVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kafka version '%s': %s", loglet.KafkaVersion, err)
+	}
+	if compression == kafka.CompressionZSTD && !version.IsAtLeast(kafka.V2_1_0_0) {
+		return nil, fmt.Errorf("zstd compression needs kafka version 2.1.0 or later, got %s", version)
+	}
+
+	if loglet.Idempotent {
+		if acks != kafka.WaitForAll {
+			return nil, fmt.Errorf("idempotence needs acks from all replicas, got acks '%s'", loglet.RequiredAcks)
+		}
+		if !version.IsAtLeast(kafka.V0_11_0_0) {
+			return nil, fmt.Errorf("idempotence needs kafka version 0.11.0 or later, got %s", version)
+		}
+		if loglet.Retries < 1 {
+			return nil, fmt.Errorf("idempotence needs at least 1 retry, got %d", loglet.Retries)
+		}
+	}
+
+	if loglet.MaxMessageBytes >= int(kafka.MaxRequestSize) {
+		return nil, fmt.Errorf("max message bytes %d must be less than the maximum request size of %d", loglet.MaxMessageBytes, kafka.MaxRequestSize)
+	}
+
 	config := kafka.NewConfig()
 	config.ClientID = "loglet"
-	config.Producer.RequiredAcks = kafka.WaitForLocal
-	//config.Producer.Flush.Messages = kafka.
-	config.Producer.Retry.Backoff = 1 * time.Second
+	config.Version = version
+	config.Producer.RequiredAcks = acks
+	config.Producer.Compression = compression
+	config.Producer.Idempotent = loglet.Idempotent
+	if loglet.Idempotent {
+		// retried batches must not overtake the ones after them
+		config.Net.MaxOpenRequests = 1
+	}
+	config.Producer.MaxMessageBytes = loglet.MaxMessageBytes
+	config.Producer.Retry.Max = loglet.Retries
+	config.Producer.Retry.Backoff = loglet.RetryBackoff
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = partitioner
+	config.Producer.Flush.Frequency = loglet.MaxMessageDelay
+	config.Producer.Flush.Bytes = loglet.MaxMessageSize
+	config.Producer.Flush.Messages = loglet.MaxMessageCount
+	if tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
 
-	return kafka.NewSyncProducer(loglet.KafkaBrokers, config)
+	err = configureSASL(config, loglet)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
 }
 
 func (p *kafkaPublisher) Ret() <-chan error {
@@ -62,40 +164,256 @@ func (p *kafkaPublisher) Published() <-chan string {
 	return p.published
 }
 
+const (
+	minRetryBackoff = 1 * time.Second
+	maxRetryBackoff = 1 * time.Minute
+)
+
 func (p *kafkaPublisher) loop(msgs <-chan *EncodedMessage, done <-chan struct{}) {
 	defer close(p.ret)
 	defer close(p.published)
 
+	if p.producer != nil {
+		defer func() {
+			// when stopped before draining there may be messages the
+			// producer would otherwise wait for
+			select {
+			case <-done:
+				p.producer.AsyncClose()
+				return
+			default:
+			}
+
+			err := p.producer.Close()
+			if err != nil {
+				log.Debugf("kafka: error closing producer: %v", err)
+			}
+		}()
+	}
+
 	var (
-		ok bool
-		m  *EncodedMessage
+		acks      = newAckQueue()
+		successes <-chan *kafka.ProducerMessage
+		failures  <-chan *kafka.ProducerError
+
+		// messages waiting to be handed to the producer, either new or
+		// being retried after a failure
+		queue []*kafka.ProducerMessage
+
+		// retry is only non-nil while backing off after a failure, during
+		// which no messages are accepted or sent
+		retry   <-chan time.Time
+		backoff = minRetryBackoff
+
+		// published is only non-nil when there is a cursor to publish
+		published chan<- string
+		cursor    string
+
+		produceLatency  = kafkaProduceLatency.WithLabelValues(p.name)
+		produceSuccess  = kafkaProduceSuccess.WithLabelValues(p.name)
+		retriedFailures = kafkaProduceFailures.WithLabelValues(p.name, "true")
+		droppedFailures = kafkaProduceFailures.WithLabelValues(p.name, "false")
+		droppedMessages = outputMessagesDropped.WithLabelValues(p.name)
+		pending         = kafkaPending.WithLabelValues(p.name)
 	)
 
+	if p.producer != nil {
+		successes = p.producer.Successes()
+		failures = p.producer.Errors()
+	}
+
 	for {
+		// once the input is closed, return after every message has been
+		// acknowledged and the last cursor published
+		if msgs == nil && acks.len() == 0 && published == nil {
+			return
+		}
+
+		var (
+			in    <-chan *EncodedMessage
+			input chan<- *kafka.ProducerMessage
+			next  *kafka.ProducerMessage
+		)
+
+		switch {
+		case retry != nil:
+		case len(queue) > 0:
+			input = p.producer.Input()
+			next = queue[0]
+		default:
+			in = msgs
+		}
+
 		select {
 		case <-done:
 			return
-		case m, ok = <-msgs:
+
+		case m, ok := <-in:
 			if !ok {
-				return
+				msgs = nil
+				continue
+			}
+			seq := acks.add(m.Cursor)
+			if p.producer == nil {
+				cursor, _ = acks.ack(seq)
+				published = p.published
+				continue
+			}
+			pending.Set(float64(acks.len()))
+			topic := m.Topic
+			if topic == "" {
+				topic = p.topic
+			}
+			pm := &kafka.ProducerMessage{
+				Topic:    topic,
+				Value:    kafka.ByteEncoder(m.Message),
+				Metadata: &messageMetadata{seq: seq, queued: time.Now()},
+			}
+			// a nil key lets the partitioner pick any partition
+			if m.Key != nil {
+				pm.Key = kafka.ByteEncoder(m.Key)
+			}
+			queue = append(queue, pm)
+
+		case input <- next:
+			queue = queue[1:]
+
+		case m := <-successes:
+			backoff = minRetryBackoff
+			metadata := m.Metadata.(*messageMetadata)
+			produceSuccess.Inc()
+			produceLatency.Observe(time.Since(metadata.queued).Seconds())
+			if c, ok := acks.ack(metadata.seq); ok {
+				cursor = c
+				published = p.published
 			}
-			if p.producer != nil {
-				_, _, err := p.producer.SendMessage(&kafka.ProducerMessage{
-					Topic: p.topic,
-					Value: kafka.ByteEncoder(m.Message),
-				})
-				if err != nil {
-					p.ret <- fmt.Errorf("kafka: unable to produce message: %v", err)
-					return
+			pending.Set(float64(acks.len()))
+
+		case err := <-failures:
+			// messages kafka will never accept are dropped rather than
+			// holding back the cursor forever, like the batches other
+			// outputs reject
+			if !isRetriable(err.Err) {
+				droppedFailures.Inc()
+				droppedMessages.Inc()
+				log.Errorf("kafka: dropping message that can't be produced: %v", err.Err)
+				if c, ok := acks.ack(err.Msg.Metadata.(*messageMetadata).seq); ok {
+					cursor = c
+					published = p.published
 				}
+				pending.Set(float64(acks.len()))
+				continue
 			}
-		}
 
-		select {
-		case <-done:
-			return
-		case p.published <- m.Cursor:
+			retriedFailures.Inc()
+
+			// messages coming back from the producer carry internal state,
+			// so a fresh message is queued for the retry
+			queue = requeue(queue, &kafka.ProducerMessage{
+				Topic:    err.Msg.Topic,
+				Key:      err.Msg.Key,
+				Value:    err.Msg.Value,
+				Metadata: err.Msg.Metadata,
+			})
+
+			if retry == nil {
+				log.Warnf("kafka: unable to produce message, retrying in %s: %v", backoff, err.Err)
+				retry = time.After(backoff)
+				backoff = backoff * 2
+				if backoff > maxRetryBackoff {
+					backoff = maxRetryBackoff
+				}
+			}
+
+		case <-retry:
+			retry = nil
+
+		case published <- cursor:
+			published = nil
 		}
 	}
+}
+
+// messageMetadata travels with a message through the producer
+type messageMetadata struct {
+	// position in the ack queue
+	seq uint64
+	// when the message was first queued, for measuring latency
+	queued time.Time
+}
+
+// requeue puts a message being retried back in the queue ahead of any
+// messages that came after it, so retries don't reorder messages
+func requeue(queue []*kafka.ProducerMessage, m *kafka.ProducerMessage) []*kafka.ProducerMessage {
+	seq := m.Metadata.(*messageMetadata).seq
+	i := sort.Search(len(queue), func(i int) bool {
+		return queue[i].Metadata.(*messageMetadata).seq > seq
+	})
+
+	queue = append(queue, nil)
+	copy(queue[i+1:], queue[i:])
+	queue[i] = m
+	return queue
+}
+
+// isRetriable returns false for errors that will never succeed no matter how
+// many times the message is sent again
+func isRetriable(err error) bool {
+	switch err {
+	case kafka.ErrMessageSizeTooLarge, kafka.ErrInvalidMessage, kafka.ErrInvalidMessageSize, kafka.ErrMessageSetSizeTooLarge:
+		return false
+	}
+	return true
+}
+
+// ackQueue keeps track of in-flight messages in the order they were sent, so
+// that a cursor is only released once every message before it has been
+// acknowledged.
+type ackQueue struct {
+	head    uint64
+	entries []ackEntry
+}
+
+type ackEntry struct {
+	cursor string
+	acked  bool
+}
+
+func newAckQueue() *ackQueue {
+	return &ackQueue{}
+}
+
+// add enqueues a message with the given cursor, returning its sequence number
+func (q *ackQueue) add(cursor string) uint64 {
+	q.entries = append(q.entries, ackEntry{cursor: cursor})
+	return q.head + uint64(len(q.entries)-1)
+}
+
+// len returns the number of messages that haven't been released yet
+func (q *ackQueue) len() int {
+	return len(q.entries)
+}
+
+// ack marks the message with the given sequence number as acknowledged and
+// returns the cursor of the latest message for which it and all preceding
+// messages have been acknowledged, if any
+func (q *ackQueue) ack(seq uint64) (string, bool) {
+	if seq < q.head || seq-q.head >= uint64(len(q.entries)) {
+		return "", false
+	}
+	q.entries[seq-q.head].acked = true
+
+	n := 0
+	for n < len(q.entries) && q.entries[n].acked {
+		n++
+	}
+	if n == 0 {
+		return "", false
+	}
+
+	cursor := q.entries[n-1].cursor
+	q.entries = q.entries[n:]
+	q.head += uint64(n)
 
+	return cursor, true
 }
@@ -0,0 +1,238 @@
+package loglet
+
+import (
+	"strings"
+	"testing"
+
+	kafka "github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func TestAckQueueReleasesCursorsInOrder(t *testing.T) {
+	q := newAckQueue()
+	a := q.add("a")
+	b := q.add("b")
+	c := q.add("c")
+
+	if cursor, ok := q.ack(b); ok {
+		t.Error("expected no cursor while a is in flight, got", cursor)
+	}
+	if cursor, ok := q.ack(c); ok {
+		t.Error("expected no cursor while a is in flight, got", cursor)
+	}
+
+	cursor, ok := q.ack(a)
+	if !ok || cursor != "c" {
+		t.Error("expected cursor c once a was acked, got", cursor)
+	}
+
+	if _, ok := q.ack(a); ok {
+		t.Error("expected acking an already released message to be ignored")
+	}
+
+	d := q.add("d")
+	cursor, ok = q.ack(d)
+	if !ok || cursor != "d" {
+		t.Error("expected cursor d, got", cursor)
+	}
+}
+
+func TestRequeueKeepsMessageOrder(t *testing.T) {
+	message := func(seq uint64) *kafka.ProducerMessage {
+		return &kafka.ProducerMessage{Metadata: &messageMetadata{seq: seq}}
+	}
+
+	var queue []*kafka.ProducerMessage
+	for _, seq := range []uint64{3, 4, 1, 5, 2, 0} {
+		queue = requeue(queue, message(seq))
+	}
+
+	for i, m := range queue {
+		if seq := m.Metadata.(*messageMetadata).seq; seq != uint64(i) {
+			t.Errorf("expected message %d at %d, got %d", i, i, seq)
+		}
+	}
+}
+
+func TestKafkaPublisherDropsMessagesKafkaRejects(t *testing.T) {
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndFail(kafka.ErrMessageSizeTooLarge)
+	producer.ExpectInputAndSucceed()
+
+	publisher := &kafkaPublisher{
+		name:      "test-dropped",
+		ret:       make(chan error),
+		published: make(chan string),
+		producer:  producer,
+		topic:     "logs",
+	}
+
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	defer close(done)
+	go publisher.loop(msgs, done)
+
+	msgs <- &EncodedMessage{Cursor: "a", Message: []byte("{}")}
+	msgs <- &EncodedMessage{Cursor: "b", Message: []byte("{}")}
+	close(msgs)
+
+	var cursor string
+	for c := range publisher.Published() {
+		cursor = c
+	}
+	if cursor != "b" {
+		t.Error("expected last published cursor to be b, was", cursor)
+	}
+	if dropped := outputMessagesDropped.WithLabelValues("test-dropped").Value(); dropped != 1 {
+		t.Error("expected 1 dropped message, got", dropped)
+	}
+}
+
+func TestKafkaPublisherPublishesAckedCursors(t *testing.T) {
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+
+	publisher := &kafkaPublisher{
+		name:      "test-acked",
+		ret:       make(chan error),
+		published: make(chan string),
+		producer:  producer,
+		topic:     "logs",
+	}
+
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	go publisher.loop(msgs, done)
+
+	msgs <- &EncodedMessage{Cursor: "a", Message: []byte("{}")}
+	msgs <- &EncodedMessage{Cursor: "b", Message: []byte("{}")}
+
+	var cursor string
+	for cursor != "b" {
+		cursor = <-publisher.Published()
+	}
+
+	close(done)
+	for err := range publisher.Ret() {
+		t.Error("unexpected error:", err)
+	}
+
+	body := scrape(t)
+	for _, sample := range []string{
+		`loglet_kafka_produce_successes_total{output="test-acked"} 2`,
+		`loglet_kafka_produce_latency_seconds_count{output="test-acked"} 2`,
+		`loglet_kafka_pending_messages{output="test-acked"} 0`,
+	} {
+		if !strings.Contains(body, "\n"+sample+"\n") {
+			t.Errorf("expected %s in metrics", sample)
+		}
+	}
+}
+
+func TestKafkaPublisherDrainsWhenInputCloses(t *testing.T) {
+	config := kafka.NewConfig()
+	config.Producer.Return.Successes = true
+
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+
+	publisher := &kafkaPublisher{
+		ret:       make(chan error),
+		published: make(chan string),
+		producer:  producer,
+		topic:     "logs",
+	}
+
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	defer close(done)
+	go publisher.loop(msgs, done)
+
+	msgs <- &EncodedMessage{Cursor: "a", Message: []byte("{}")}
+	msgs <- &EncodedMessage{Cursor: "b", Message: []byte("{}")}
+	close(msgs)
+
+	var cursor string
+	for c := range publisher.Published() {
+		cursor = c
+	}
+	if cursor != "b" {
+		t.Error("expected last published cursor to be b, was", cursor)
+	}
+
+	for err := range publisher.Ret() {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestNewProducerConfig(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.RequiredAcks = "all"
+	loglet.Compression = "snappy"
+	loglet.Retries = 5
+
+	config, err := newProducerConfig(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Producer.RequiredAcks != kafka.WaitForAll {
+		t.Error("expected acks from all replicas, was", config.Producer.RequiredAcks)
+	}
+	if config.Producer.Compression != kafka.CompressionSnappy {
+		t.Error("expected snappy compression, was", config.Producer.Compression)
+	}
+	if config.Producer.Retry.Max != 5 {
+		t.Error("expected 5 retries, was", config.Producer.Retry.Max)
+	}
+
+	loglet.Compression = "zstd"
+	loglet.KafkaVersion = "2.1.0"
+	loglet.Idempotent = true
+
+	config, err = newProducerConfig(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Producer.Compression != kafka.CompressionZSTD {
+		t.Error("expected zstd compression, was", config.Producer.Compression)
+	}
+	if config.Version != kafka.V2_1_0_0 {
+		t.Error("expected kafka version 2.1.0, was", config.Version)
+	}
+	if !config.Producer.Idempotent || config.Net.MaxOpenRequests != 1 {
+		t.Error("expected idempotence with one request in flight, was", config.Producer.Idempotent, config.Net.MaxOpenRequests)
+	}
+
+	for _, configure := range []func(*options.Loglet){
+		func(l *options.Loglet) { l.RequiredAcks = "some" },
+		func(l *options.Loglet) { l.Compression = "brotli" },
+		func(l *options.Loglet) { l.Compression, l.KafkaVersion = "zstd", "2.0.0" },
+		func(l *options.Loglet) { l.KafkaVersion = "latest" },
+		func(l *options.Loglet) { l.Idempotent = true },
+		func(l *options.Loglet) { l.Idempotent, l.RequiredAcks, l.KafkaVersion = true, "all", "0.10.2" },
+		func(l *options.Loglet) { l.Idempotent, l.RequiredAcks, l.Retries = true, "all", 0 },
+		func(l *options.Loglet) { l.Retries = -1 },
+		func(l *options.Loglet) { l.MaxMessageBytes = 0 },
+		func(l *options.Loglet) { l.MaxMessageBytes = int(kafka.MaxRequestSize) },
+		func(l *options.Loglet) { l.MaxMessageCount = -1 },
+	} {
+		loglet := options.NewLoglet()
+		configure(loglet)
+
+		_, err := newProducerConfig(loglet)
+		if err == nil {
+			t.Errorf("expected error for acks %s, compression %s, version %s, idempotent %v, retries %d, max message bytes %d, max message count %d",
+				loglet.RequiredAcks, loglet.Compression, loglet.KafkaVersion, loglet.Idempotent, loglet.Retries, loglet.MaxMessageBytes, loglet.MaxMessageCount)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package loglet
+
+import (
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/metrics"
+)
+
+var (
+	configReloads        = metrics.NewCounterVec("loglet_config_reloads_total", "Attempts to reload filters, transformers and routing.", "result")
+	configReloadsSuccess = configReloads.WithLabelValues("success")
+	configReloadsFailure = configReloads.WithLabelValues("failure")
+)
+
+// configFilePollInterval is how often to check the config file for changes
+const configFilePollInterval = 5 * time.Second
+
+// reloadPipeline reads the configuration again and swaps in new filters,
+// transformers and routing, without interrupting the rest of the pipeline.
+// Nothing changes if any part of the new configuration is invalid.
+func reloadPipeline(loglet *options.Loglet, filter JournalEntryFilter, transformer JournalEntryTransformer) {
+	err := reload(loglet, filter, transformer)
+	if err != nil {
+		configReloadsFailure.Inc()
+		log.Errorf("reload: keeping current configuration: %s", err)
+		return
+	}
+
+	configReloadsSuccess.Inc()
+	log.Infof("reload: reloaded filters, transformers and routing, other settings take effect on restart")
+}
+
+func reload(loglet *options.Loglet, filter JournalEntryFilter, transformer JournalEntryTransformer) error {
+	reloaded, err := loglet.Reload()
+	if err != nil {
+		return err
+	}
+
+	// check the filters build before changing the transformers, which
+	// only change if they build too
+	_, err = newFilterRules(reloaded)
+	if err != nil {
+		return err
+	}
+
+	err = transformer.Reload(reloaded)
+	if err != nil {
+		return err
+	}
+	return filter.Reload(reloaded)
+}
+
+// watchConfigFile signals when the config file changes. Changes are picked
+// up by polling, which also copes with the file being replaced rather than
+// written to, as configuration management tools tend to.
+func watchConfigFile(path string, done <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	if path == "" {
+		return changes
+	}
+
+	version := func() fileVersion {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fileVersion{}
+		}
+		return fileVersion{info.ModTime(), info.Size()}
+	}
+
+	go func() {
+		ticker := time.NewTicker(configFilePollInterval)
+		defer ticker.Stop()
+
+		last := version()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			current := version()
+			if current == last {
+				continue
+			}
+			last = current
+
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes
+}
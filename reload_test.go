@@ -0,0 +1,97 @@
+package loglet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func TestReloadPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "loglet.yaml")
+	writeConfig := func(contents string) {
+		err := ioutil.WriteFile(config, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("exclude-filter:\n  - UNIT == \"a\"\ntopic: first")
+
+	app := kingpin.New("loglet", "")
+	loglet := options.NewLoglet()
+	loglet.AddFlags(app)
+	options.AddCommands(app)
+	args := []string{"--config", config}
+	_, err = app.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loglet.LoadConfigFile(app, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(chan *JournalEntry)
+	done := make(chan struct{})
+	defer close(done)
+
+	filter, err := NewJournalEntryFilter(loglet, entries, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer, err := NewJournalEntryTransformer(loglet, filter.Entries(), done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sends entries for units a and b, returning the unit and topic of
+	// the one that makes it through
+	send := func() (string, string) {
+		for _, unit := range []string{"a", "b"} {
+			entries <- &JournalEntry{Cursor: unit, Fields: map[string]string{"UNIT": unit, "__REALTIME_TIMESTAMP": "1"}}
+		}
+		m := <-transformer.Messages()
+		return m.Cursor, m.Topic
+	}
+
+	if unit, topic := send(); unit != "b" || topic != "first" {
+		t.Errorf("expected b to first before reload, was %s to %s", unit, topic)
+	}
+
+	writeConfig("exclude-filter:\n  - UNIT == \"b\"\ntopic: second")
+	err = reload(loglet, filter, transformer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unit, topic := send(); unit != "a" || topic != "second" {
+		t.Errorf("expected a to second after reload, was %s to %s", unit, topic)
+	}
+
+	// a valid filter with invalid routing changes neither
+	writeConfig("exclude-filter:\n  - UNIT == \"a\"\ntopic: \"{{.unit\"")
+	err = reload(loglet, filter, transformer)
+	if err == nil {
+		t.Error("expected error reloading invalid topic")
+	}
+
+	writeConfig("exclude-filter:\n  - UNIT ==")
+	err = reload(loglet, filter, transformer)
+	if err == nil {
+		t.Error("expected error reloading invalid filter")
+	}
+
+	if unit, topic := send(); unit != "a" || topic != "second" {
+		t.Errorf("expected a to second after invalid reloads, was %s to %s", unit, topic)
+	}
+}
@@ -0,0 +1,131 @@
+package loglet
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/filters"
+	"github.com/uswitch/loglet/metrics"
+	"github.com/uswitch/loglet/types"
+)
+
+var (
+	topicFallbacks        = metrics.NewCounterVec("loglet_topic_fallbacks_total", "Messages sent to the fallback topic because the routed topic couldn't be used.", "reason")
+	topicFallbacksMissing = topicFallbacks.WithLabelValues("missing")
+	topicFallbacksInvalid = topicFallbacks.WithLabelValues("invalid")
+	topicFallbacksLimit   = topicFallbacks.WithLabelValues("limit")
+)
+
+// kafka only allows these characters in topic names
+var topicNameRe = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// topicRouter picks the kafka topic for each message, from the first
+// matching routing rule or otherwise the topic template. Messages go to the
+// fallback topic when a template refers to a missing field, renders an
+// invalid topic name, or would exceed the limit on distinct topics.
+type topicRouter struct {
+	rules     []topicRule
+	topic     *template.Template
+	fallback  string
+	maxTopics int
+	topics    map[string]bool
+}
+
+type topicRule struct {
+	expr  filters.Expr
+	topic *template.Template
+}
+
+func newTopicRouter(loglet *options.Loglet) (*topicRouter, error) {
+	if !topicNameRe.MatchString(loglet.FallbackTopic) {
+		return nil, fmt.Errorf("invalid fallback topic '%s'", loglet.FallbackTopic)
+	}
+
+	topic, err := parseTopicTemplate(loglet.KafkaTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	router := &topicRouter{
+		topic:     topic,
+		fallback:  loglet.FallbackTopic,
+		maxTopics: loglet.MaxTopics,
+		topics:    map[string]bool{loglet.FallbackTopic: true},
+	}
+
+	for _, route := range loglet.TopicRoutes {
+		// the topic comes last, so split on the last arrow in case the
+		// expression contains one in a string
+		i := strings.LastIndex(route, "=>")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid topic route '%s', expected: <filter> => <topic>", route)
+		}
+
+		expr, err := filters.Compile(strings.TrimSpace(route[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic route '%s': %s", route, err)
+		}
+		topic, err := parseTopicTemplate(strings.TrimSpace(route[i+2:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic route '%s': %s", route, err)
+		}
+
+		router.rules = append(router.rules, topicRule{expr, topic})
+	}
+
+	return router, nil
+}
+
+func parseTopicTemplate(topic string) (*template.Template, error) {
+	t, err := template.New("topic").Option("missingkey=error").Parse(topic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic template '%s': %s", topic, err)
+	}
+	return t, nil
+}
+
+func (r *topicRouter) route(m *types.LogMessage) string {
+	topic := r.topic
+
+	if len(r.rules) > 0 {
+		fields := m.StringFields()
+		for _, rule := range r.rules {
+			if rule.expr.Match(fields) {
+				topic = rule.topic
+				break
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := topic.Execute(&buf, m.Fields)
+	name := buf.String()
+
+	switch {
+	case err != nil || name == "":
+		topicFallbacksMissing.Inc()
+		return r.fallback
+
+	case !topicNameRe.MatchString(name):
+		topicFallbacksInvalid.Inc()
+		return r.fallback
+
+	case !r.topics[name]:
+		if len(r.topics) >= r.maxTopics {
+			topicFallbacksLimit.Inc()
+			return r.fallback
+		}
+		r.topics[name] = true
+		if len(r.topics) == r.maxTopics {
+			log.Warnf("router: reached limit of %d topics, messages for any other topic will go to %s", r.maxTopics, r.fallback)
+		}
+	}
+
+	return name
+}
@@ -0,0 +1,99 @@
+package loglet
+
+import (
+	"testing"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+	"github.com/uswitch/loglet/transformers"
+	"github.com/uswitch/loglet/types"
+)
+
+func TestTopicRouter(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.KafkaTopic = "logs-{{.systemd_unit}}"
+	loglet.FallbackTopic = "logs-other"
+	loglet.TopicRoutes = []string{
+		`systemd_unit =~ "^kube" => kubernetes`,
+		`has(container_name) && priority <= 3 => containers-{{.container_name}}-errors`,
+	}
+	loglet.MaxTopics = 4
+
+	router, err := newTopicRouter(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fields   map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"systemd_unit": "kubelet.service"}, "kubernetes"},
+		{map[string]interface{}{"systemd_unit": "sshd.service"}, "logs-sshd.service"},
+		{map[string]interface{}{"container_name": "app", "priority": "3"}, "containers-app-errors"},
+		// template refers to a missing field
+		{map[string]interface{}{"container_name": "app", "priority": "6"}, "logs-other"},
+		// not a valid topic name
+		{map[string]interface{}{"systemd_unit": "getty@tty1.service"}, "logs-other"},
+		// already routed to
+		{map[string]interface{}{"systemd_unit": "sshd.service"}, "logs-sshd.service"},
+		// over the limit of distinct topics, including the fallback
+		{map[string]interface{}{"systemd_unit": "docker.service"}, "logs-other"},
+	}
+
+	for _, test := range tests {
+		topic := router.route(&types.LogMessage{Fields: test.fields})
+		if topic != test.expected {
+			t.Errorf("expected %v to be routed to %s, was %s", test.fields, test.expected, topic)
+		}
+	}
+}
+
+func TestTopicRouterKubernetesMetadata(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.KafkaTopic = "logs"
+	loglet.TopicRoutes = []string{
+		`kubernetes_namespace == "monitoring" => monitoring`,
+		`has(kubernetes_pod) => pods-{{.kubernetes_namespace}}`,
+	}
+
+	router, err := newTopicRouter(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubernetes := transformers.NewKubernetes(nil)
+
+	tests := []struct {
+		container string
+		expected  string
+	}{
+		{"k8s_agent_agent-1_monitoring_uid-1_0", "monitoring"},
+		{"k8s_app_web-1_default_uid-2_0", "pods-default"},
+		{"elated_hopper", "logs"},
+	}
+
+	for _, test := range tests {
+		m := &types.LogMessage{Fields: map[string]interface{}{"container_name": test.container}}
+		kubernetes.Transform(m)
+		topic := router.route(m)
+		if topic != test.expected {
+			t.Errorf("expected %s to be routed to %s, was %s", test.container, test.expected, topic)
+		}
+	}
+}
+
+func TestTopicRouterInvalidConfig(t *testing.T) {
+	for _, configure := range []func(*options.Loglet){
+		func(l *options.Loglet) { l.KafkaTopic = "logs-{{.systemd_unit" },
+		func(l *options.Loglet) { l.FallbackTopic = "" },
+		func(l *options.Loglet) { l.TopicRoutes = []string{"has(x)"} },
+		func(l *options.Loglet) { l.TopicRoutes = []string{"x == => topic"} },
+	} {
+		loglet := options.NewLoglet()
+		configure(loglet)
+
+		_, err := newTopicRouter(loglet)
+		if err == nil {
+			t.Errorf("expected error for topic %s, fallback %s, routes %v", loglet.KafkaTopic, loglet.FallbackTopic, loglet.TopicRoutes)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package loglet
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+
+	kafka "github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+var saslMechanisms = map[string]kafka.SASLMechanism{
+	"plain":         kafka.SASLTypePlaintext,
+	"scram-sha-256": kafka.SASLTypeSCRAMSHA256,
+	"scram-sha-512": kafka.SASLTypeSCRAMSHA512,
+}
+
+var scramHashes = map[kafka.SASLMechanism]scram.HashGeneratorFcn{
+	kafka.SASLTypeSCRAMSHA256: sha256.New,
+	kafka.SASLTypeSCRAMSHA512: sha512.New,
+}
+
+// configureSASL sets up SASL authentication to kafka brokers with the
+// configured mechanism, leaving it disabled for none
+func configureSASL(config *kafka.Config, loglet *options.Loglet) error {
+	if loglet.SASLMechanism == "none" {
+		return nil
+	}
+
+	mechanism, ok := saslMechanisms[loglet.SASLMechanism]
+	if !ok {
+		return fmt.Errorf("sasl: unknown mechanism '%s', expected none, plain, scram-sha-256 or scram-sha-512", loglet.SASLMechanism)
+	}
+	if loglet.SASLUsername == "" || loglet.SASLPassword == "" {
+		return fmt.Errorf("sasl: --sasl-username and --sasl-password are needed with --sasl-mechanism=%s", loglet.SASLMechanism)
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = mechanism
+	config.Net.SASL.User = loglet.SASLUsername
+	config.Net.SASL.Password = loglet.SASLPassword
+	if hash, ok := scramHashes[mechanism]; ok {
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() kafka.SCRAMClient {
+			return &scramClient{hash: hash}
+		}
+	}
+
+	return nil
+}
+
+// scramClient runs the client side of a SCRAM exchange for sarama, one per
+// connection
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(username, password, authzID string) error {
+	client, err := c.hash.NewClient(username, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
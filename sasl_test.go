@@ -0,0 +1,130 @@
+package loglet
+
+import (
+	"crypto/sha512"
+	"testing"
+
+	kafka "github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+func TestConfigureSASL(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		expected  kafka.SASLMechanism
+		scram     bool
+	}{
+		{"plain", kafka.SASLTypePlaintext, false},
+		{"scram-sha-256", kafka.SASLTypeSCRAMSHA256, true},
+		{"scram-sha-512", kafka.SASLTypeSCRAMSHA512, true},
+	}
+
+	for _, test := range tests {
+		loglet := options.NewLoglet()
+		loglet.SASLMechanism = test.mechanism
+		loglet.SASLUsername = "loglet"
+		loglet.SASLPassword = "secret"
+
+		config, err := newProducerConfig(loglet)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.mechanism, err)
+			continue
+		}
+		if !config.Net.SASL.Enable || config.Net.SASL.Mechanism != test.expected {
+			t.Errorf("%s: expected SASL with %s, got %v with %s", test.mechanism, test.expected, config.Net.SASL.Enable, config.Net.SASL.Mechanism)
+		}
+		if config.Net.SASL.User != "loglet" || config.Net.SASL.Password != "secret" {
+			t.Errorf("%s: expected credentials to be set, got %s/%s", test.mechanism, config.Net.SASL.User, config.Net.SASL.Password)
+		}
+		if (config.Net.SASL.SCRAMClientGeneratorFunc != nil) != test.scram {
+			t.Errorf("%s: expected SCRAM client %v", test.mechanism, test.scram)
+		}
+	}
+
+	config, err := newProducerConfig(options.NewLoglet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Net.SASL.Enable {
+		t.Error("expected SASL to be disabled by default")
+	}
+
+	for _, configure := range []func(*options.Loglet){
+		func(l *options.Loglet) { l.SASLMechanism = "gssapi" },
+		func(l *options.Loglet) { l.SASLMechanism, l.SASLPassword = "plain", "secret" },
+		func(l *options.Loglet) { l.SASLMechanism, l.SASLUsername = "scram-sha-256", "loglet" },
+	} {
+		loglet := options.NewLoglet()
+		configure(loglet)
+
+		_, err := newProducerConfig(loglet)
+		if err == nil {
+			t.Errorf("expected error for mechanism %s, username '%s', password '%s'", loglet.SASLMechanism, loglet.SASLUsername, loglet.SASLPassword)
+		}
+	}
+}
+
+// scramExchange runs a client from the producer config against a server
+// knowing the credentials for password, returning whether both sides
+// authenticated each other
+func scramExchange(t *testing.T, config *kafka.Config, hash scram.HashGeneratorFcn, password string) bool {
+	stored, err := hash.NewClient("loglet", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := hash.NewServer(func(username string) (scram.StoredCredentials, error) {
+		return stored.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConversation := server.NewConversation()
+
+	client := config.Net.SASL.SCRAMClientGeneratorFunc()
+	err = client.Begin(config.Net.SASL.User, config.Net.SASL.Password, config.Net.SASL.SCRAMAuthzID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var challenge string
+	for !client.Done() {
+		response, err := client.Step(challenge)
+		if err != nil {
+			return false
+		}
+		if client.Done() {
+			break
+		}
+		challenge, err = serverConversation.Step(response)
+		if err != nil {
+			return false
+		}
+	}
+	return serverConversation.Valid()
+}
+
+func TestSCRAMClient(t *testing.T) {
+	for mechanism, hash := range map[string]scram.HashGeneratorFcn{
+		"scram-sha-256": scram.SHA256,
+		"scram-sha-512": scram.HashGeneratorFcn(sha512.New),
+	} {
+		loglet := options.NewLoglet()
+		loglet.SASLMechanism = mechanism
+		loglet.SASLUsername = "loglet"
+		loglet.SASLPassword = "secret"
+
+		config, err := newProducerConfig(loglet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !scramExchange(t, config, hash, "secret") {
+			t.Errorf("%s: expected to authenticate", mechanism)
+		}
+		if scramExchange(t, config, hash, "wrong") {
+			t.Errorf("%s: expected not to authenticate with the wrong password", mechanism)
+		}
+	}
+}
@@ -0,0 +1,721 @@
+package loglet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A spool is an on-disk queue of encoded messages made up of a sequence of
+// segment files. Messages are appended to the newest segment and read back in
+// order, and segments are removed once every message in them has been
+// acknowledged as published.
+//
+// Each record in a segment is laid out as:
+//
+//	uint32 payload length | uint32 crc32 of payload | payload
+//
+// where the payload is:
+//
+//	uint32 cursor length | cursor | uint32 topic length | topic |
+//	uint32 key length | key | message
+type diskSpool struct {
+	mu sync.Mutex
+
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	size        int64
+
+	// segments currently on disk, oldest first
+	segments []*spoolSegment
+
+	writer *os.File
+
+	// read position within segments[read]
+	read       int
+	readOffset int64
+	reader     *os.File
+
+	// messages handed out for publishing, in order, that haven't yet been
+	// acknowledged
+	delivered []spooledMessage
+
+	lastCursor string
+	closed     bool
+
+	// space is signalled whenever segments are removed
+	space chan struct{}
+}
+
+type spoolSegment struct {
+	id   uint64
+	size int64
+}
+
+type spooledMessage struct {
+	cursor string
+	// segment the message was read from, or nil if it was never written to
+	// disk
+	segment *spoolSegment
+}
+
+const (
+	spoolSegmentExt    = ".seg"
+	spoolHeaderSize    = 8
+	spoolMaxRecordSize = 256 << 20
+)
+
+// OpenSpool opens the spool in dir, creating it if needed. Any messages up to
+// and including the committed cursor are considered already published and
+// skipped.
+func OpenSpool(dir string, segmentSize, maxSize int64, committed string) (*diskSpool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("spool: unable to create directory: %s", err)
+	}
+
+	s := &diskSpool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		space:       make(chan struct{}, 1),
+	}
+
+	err = s.load(committed)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *diskSpool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentExt))
+}
+
+// load scans existing segments, truncating any partially written record at
+// the end of the newest one, and positions the reader after the committed
+// cursor
+func (s *diskSpool) load(committed string) error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("spool: unable to list segments: %s", err)
+	}
+
+	var ids []uint64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64s(ids))
+
+	var (
+		committedSegment = -1
+		committedOffset  int64
+	)
+
+	for i, id := range ids {
+		segment := &spoolSegment{id: id}
+
+		err := s.scanSegment(segment, func(cursor string, offset int64) {
+			s.lastCursor = cursor
+			if committed != "" && cursor == committed {
+				committedSegment = i
+				committedOffset = offset
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		s.segments = append(s.segments, segment)
+		s.size += segment.size
+	}
+
+	if committedSegment >= 0 {
+		s.read = committedSegment
+		s.readOffset = committedOffset
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = append(s.segments, &spoolSegment{id: 0})
+	}
+
+	last := s.segments[len(s.segments)-1]
+	s.writer, err = os.OpenFile(s.segmentPath(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("spool: unable to open segment for writing: %s", err)
+	}
+	spoolBytes.Set(float64(s.size))
+
+	return s.removeAcknowledged()
+}
+
+// scanSegment reads every record in a segment, calling fn with the cursor of
+// each and the offset following it. A truncated or corrupt record ends the
+// segment and the file is truncated to drop it.
+func (s *diskSpool) scanSegment(segment *spoolSegment, fn func(cursor string, offset int64)) error {
+	path := s.segmentPath(segment.id)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("spool: unable to open segment: %s", err)
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		m, n, err := readSpoolRecord(f, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warnf("spool: truncating segment %s at offset %d: %s", path, offset, err)
+			err = os.Truncate(path, offset)
+			if err != nil {
+				return fmt.Errorf("spool: unable to truncate segment: %s", err)
+			}
+			break
+		}
+		offset += n
+		fn(m.Cursor, offset)
+	}
+
+	segment.size = offset
+	return nil
+}
+
+func readSpoolRecord(f *os.File, offset int64) (*EncodedMessage, int64, error) {
+	header := make([]byte, spoolHeaderSize)
+	n, err := f.ReadAt(header, offset)
+	if err == io.EOF && n == 0 {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading record header: %s", err)
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length < 12 || length > spoolMaxRecordSize {
+		return nil, 0, fmt.Errorf("invalid record length %d", length)
+	}
+
+	payload := make([]byte, length)
+	_, err = f.ReadAt(payload, offset+spoolHeaderSize)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading record: %s", err)
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+
+	cursor, payload, err := readSpoolField(payload)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid cursor: %s", err)
+	}
+	topic, payload, err := readSpoolField(payload)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid topic: %s", err)
+	}
+	key, payload, err := readSpoolField(payload)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid key: %s", err)
+	}
+	if len(key) == 0 {
+		key = nil
+	}
+
+	m := &EncodedMessage{
+		Cursor:  string(cursor),
+		Topic:   string(topic),
+		Key:     key,
+		Message: payload,
+	}
+
+	return m, spoolHeaderSize + int64(length), nil
+}
+
+// readSpoolField reads a length prefixed field from the start of a payload,
+// returning it and the rest of the payload
+func readSpoolField(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < 4 {
+		return nil, nil, fmt.Errorf("truncated length")
+	}
+	length := binary.LittleEndian.Uint32(payload[0:4])
+	if uint64(length) > uint64(len(payload)-4) {
+		return nil, nil, fmt.Errorf("invalid length %d", length)
+	}
+	return payload[4 : 4+length], payload[4+length:], nil
+}
+
+func encodeSpoolRecord(m *EncodedMessage) []byte {
+	length := 4 + len(m.Cursor) + 4 + len(m.Topic) + 4 + len(m.Key) + len(m.Message)
+	record := make([]byte, spoolHeaderSize+length)
+
+	payload := record[spoolHeaderSize:]
+	for _, field := range [][]byte{[]byte(m.Cursor), []byte(m.Topic), m.Key} {
+		binary.LittleEndian.PutUint32(payload[0:4], uint32(len(field)))
+		copy(payload[4:], field)
+		payload = payload[4+len(field):]
+	}
+	copy(payload, m.Message)
+	payload = record[spoolHeaderSize:]
+
+	binary.LittleEndian.PutUint32(record[0:4], uint32(length))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+
+	return record
+}
+
+// LastCursor returns the cursor of the newest message in the spool that is
+// yet to be published, or the empty string if there is none
+func (s *diskSpool) LastCursor() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastCursor
+}
+
+// Close closes any open segment files
+func (s *diskSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if s.writer != nil {
+		err := s.writer.Close()
+		s.writer = nil
+		return err
+	}
+	return nil
+}
+
+// full returns true if the spool has reached its maximum size
+func (s *diskSpool) full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxSize > 0 && s.size >= s.maxSize
+}
+
+// pending returns true if there are messages on disk that haven't been read
+// yet, callers must hold the lock
+func (s *diskSpool) pending() bool {
+	return s.read < len(s.segments)-1 || s.readOffset < s.segments[s.read].size
+}
+
+// empty returns true if there are no unread messages on disk
+func (s *diskSpool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.pending()
+}
+
+// append writes a message to the end of the spool
+func (s *diskSpool) append(m *EncodedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("spool: closed")
+	}
+
+	record := encodeSpoolRecord(m)
+
+	_, err := s.writer.Write(record)
+	if err != nil {
+		return fmt.Errorf("spool: unable to write record: %s", err)
+	}
+
+	segment := s.segments[len(s.segments)-1]
+	segment.size += int64(len(record))
+	s.size += int64(len(record))
+	s.lastCursor = m.Cursor
+	spoolBytes.Set(float64(s.size))
+
+	if segment.size >= s.segmentSize {
+		err = s.roll()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// roll syncs and closes the current segment and starts a new one, callers
+// must hold the lock
+func (s *diskSpool) roll() error {
+	err := s.writer.Sync()
+	if err != nil {
+		return fmt.Errorf("spool: unable to sync segment: %s", err)
+	}
+	err = s.writer.Close()
+	if err != nil {
+		return fmt.Errorf("spool: unable to close segment: %s", err)
+	}
+
+	segment := &spoolSegment{id: s.segments[len(s.segments)-1].id + 1}
+	s.writer, err = os.OpenFile(s.segmentPath(segment.id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("spool: unable to create segment: %s", err)
+	}
+	s.segments = append(s.segments, segment)
+
+	return nil
+}
+
+// next reads the next unread message from disk, returning nil if there is
+// none. The message is expected to be handed out for publishing.
+func (s *diskSpool) next() (*EncodedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, fmt.Errorf("spool: closed")
+	}
+
+	for s.readOffset >= s.segments[s.read].size {
+		if s.read == len(s.segments)-1 {
+			return nil, nil
+		}
+		if s.reader != nil {
+			s.reader.Close()
+			s.reader = nil
+		}
+		s.read++
+		s.readOffset = 0
+	}
+
+	segment := s.segments[s.read]
+
+	if s.reader == nil {
+		f, err := os.Open(s.segmentPath(segment.id))
+		if err != nil {
+			return nil, fmt.Errorf("spool: unable to open segment for reading: %s", err)
+		}
+		s.reader = f
+	}
+
+	m, n, err := readSpoolRecord(s.reader, s.readOffset)
+	if err != nil {
+		return nil, fmt.Errorf("spool: unable to read segment %d at offset %d: %s", segment.id, s.readOffset, err)
+	}
+	s.readOffset += n
+
+	s.delivered = append(s.delivered, spooledMessage{cursor: m.Cursor, segment: segment})
+
+	return m, nil
+}
+
+// deliver records that a message is about to be published without having
+// been written to disk
+func (s *diskSpool) deliver(m *EncodedMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delivered = append(s.delivered, spooledMessage{cursor: m.Cursor})
+}
+
+// undeliver reverts the last call to deliver, for when the message couldn't
+// be published after all
+func (s *diskSpool) undeliver() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delivered = s.delivered[:len(s.delivered)-1]
+}
+
+// ack marks every delivered message up to and including the one with the
+// given cursor as published, removing segments that are no longer needed
+func (s *diskSpool) ack(cursor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := -1
+	for i, m := range s.delivered {
+		if m.cursor == cursor {
+			n = i
+			break
+		}
+	}
+	if n < 0 {
+		return nil
+	}
+	s.delivered = s.delivered[n+1:]
+
+	return s.removeAcknowledged()
+}
+
+// removeAcknowledged removes segments in which every message has been read
+// and acknowledged, callers must hold the lock
+func (s *diskSpool) removeAcknowledged() error {
+	// the oldest segment still needed is either the one a delivered message
+	// came from, or the one currently being read
+	oldest := s.read
+	for _, m := range s.delivered {
+		if m.segment == nil {
+			continue
+		}
+		for i := 0; i < oldest; i++ {
+			if s.segments[i] == m.segment {
+				oldest = i
+				break
+			}
+		}
+		break
+	}
+
+	// once everything has been read and acknowledged the current segment
+	// can go too, so a restart doesn't replay it
+	current := s.segments[s.read]
+	reset := oldest == s.read && current.size > 0 && !s.pending() && !s.closed && !s.hasDelivered(current)
+	if reset {
+		oldest = len(s.segments)
+	}
+
+	if oldest == 0 {
+		return nil
+	}
+
+	if reset {
+		if s.reader != nil {
+			s.reader.Close()
+			s.reader = nil
+		}
+		err := s.writer.Close()
+		if err != nil {
+			return fmt.Errorf("spool: unable to close segment: %s", err)
+		}
+	}
+
+	for _, segment := range s.segments[:oldest] {
+		err := os.Remove(s.segmentPath(segment.id))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("spool: unable to remove segment: %s", err)
+		}
+		s.size -= segment.size
+	}
+
+	if reset {
+		segment := &spoolSegment{id: s.segments[len(s.segments)-1].id + 1}
+		var err error
+		s.writer, err = os.OpenFile(s.segmentPath(segment.id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("spool: unable to create segment: %s", err)
+		}
+		s.segments = []*spoolSegment{segment}
+		s.read = 0
+		s.readOffset = 0
+		s.lastCursor = ""
+	} else {
+		s.segments = s.segments[oldest:]
+		s.read -= oldest
+	}
+	spoolBytes.Set(float64(s.size))
+
+	select {
+	case s.space <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// hasDelivered returns true if any unacknowledged message was read from the
+// given segment, callers must hold the lock
+func (s *diskSpool) hasDelivered(segment *spoolSegment) bool {
+	for _, m := range s.delivered {
+		if m.segment == segment {
+			return true
+		}
+	}
+	return false
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+type Spooler interface {
+	Ret() <-chan error
+	Messages() <-chan *EncodedMessage
+}
+
+type spooler struct {
+	ret      chan error
+	messages chan *EncodedMessage
+	spool    *diskSpool
+}
+
+// NewSpooler passes messages on for publishing, writing them to the spool
+// whenever they can't be published straight away
+func NewSpooler(spool *diskSpool, msgs <-chan *EncodedMessage, done <-chan struct{}) Spooler {
+	s := &spooler{
+		ret:      make(chan error, 1),
+		messages: make(chan *EncodedMessage, stageBuffer),
+		spool:    spool,
+	}
+
+	go s.loop(msgs, done)
+
+	return s
+}
+
+func (s *spooler) Ret() <-chan error {
+	return s.ret
+}
+
+func (s *spooler) Messages() <-chan *EncodedMessage {
+	return s.messages
+}
+
+func (s *spooler) loop(msgs <-chan *EncodedMessage, done <-chan struct{}) {
+	defer close(s.ret)
+	defer close(s.messages)
+
+	// next message read back from disk, waiting to be published
+	var next *EncodedMessage
+
+	for {
+		if next == nil {
+			var err error
+			next, err = s.spool.next()
+			if err != nil {
+				s.ret <- err
+				return
+			}
+		}
+
+		var (
+			in  <-chan *EncodedMessage
+			out chan<- *EncodedMessage
+		)
+		if !s.spool.full() {
+			in = msgs
+		}
+		if next != nil {
+			out = s.messages
+		}
+
+		select {
+		case <-done:
+			return
+
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+
+			// skip the disk when nothing is spooled and the publisher is
+			// ready for more
+			if next == nil && s.spool.empty() {
+				s.spool.deliver(m)
+				select {
+				case s.messages <- m:
+					continue
+				default:
+					s.spool.undeliver()
+				}
+			}
+
+			err := s.spool.append(m)
+			if err != nil {
+				s.ret <- err
+				return
+			}
+
+		case out <- next:
+			next = nil
+
+		case <-s.spool.space:
+		}
+	}
+}
+
+type SpoolAcknowledger interface {
+	Ret() <-chan error
+	Published() <-chan string
+}
+
+type spoolAcknowledger struct {
+	ret       chan error
+	published chan string
+	spool     *diskSpool
+}
+
+// NewSpoolAcknowledger releases spooled messages as their cursors are
+// published, passing the cursors on to be committed
+func NewSpoolAcknowledger(spool *diskSpool, cursors <-chan string, done <-chan struct{}) SpoolAcknowledger {
+	a := &spoolAcknowledger{
+		ret:       make(chan error, 1),
+		published: make(chan string),
+		spool:     spool,
+	}
+
+	go a.loop(cursors, done)
+
+	return a
+}
+
+func (a *spoolAcknowledger) Ret() <-chan error {
+	return a.ret
+}
+
+func (a *spoolAcknowledger) Published() <-chan string {
+	return a.published
+}
+
+func (a *spoolAcknowledger) loop(cursors <-chan string, done <-chan struct{}) {
+	defer close(a.ret)
+	defer close(a.published)
+
+	for {
+		select {
+		case <-done:
+			return
+		case cursor, ok := <-cursors:
+			if !ok {
+				return
+			}
+
+			// segments are removed before the cursor is committed, so the
+			// committed cursor never gets ahead of what's on disk
+			err := a.spool.ack(cursor)
+			if err != nil {
+				a.ret <- err
+				return
+			}
+
+			select {
+			case <-done:
+				return
+			case a.published <- cursor:
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package loglet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func spoolTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "loglet-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func appendMessages(t *testing.T, s *diskSpool, from, to int) {
+	for i := from; i < to; i++ {
+		err := s.append(&EncodedMessage{Cursor: fmt.Sprintf("c%d", i), Topic: fmt.Sprintf("t%d", i), Key: []byte(fmt.Sprintf("k%d", i)), Message: []byte(fmt.Sprintf("m%d", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readMessages(t *testing.T, s *diskSpool) []string {
+	var cursors []string
+	for {
+		m, err := s.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == nil {
+			return cursors
+		}
+		if string(m.Message) != "m"+m.Cursor[1:] || m.Topic != "t"+m.Cursor[1:] || string(m.Key) != "k"+m.Cursor[1:] {
+			t.Error("unexpected message for cursor", m.Cursor, m.Topic, string(m.Key), string(m.Message))
+		}
+		cursors = append(cursors, m.Cursor)
+	}
+}
+
+func segmentCount(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestSpoolReadsInOrderAndRemovesAckedSegments(t *testing.T) {
+	dir := spoolTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, 64, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	appendMessages(t, s, 0, 10)
+	if segmentCount(t, dir) < 3 {
+		t.Fatal("expected several segments, got", segmentCount(t, dir))
+	}
+
+	cursors := readMessages(t, s)
+	if len(cursors) != 10 || cursors[0] != "c0" || cursors[9] != "c9" {
+		t.Fatal("unexpected cursors read from spool:", cursors)
+	}
+
+	err = s.ack("c9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.size != 0 || segmentCount(t, dir) != 1 {
+		t.Error("expected all segments to be removed once acked, size", s.size, "segments", segmentCount(t, dir))
+	}
+	if s.LastCursor() != "" {
+		t.Error("expected no last cursor once everything was acked, got", s.LastCursor())
+	}
+}
+
+func TestSpoolReplaysUnacknowledgedMessagesAfterRestart(t *testing.T) {
+	dir := spoolTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, 64, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendMessages(t, s, 0, 10)
+	s.Close()
+
+	s, err = OpenSpool(dir, 64, 0, "c4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.LastCursor() != "c9" {
+		t.Error("expected last cursor c9, got", s.LastCursor())
+	}
+
+	cursors := readMessages(t, s)
+	if len(cursors) != 5 || cursors[0] != "c5" {
+		t.Error("expected to replay c5 onwards, got", cursors)
+	}
+}
+
+func TestSpoolTruncatesPartialRecord(t *testing.T) {
+	dir := spoolTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, 1024, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendMessages(t, s, 0, 3)
+	s.Close()
+
+	path := s.segmentPath(0)
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, stat.Size()-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSpool(dir, 1024, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	appendMessages(t, s, 3, 4)
+
+	cursors := readMessages(t, s)
+	if len(cursors) != 3 || cursors[0] != "c0" || cursors[1] != "c1" || cursors[2] != "c3" {
+		t.Error("expected partial record to be dropped, got", cursors)
+	}
+}
+
+func TestSpoolerBuffersWhilePublisherIsBlocked(t *testing.T) {
+	dir := spoolTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, 1024, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	msgs := make(chan *EncodedMessage)
+	done := make(chan struct{})
+	spooler := NewSpooler(s, msgs, done)
+
+	for i := 0; i < 5; i++ {
+		msgs <- &EncodedMessage{Cursor: fmt.Sprintf("c%d", i), Message: []byte(fmt.Sprintf("m%d", i))}
+	}
+
+	for i := 0; i < 5; i++ {
+		m := <-spooler.Messages()
+		if m.Cursor != fmt.Sprintf("c%d", i) {
+			t.Error("expected messages in order, got", m.Cursor, "at", i)
+		}
+	}
+
+	close(done)
+	for err := range spooler.Ret() {
+		t.Error("unexpected error:", err)
+	}
+}
@@ -0,0 +1,139 @@
+package loglet
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// timestampFormat formats the @timestamp of messages, and parses it back for
+// outputs that need the time of a message
+type timestampFormat struct {
+	// layouts for times formatted as strings, empty for times formatted as
+	// numbers since the epoch
+	layout      string
+	parseLayout string
+	// units of times formatted as numbers since the epoch
+	unit time.Duration
+}
+
+type timestampPrecision struct {
+	fraction string
+	unit     time.Duration
+}
+
+var timestampPrecisions = map[string]timestampPrecision{
+	"ms": {".000", time.Millisecond},
+	"us": {".000000", time.Microsecond},
+	"ns": {".000000000", time.Nanosecond},
+}
+
+// newTimestampFormat returns the format for rfc3339 or epoch timestamps
+// with the precision given as ms, us or ns, or for a go time layout
+func newTimestampFormat(format, precision string) (*timestampFormat, error) {
+	p, ok := timestampPrecisions[precision]
+	if !ok {
+		return nil, fmt.Errorf("invalid timestamp precision '%s', expected ms, us or ns", precision)
+	}
+
+	switch format {
+	case "rfc3339":
+		// a fixed number of digits so timestamps sort as strings
+		return &timestampFormat{
+			layout:      "2006-01-02T15:04:05" + p.fraction + "Z07:00",
+			parseLayout: time.RFC3339Nano,
+		}, nil
+	case "epoch":
+		return &timestampFormat{unit: p.unit}, nil
+	}
+
+	// a layout without any elements formats every time the same
+	if time.Unix(0, 0).Format(format) == format {
+		return nil, fmt.Errorf("invalid timestamp format '%s', expected rfc3339, epoch or a go time layout", format)
+	}
+	return &timestampFormat{layout: format, parseLayout: format}, nil
+}
+
+func (f *timestampFormat) format(t time.Time) interface{} {
+	if f.layout == "" {
+		return t.UnixNano() / int64(f.unit)
+	}
+	return t.UTC().Format(f.layout)
+}
+
+func (f *timestampFormat) parse(raw json.RawMessage) (time.Time, error) {
+	if f.layout == "" {
+		n, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %s: %s", raw, err)
+		}
+		return time.Unix(0, n*int64(f.unit)).UTC(), nil
+	}
+
+	var s string
+	err := json.Unmarshal(raw, &s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s: %s", raw, err)
+	}
+	t, err := time.Parse(f.parseLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s: %s", raw, err)
+	}
+	return t.UTC(), nil
+}
+
+// messageTime returns the @timestamp of a message, or the current time if
+// it hasn't got one
+func (f *timestampFormat) messageTime(m *EncodedMessage) time.Time {
+	// just the timestamp, so epoch timestamps aren't rounded to floats
+	var message struct {
+		Timestamp json.RawMessage `json:"@timestamp"`
+	}
+	err := json.Unmarshal(m.Message, &message)
+	if err != nil || message.Timestamp == nil {
+		return time.Now().UTC()
+	}
+
+	t, err := f.parse(message.Timestamp)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return t
+}
+
+// journalTimestampFields are the fields of an entry saying when it was
+// logged
+var journalTimestampFields = []string{
+	"_SOURCE_REALTIME_TIMESTAMP",
+	"__REALTIME_TIMESTAMP",
+	"__MONOTONIC_TIMESTAMP",
+}
+
+// readTime returns when an entry was logged: the time the client gave if
+// there is one, otherwise when the journal received it
+func readTime(fields map[string]string) (time.Time, error) {
+	if source, ok := fields["_SOURCE_REALTIME_TIMESTAMP"]; ok {
+		t, err := parseJournalTime(source)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	realtime, ok := fields["__REALTIME_TIMESTAMP"]
+	if !ok {
+		return time.Time{}, fmt.Errorf("timestamp field not found")
+	}
+	return parseJournalTime(realtime)
+}
+
+// parseJournalTime parses a journal timestamp, in microseconds since the
+// epoch
+func parseJournalTime(timeField string) (time.Time, error) {
+	usSinceEpoch, err := strconv.ParseInt(timeField, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("couldn't convert '%s' to integer: %s", timeField, err)
+	}
+
+	return time.Unix(usSinceEpoch/1000000, (usSinceEpoch%1000000)*1000).UTC(), nil
+}
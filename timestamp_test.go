@@ -0,0 +1,161 @@
+package loglet
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// randomValues generates a single random argument for quick.Check from a
+// random non-negative int64
+func randomValues(value func(int64) interface{}) func([]reflect.Value, *rand.Rand) {
+	return func(args []reflect.Value, r *rand.Rand) {
+		args[0] = reflect.ValueOf(value(r.Int63()))
+	}
+}
+
+func TestReadTime(t *testing.T) {
+	tests := []struct {
+		fields   map[string]string
+		expected time.Time
+	}{
+		{
+			map[string]string{"__REALTIME_TIMESTAMP": "1500000000123456"},
+			time.Date(2017, 7, 14, 2, 40, 0, 123456000, time.UTC),
+		},
+		{
+			map[string]string{"__REALTIME_TIMESTAMP": "1500000000123456", "_SOURCE_REALTIME_TIMESTAMP": "1499999999000001"},
+			time.Date(2017, 7, 14, 2, 39, 59, 1000, time.UTC),
+		},
+		{
+			// an invalid source timestamp falls back to the journal's
+			map[string]string{"__REALTIME_TIMESTAMP": "1500000000123456", "_SOURCE_REALTIME_TIMESTAMP": "soon"},
+			time.Date(2017, 7, 14, 2, 40, 0, 123456000, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		ts, err := readTime(test.fields)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", test.fields, err)
+			continue
+		}
+		if !ts.Equal(test.expected) {
+			t.Errorf("%v: expected %s, got %s", test.fields, test.expected, ts)
+		}
+	}
+
+	for _, fields := range []map[string]string{{}, {"__REALTIME_TIMESTAMP": "yesterday"}} {
+		_, err := readTime(fields)
+		if err == nil {
+			t.Errorf("%v: expected error", fields)
+		}
+	}
+}
+
+func TestReadTimeRoundTrip(t *testing.T) {
+	roundTrip := func(us int64) bool {
+		ts, err := readTime(map[string]string{"__REALTIME_TIMESTAMP": strconv.FormatInt(us, 10)})
+		return err == nil && ts.UnixNano()/1000 == us && ts.Nanosecond()%1000 == 0
+	}
+
+	// journal timestamps until the year 2262, when nanoseconds overflow
+	config := &quick.Config{Values: randomValues(func(r int64) interface{} { return r % (math.MaxInt64 / 1000) })}
+	if err := quick.Check(roundTrip, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTimestampFormat(t *testing.T) {
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 123456789, time.UTC)
+
+	tests := []struct {
+		format    string
+		precision string
+		expected  string
+	}{
+		{"rfc3339", "ms", `"2017-07-14T02:40:00.123Z"`},
+		{"rfc3339", "us", `"2017-07-14T02:40:00.123456Z"`},
+		{"rfc3339", "ns", `"2017-07-14T02:40:00.123456789Z"`},
+		{"epoch", "ms", `1500000000123`},
+		{"epoch", "us", `1500000000123456`},
+		{"epoch", "ns", `1500000000123456789`},
+		{"2006-01-02 15:04:05.000000", "ms", `"2017-07-14 02:40:00.123456"`},
+	}
+
+	for _, test := range tests {
+		f, err := newTimestampFormat(test.format, test.precision)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %s", test.format, test.precision, err)
+			continue
+		}
+		formatted, _ := json.Marshal(f.format(ts))
+		if string(formatted) != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.format, test.precision, test.expected, formatted)
+		}
+	}
+
+	for _, test := range []struct{ format, precision string }{
+		{"rfc3339", "s"},
+		{"no time here", "ms"},
+	} {
+		_, err := newTimestampFormat(test.format, test.precision)
+		if err == nil {
+			t.Errorf("%s %s: expected error", test.format, test.precision)
+		}
+	}
+}
+
+func TestTimestampFormatRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		format    string
+		precision time.Duration
+	}{
+		{"rfc3339", time.Millisecond},
+		{"rfc3339", time.Microsecond},
+		{"rfc3339", time.Nanosecond},
+		{"epoch", time.Millisecond},
+		{"epoch", time.Microsecond},
+		{"epoch", time.Nanosecond},
+		{"2006-01-02T15:04:05.000000Z07:00", time.Microsecond},
+	} {
+		precision := map[time.Duration]string{time.Millisecond: "ms", time.Microsecond: "us", time.Nanosecond: "ns"}[test.precision]
+		f, err := newTimestampFormat(test.format, precision)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// through a message as outputs see it, truncated to the precision
+		roundTrip := func(ns int64) bool {
+			ts := time.Unix(0, ns).UTC()
+			m, err := json.Marshal(map[string]interface{}{"@timestamp": f.format(ts), "message": "hello"})
+			if err != nil {
+				return false
+			}
+			return f.messageTime(&EncodedMessage{Message: m}).Equal(ts.Truncate(test.precision))
+		}
+
+		// times between 1970 and 2262, which epoch nanoseconds can hold
+		config := &quick.Config{Values: randomValues(func(r int64) interface{} { return r })}
+		if err := quick.Check(roundTrip, config); err != nil {
+			t.Errorf("%s %s: %s", test.format, precision, err)
+		}
+	}
+}
+
+func TestMessageTimeWithoutTimestamp(t *testing.T) {
+	f, _ := newTimestampFormat("rfc3339", "ms")
+
+	before := time.Now()
+	for _, m := range []string{`{"message":"hello"}`, `{"@timestamp":"yesterday"}`, `not json`} {
+		ts := f.messageTime(&EncodedMessage{Message: []byte(m)})
+		if ts.Before(before) {
+			t.Errorf("%s: expected the current time, got %s", m, ts)
+		}
+	}
+}
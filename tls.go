@@ -0,0 +1,206 @@
+package loglet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+// tlsFiles holds the CA bundle and client certificate used to connect to
+// kafka, reloading them when the files change on disk so that rotated
+// certificates are picked up by new connections without a restart.
+type tlsFiles struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	modTime map[string]fileVersion
+	roots   *x509.CertPool
+	cert    *tls.Certificate
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// newTLSConfig returns the TLS configuration for connecting to kafka, or nil
+// if TLS isn't enabled
+func newTLSConfig(loglet *options.Loglet) (*tls.Config, error) {
+	if !loglet.TLSEnabled() {
+		return nil, nil
+	}
+
+	if (loglet.TLSCertFile == "") != (loglet.TLSKeyFile == "") {
+		return nil, fmt.Errorf("tls: --tls-cert-file and --tls-key-file must be used together")
+	}
+
+	files := &tlsFiles{
+		caFile:   loglet.TLSCAFile,
+		certFile: loglet.TLSCertFile,
+		keyFile:  loglet.TLSKeyFile,
+		modTime:  make(map[string]fileVersion),
+	}
+
+	// fail straight away on startup, later failures to reload keep the
+	// files loaded last
+	_, err := files.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName: loglet.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if files.certFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return files.clientCertificate(), nil
+		}
+	}
+
+	switch {
+	case loglet.TLSInsecureSkipVerify:
+		log.Warnf("tls: not verifying kafka broker certificates")
+		config.InsecureSkipVerify = true
+
+	case files.caFile != "":
+		// the CA bundle can change while running, so the standard
+		// verification is replaced with one against the current bundle
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return files.verifyConnection(state, loglet.TLSServerName)
+		}
+	}
+
+	return config, nil
+}
+
+// changed returns whether a file differs from when it was last loaded
+func (f *tlsFiles) changed(path string) (bool, fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fileVersion{}, err
+	}
+	version := fileVersion{info.ModTime(), info.Size()}
+	return f.modTime[path] != version, version, nil
+}
+
+// reload loads any of the files that have changed, returning whether any
+// were loaded
+func (f *tlsFiles) reload() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reloaded := false
+
+	if f.caFile != "" {
+		changed, version, err := f.changed(f.caFile)
+		if err != nil {
+			return false, fmt.Errorf("tls: unable to read CA file: %s", err)
+		}
+		if changed {
+			pem, err := ioutil.ReadFile(f.caFile)
+			if err != nil {
+				return false, fmt.Errorf("tls: unable to read CA file: %s", err)
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return false, fmt.Errorf("tls: no certificates found in CA file %s", f.caFile)
+			}
+			f.roots = roots
+			f.modTime[f.caFile] = version
+			reloaded = true
+		}
+	}
+
+	if f.certFile != "" {
+		certChanged, certVersion, err := f.changed(f.certFile)
+		if err != nil {
+			return false, fmt.Errorf("tls: unable to read certificate file: %s", err)
+		}
+		keyChanged, keyVersion, err := f.changed(f.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("tls: unable to read key file: %s", err)
+		}
+		if certChanged || keyChanged {
+			cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+			if err != nil {
+				return false, fmt.Errorf("tls: unable to load client certificate: %s", err)
+			}
+			f.cert = &cert
+			f.modTime[f.certFile] = certVersion
+			f.modTime[f.keyFile] = keyVersion
+			reloaded = true
+		}
+	}
+
+	return reloaded, nil
+}
+
+// refresh reloads changed files, keeping the ones loaded last if they can't
+// be loaded, for example while only one of a certificate and key has been
+// replaced
+func (f *tlsFiles) refresh() {
+	reloaded, err := f.reload()
+	if err != nil {
+		log.Warnf("%s, using previously loaded files", err)
+		return
+	}
+	if reloaded {
+		log.Infof("tls: reloaded certificates")
+	}
+}
+
+func (f *tlsFiles) clientCertificate() *tls.Certificate {
+	f.refresh()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cert
+}
+
+// verifyConnection verifies the broker's certificate against the current CA
+// bundle, and against the name it was dialled by, or serverName for brokers
+// dialled by IP address, which connections aren't given a name for
+func (f *tlsFiles) verifyConnection(state tls.ConnectionState, serverName string) error {
+	f.refresh()
+
+	name := state.ServerName
+	if name == "" {
+		name = serverName
+	}
+	if name == "" {
+		return fmt.Errorf("tls: unable to verify the name of a broker reached by IP address, set --tls-server-name")
+	}
+
+	f.mu.Lock()
+	roots := f.roots
+	f.mu.Unlock()
+
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("tls: broker presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
@@ -0,0 +1,281 @@
+package loglet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, serial int64) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		der:  der,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// writeTestFile writes a file with a distinct modification time, so changes
+// are noticed even within the resolution of the filesystem's timestamps
+func writeTestFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	err := ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsListener accepts connections on a local TLS listener standing in for a
+// kafka broker, sending the common name of each client certificate presented
+func tlsListener(t *testing.T, serverCert *testCert, clientCA *testCert) (string, <-chan string, func()) {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.der}, PrivateKey: serverCert.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().String(), clients, func() { l.Close() }
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, 1)
+	broker := newTestCert(t, "broker", ca, 2)
+	client1 := newTestCert(t, "client-1", ca, 3)
+	client2 := newTestCert(t, "client-2", ca, 4)
+
+	now := time.Now()
+	loglet := options.NewLoglet()
+	loglet.TLSCAFile = filepath.Join(dir, "ca.pem")
+	loglet.TLSCertFile = filepath.Join(dir, "cert.pem")
+	loglet.TLSKeyFile = filepath.Join(dir, "key.pem")
+	loglet.TLSServerName = "broker"
+	writeTestFile(t, loglet.TLSCAFile, ca.pem, now)
+	writeTestFile(t, loglet.TLSCertFile, client1.pem, now)
+	writeTestFile(t, loglet.TLSKeyFile, client1.keyPEM(t), now)
+
+	config, err := newTLSConfig(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, clients, closeListener := tlsListener(t, broker, ca)
+	defer closeListener()
+
+	connect := func() error {
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	err = connect()
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	if client := <-clients; client != "client-1" {
+		t.Error("expected client-1 certificate, was", client)
+	}
+
+	// rotated client certificates are used for new connections
+	writeTestFile(t, loglet.TLSCertFile, client2.pem, now.Add(time.Second))
+	writeTestFile(t, loglet.TLSKeyFile, client2.keyPEM(t), now.Add(time.Second))
+
+	err = connect()
+	if err != nil {
+		t.Fatal("unable to connect after rotating client certificate:", err)
+	}
+	if client := <-clients; client != "client-2" {
+		t.Error("expected client-2 certificate, was", client)
+	}
+
+	// a broker certificate from a CA not in the bundle is rejected until
+	// the bundle is updated
+	ca2 := newTestCert(t, "ca-2", nil, 5)
+	broker2 := newTestCert(t, "broker", ca2, 6)
+	addr2, _, closeListener2 := tlsListener(t, broker2, ca)
+	defer closeListener2()
+	addr = addr2
+
+	err = connect()
+	if err == nil {
+		t.Error("expected error connecting to broker with unknown CA")
+	}
+
+	writeTestFile(t, loglet.TLSCAFile, append(ca.pem, ca2.pem...), now.Add(2*time.Second))
+
+	err = connect()
+	if err != nil {
+		t.Error("unable to connect after updating CA bundle:", err)
+	}
+
+	// and the server name is verified
+	config.ServerName = "not-the-broker"
+	err = connect()
+	if err == nil {
+		t.Error("expected error connecting with wrong server name")
+	}
+}
+
+func TestTLSConfigIPAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, 1)
+	broker := newTestCert(t, "broker", ca, 2)
+	client := newTestCert(t, "client", ca, 3)
+
+	now := time.Now()
+	loglet := options.NewLoglet()
+	loglet.TLSCAFile = filepath.Join(dir, "ca.pem")
+	loglet.TLSCertFile = filepath.Join(dir, "cert.pem")
+	loglet.TLSKeyFile = filepath.Join(dir, "key.pem")
+	writeTestFile(t, loglet.TLSCAFile, ca.pem, now)
+	writeTestFile(t, loglet.TLSCertFile, client.pem, now)
+	writeTestFile(t, loglet.TLSKeyFile, client.keyPEM(t), now)
+
+	addr, _, closeListener := tlsListener(t, broker, ca)
+	defer closeListener()
+
+	connect := func() error {
+		config, err := newTLSConfig(loglet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// the broker's certificate isn't for the address it's reached by
+	err = connect()
+	if err == nil {
+		t.Error("expected error connecting by IP address to broker with certificate for another name")
+	}
+
+	loglet.TLSServerName = "127.0.0.1"
+	err = connect()
+	if err == nil {
+		t.Error("expected error connecting by IP address with server name not in broker certificate")
+	}
+
+	loglet.TLSServerName = "broker"
+	err = connect()
+	if err != nil {
+		t.Error("unable to connect by IP address with server name:", err)
+	}
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	loglet := options.NewLoglet()
+	config, err := newTLSConfig(loglet)
+	if config != nil || err != nil {
+		t.Error("expected no TLS config when TLS isn't enabled", config, err)
+	}
+
+	loglet.TLSCertFile = "cert.pem"
+	_, err = newTLSConfig(loglet)
+	if err == nil {
+		t.Error("expected error with certificate but no key")
+	}
+
+	loglet.TLSKeyFile = "key.pem"
+	_, err = newTLSConfig(loglet)
+	if err == nil {
+		t.Error("expected error with missing certificate files")
+	}
+}
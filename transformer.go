@@ -3,8 +3,10 @@ package loglet
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
+	"io"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/uswitch/loglet/cmd/loglet/options"
@@ -14,38 +16,201 @@ import (
 
 type EncodedMessage struct {
 	Cursor  string
+	Topic   string
+	Key     []byte
 	Message []byte
 }
 
 type JournalEntryTransformer interface {
 	Ret() <-chan error
 	Messages() <-chan *EncodedMessage
+	// Reload replaces the transformers, routing and keys, keeping the
+	// current ones if the new ones are invalid
+	Reload(loglet *options.Loglet) error
 }
 
 type journalEntryTransformer struct {
-	ret          chan error
-	messages     chan *EncodedMessage
+	ret      chan error
+	messages chan *EncodedMessage
+
+	timestamps     *timestampFormat
+	keepTimestamps bool
+
+	mu    sync.Mutex
+	chain *transformChain
+	// chains replaced by reloads, closed by convert once it has switched
+	// to the current one
+	retired  []*transformChain
+	reloaded chan struct{}
+}
+
+// transformChain is everything that shapes a message and decides where it
+// goes
+type transformChain struct {
 	transformers []types.Transformer
+	router       *topicRouter
+	keyer        *messageKeyer
 }
 
-func NewJournalEntryTransformer(loglet *options.Loglet, entries <-chan *JournalEntry, done <-chan struct{}) JournalEntryTransformer {
+func NewJournalEntryTransformer(loglet *options.Loglet, entries <-chan *JournalEntry, done <-chan struct{}) (JournalEntryTransformer, error) {
 	ret := make(chan error)
-	messages := make(chan *EncodedMessage)
+	messages := make(chan *EncodedMessage, stageBuffer)
+
+	timestamps, err := newTimestampFormat(loglet.TimestampFormat, loglet.TimestampPrecision)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := newTransformChain(loglet)
+	if err != nil {
+		return nil, err
+	}
+
+	converter := &journalEntryTransformer{
+		ret:            ret,
+		messages:       messages,
+		timestamps:     timestamps,
+		keepTimestamps: loglet.KeepJournalTimestamps,
+		chain:          chain,
+		reloaded:       make(chan struct{}, 1),
+	}
+	go converter.convert(entries, done)
+
+	return converter, nil
+}
+
+func newTransformChain(loglet *options.Loglet) (*transformChain, error) {
+	router, err := newTopicRouter(loglet)
+	if err != nil {
+		return nil, err
+	}
+
+	keyer, err := newMessageKeyer(loglet)
+	if err != nil {
+		return nil, err
+	}
 
 	var ts []types.Transformer
 
+	if loglet.JSONMessage {
+		ts = append(ts, transformers.NewJSONMessage(loglet.JSONMessageTarget, loglet.JSONMessageConflict == "payload", loglet.JSONMessageMaxDepth, loglet.JSONMessageMaxSize))
+	}
+
+	if loglet.LogfmtMessage {
+		ts = append(ts, transformers.NewLogfmt(loglet.LogfmtPromote))
+	}
+
+	if len(loglet.GrokRules) > 0 {
+		grok, err := transformers.NewGrok(loglet.GrokRules, loglet.GrokPatternFiles)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, grok)
+	}
+
+	// added last as they start watching or refreshing in the background
+	if loglet.KubernetesMetadata {
+		var pods *transformers.PodCache
+		if loglet.KubernetesMetadataSource != "none" {
+			nodeName := loglet.KubernetesNodeName
+			if nodeName == "" {
+				nodeName, _ = os.Hostname()
+			}
+			pods, err = transformers.NewPodCache(transformers.PodCacheOptions{
+				Source:    loglet.KubernetesMetadataSource,
+				URL:       loglet.KubernetesURL,
+				TokenFile: loglet.KubernetesTokenFile,
+				CAFile:    loglet.KubernetesCAFile,
+				NodeName:  nodeName,
+				TTL:       loglet.KubernetesCacheTTL,
+				Timeout:   kubernetesTimeout,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		ts = append(ts, transformers.NewKubernetes(pods))
+	}
+
+	if loglet.ECSMetadata {
+		ecs, err := transformers.NewECS(loglet.ECSAgentURL, loglet.ECSRefreshInterval, ecsTimeout)
+		if err != nil {
+			// the pod cache may already be watching
+			(&transformChain{transformers: ts}).close()
+			return nil, err
+		}
+		ts = append(ts, ecs)
+	}
+
 	if loglet.DefaultFields != nil {
 		ts = append(ts, transformers.NewDefaultFields(loglet.DefaultFields))
 	}
 
-	converter := &journalEntryTransformer{
-		ret:          ret,
-		messages:     messages,
+	return &transformChain{
 		transformers: ts,
+		router:       router,
+		keyer:        keyer,
+	}, nil
+}
+
+// kubernetesTimeout limits requests for pods that aren't cached, which are
+// made in the background
+const kubernetesTimeout = 5 * time.Second
+
+// ecsTimeout limits requests to the ECS agent, which are made in the
+// background
+const ecsTimeout = 5 * time.Second
+
+// close releases anything the transformers hold on to, like watches for
+// metadata
+func (c *transformChain) close() {
+	for _, t := range c.transformers {
+		if closer, ok := t.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+func (c *journalEntryTransformer) Reload(loglet *options.Loglet) error {
+	chain, err := newTransformChain(loglet)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	previous := c.chain
+	// topics already produced to still count towards --max-topics. Only
+	// convert uses them, and it uses one chain at a time.
+	chain.router.topics = previous.router.topics
+	c.chain = chain
+	c.retired = append(c.retired, previous)
+	c.mu.Unlock()
+
+	select {
+	case c.reloaded <- struct{}{}:
+	default:
 	}
-	go converter.convert(entries, done)
 
-	return converter
+	return nil
+}
+
+// closeRetired closes chains replaced by reloads, which must only be called
+// by convert between messages so none of them are in use
+func (c *journalEntryTransformer) closeRetired() {
+	c.mu.Lock()
+	retired := c.retired
+	c.retired = nil
+	c.mu.Unlock()
+
+	for _, chain := range retired {
+		chain.close()
+	}
+}
+
+func (c *journalEntryTransformer) currentChain() *transformChain {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chain
 }
 
 func (c *journalEntryTransformer) Ret() <-chan error {
@@ -59,6 +224,10 @@ func (c *journalEntryTransformer) Messages() <-chan *EncodedMessage {
 func (c *journalEntryTransformer) convert(entries <-chan *JournalEntry, done <-chan struct{}) {
 	defer close(c.ret)
 	defer close(c.messages)
+	defer func() {
+		c.closeRetired()
+		c.currentChain().close()
+	}()
 
 	for {
 		var entry *JournalEntry
@@ -66,6 +235,9 @@ func (c *journalEntryTransformer) convert(entries <-chan *JournalEntry, done <-c
 		select {
 		case <-done:
 			return
+		case <-c.reloaded:
+			c.closeRetired()
+			continue
 		case entry = <-entries:
 			if entry == nil {
 				return
@@ -74,6 +246,7 @@ func (c *journalEntryTransformer) convert(entries <-chan *JournalEntry, done <-c
 
 		m, err := c.convertToLogstashMessage(entry)
 		if err != nil {
+			transformErrors.Inc()
 			c.ret <- fmt.Errorf("transformer: unable to convert journal entry to logstash message: %s", err)
 			return
 		}
@@ -89,20 +262,22 @@ func (c *journalEntryTransformer) convert(entries <-chan *JournalEntry, done <-c
 }
 
 func (c *journalEntryTransformer) convertToLogstashMessage(entry *JournalEntry) (*EncodedMessage, error) {
-	fields := readFields(entry)
+	fields := readFields(entry, c.keepTimestamps)
 
-	timestamp, err := readTime(fields)
+	timestamp, err := readTime(entry.Fields)
 	if err != nil {
 		return nil, err
 	}
 
-	fields["@timestamp"] = timestamp.Format("2006-01-02T15:04:05.000Z")
+	fields["@timestamp"] = c.timestamps.format(timestamp)
 
 	logMessage := &types.LogMessage{
 		Fields: fields,
 	}
 
-	for _, t := range c.transformers {
+	chain := c.currentChain()
+
+	for _, t := range chain.transformers {
 		t.Transform(logMessage)
 	}
 
@@ -113,24 +288,27 @@ func (c *journalEntryTransformer) convertToLogstashMessage(entry *JournalEntry)
 
 	return &EncodedMessage{
 		Cursor:  entry.Cursor,
+		Topic:   chain.router.route(logMessage),
+		Key:     chain.keyer.key(logMessage),
 		Message: m,
 	}, nil
 }
 
-func readFields(entry *JournalEntry) map[string]interface{} {
+func readFields(entry *JournalEntry, keepTimestamps bool) map[string]interface{} {
 	fields := make(map[string]interface{})
 
 	for key, val := range entry.Fields {
 		formattedKey := strings.ToLower(strings.TrimLeft(key, "_"))
 		switch formattedKey {
+		case "monotonic_timestamp", "source_monotonic_timestamp", "source_realtime_timestamp":
+			if keepTimestamps {
+				fields[formattedKey] = val
+			}
 		case "cap_effective":
 		case "cmdline":
 		//case "cursor":
 		case "exe":
 		case "machine_id":
-		case "monotonic_timestamp":
-		case "source_monotonic_timestamp":
-		case "source_realtime_timestamp":
 		case "syslog_facility":
 		case "syslog_identifier":
 		case "transport":
@@ -142,19 +320,3 @@ func readFields(entry *JournalEntry) map[string]interface{} {
 
 	return fields
 }
-
-func readTime(fields map[string]interface{}) (*time.Time, error) {
-	timeField, ok := fields["realtime_timestamp"].(string)
-	if !ok {
-		return nil, fmt.Errorf("timestamp field not found")
-	}
-
-	usSinceEpoch, err := strconv.Atoi(timeField)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't convert '%s' to integer: %s", timeField, err)
-	}
-
-	ts := time.Unix(int64(usSinceEpoch/1000000), int64(usSinceEpoch%1000000000)).UTC()
-
-	return &ts, nil
-}
@@ -1,9 +1,12 @@
 package loglet
 
 import (
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/cmd/loglet/options"
 	"github.com/uswitch/loglet/transformers"
 	"github.com/uswitch/loglet/types"
-	"testing"
 )
 
 func sampleMessage(k, v string) *types.LogMessage {
@@ -32,3 +35,124 @@ func TestDefaultFields(t *testing.T) {
 		t.Error("shouldnt have overwritten foo value from baz original, was", fooMessage.Fields["foo"])
 	}
 }
+
+func TestReadFieldsKeepsJournalTimestamps(t *testing.T) {
+	entry := &JournalEntry{Fields: map[string]string{
+		"__REALTIME_TIMESTAMP":       "1500000000123456",
+		"_SOURCE_REALTIME_TIMESTAMP": "1499999999000001",
+		"__MONOTONIC_TIMESTAMP":      "123",
+	}}
+
+	fields := readFields(entry, false)
+	if _, ok := fields["source_realtime_timestamp"]; ok {
+		t.Error("expected source_realtime_timestamp to be dropped, was", fields["source_realtime_timestamp"])
+	}
+	if fields["realtime_timestamp"] != "1500000000123456" {
+		t.Error("expected realtime_timestamp to be kept, was", fields["realtime_timestamp"])
+	}
+
+	fields = readFields(entry, true)
+	if fields["source_realtime_timestamp"] != "1499999999000001" || fields["monotonic_timestamp"] != "123" {
+		t.Error("expected journal timestamps to be kept, was", fields)
+	}
+}
+
+// blockingTransformer holds up messages until released, and records being
+// closed
+type blockingTransformer struct {
+	transforming chan struct{}
+	release      chan struct{}
+	closed       chan struct{}
+}
+
+func (b *blockingTransformer) Transform(m *types.LogMessage) {
+	b.transforming <- struct{}{}
+	<-b.release
+}
+
+func (b *blockingTransformer) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestTransformerReloadClosesChainOnceUnused(t *testing.T) {
+	loglet := options.NewLoglet()
+	timestamps, _ := newTimestampFormat(loglet.TimestampFormat, loglet.TimestampPrecision)
+	chain, err := newTransformChain(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocking := &blockingTransformer{make(chan struct{}), make(chan struct{}), make(chan struct{})}
+	chain.transformers = []types.Transformer{blocking}
+
+	transformer := &journalEntryTransformer{
+		ret:        make(chan error),
+		messages:   make(chan *EncodedMessage),
+		timestamps: timestamps,
+		chain:      chain,
+		reloaded:   make(chan struct{}, 1),
+	}
+	entries := make(chan *JournalEntry)
+	done := make(chan struct{})
+	defer close(done)
+	go transformer.convert(entries, done)
+
+	entries <- &JournalEntry{Cursor: "a", Fields: map[string]string{"__REALTIME_TIMESTAMP": "1"}}
+	<-blocking.transforming
+
+	err = transformer.Reload(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-blocking.closed:
+		t.Fatal("expected chain not to be closed while in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(blocking.release)
+	<-transformer.Messages()
+
+	select {
+	case <-blocking.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected replaced chain to be closed")
+	}
+}
+
+func TestTransformerReloadKeepsTopics(t *testing.T) {
+	loglet := options.NewLoglet()
+	loglet.KafkaTopic = "{{.unit}}"
+	loglet.MaxTopics = 2
+
+	entries := make(chan *JournalEntry)
+	done := make(chan struct{})
+	defer close(done)
+	transformer, err := NewJournalEntryTransformer(loglet, entries, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(unit string) string {
+		entries <- &JournalEntry{Cursor: unit, Fields: map[string]string{"UNIT": unit, "__REALTIME_TIMESTAMP": "1"}}
+		return (<-transformer.Messages()).Topic
+	}
+
+	// the fallback topic counts as one of them
+	if topic := send("a"); topic != "a" {
+		t.Errorf("expected a, was %s", topic)
+	}
+
+	err = transformer.Reload(loglet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if topic := send("b"); topic != loglet.FallbackTopic {
+		t.Errorf("expected b to go to the fallback topic after reload, was %s", topic)
+	}
+	if topic := send("a"); topic != "a" {
+		t.Errorf("expected a after reload, was %s", topic)
+	}
+}
@@ -0,0 +1,212 @@
+package transformers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/types"
+)
+
+// unknown containers ask for tasks to be refreshed early, but no more often
+// than this. A variable so tests don't have to wait as long.
+var ecsMinRefreshInterval = 5 * time.Second
+
+// docker's journald log driver sets CONTAINER_ID to the short id
+const shortContainerIDLength = 12
+
+// ECS adds the cluster, task and container of entries logged by containers
+// the ECS agent started, looked up by CONTAINER_ID from the agent's
+// introspection API. Tasks are refreshed in the background, so entries from
+// containers that aren't known yet go through without metadata rather than
+// waiting for the agent.
+type ECS struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	mu         sync.RWMutex
+	cluster    string
+	containers map[string]map[string]interface{}
+
+	refresh chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewECS(agentURL string, interval, timeout time.Duration) (*ECS, error) {
+	u, err := url.Parse(agentURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("ecs: invalid agent url '%s'", agentURL)
+	}
+	if interval < ecsMinRefreshInterval {
+		return nil, fmt.Errorf("ecs: refresh interval %s is less than the minimum of %s", interval, ecsMinRefreshInterval)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &ECS{
+		url:        strings.TrimSuffix(agentURL, "/"),
+		interval:   interval,
+		client:     &http.Client{Timeout: timeout},
+		containers: make(map[string]map[string]interface{}),
+		refresh:    make(chan struct{}, 1),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go e.refreshTasks(ctx)
+
+	return e, nil
+}
+
+func (e *ECS) Transform(m *types.LogMessage) {
+	id, ok := m.Fields["container_id"].(string)
+	if !ok || len(id) < shortContainerIDLength {
+		return
+	}
+	id = id[:shortContainerIDLength]
+
+	e.mu.RLock()
+	metadata, ok := e.containers[id]
+	e.mu.RUnlock()
+
+	if !ok {
+		// ask for the container without waiting for it
+		select {
+		case e.refresh <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	ecs := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		ecs[k] = v
+	}
+	m.Fields["ecs"] = ecs
+}
+
+// Close stops refreshing tasks
+func (e *ECS) Close() error {
+	e.cancel()
+	<-e.done
+	return nil
+}
+
+func (e *ECS) refreshTasks(ctx context.Context) {
+	defer close(e.done)
+
+	for {
+		err := e.update(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// keep the tasks already known until the agent is back
+			log.Warnf("ecs: unable to refresh tasks: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ecsMinRefreshInterval):
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.refresh:
+		case <-time.After(e.interval - ecsMinRefreshInterval):
+		}
+	}
+}
+
+func (e *ECS) update(ctx context.Context) error {
+	e.mu.RLock()
+	cluster := e.cluster
+	e.mu.RUnlock()
+
+	// the cluster doesn't change while the agent is running
+	if cluster == "" {
+		var metadata ecsAgentMetadata
+		err := e.get(ctx, "/v1/metadata", &metadata)
+		if err != nil {
+			return err
+		}
+		cluster = metadata.Cluster
+	}
+
+	var tasks ecsTasks
+	err := e.get(ctx, "/v1/tasks", &tasks)
+	if err != nil {
+		return err
+	}
+
+	containers := make(map[string]map[string]interface{})
+	for _, task := range tasks.Tasks {
+		for _, c := range task.Containers {
+			if len(c.DockerID) < shortContainerIDLength {
+				continue
+			}
+			containers[c.DockerID[:shortContainerIDLength]] = map[string]interface{}{
+				"cluster":        cluster,
+				"task_arn":       task.Arn,
+				"task_family":    task.Family,
+				"task_revision":  task.Version,
+				"container_name": c.Name,
+			}
+		}
+	}
+
+	e.mu.Lock()
+	e.cluster = cluster
+	e.containers = containers
+	e.mu.Unlock()
+
+	return nil
+}
+
+func (e *ECS) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", e.url+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid response: %s", path, err)
+	}
+	return nil
+}
+
+type ecsAgentMetadata struct {
+	Cluster string `json:"Cluster"`
+}
+
+type ecsTasks struct {
+	Tasks []struct {
+		Arn        string `json:"Arn"`
+		Family     string `json:"Family"`
+		Version    string `json:"Version"`
+		Containers []struct {
+			DockerID string `json:"DockerId"`
+			Name     string `json:"Name"`
+		} `json:"Containers"`
+	} `json:"Tasks"`
+}
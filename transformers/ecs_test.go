@@ -0,0 +1,168 @@
+package transformers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/types"
+)
+
+// fakeECSAgent stands in for the agent's introspection API
+type fakeECSAgent struct {
+	mu     sync.Mutex
+	tasks  []interface{}
+	failed bool
+	slow   chan struct{}
+}
+
+func (a *fakeECSAgent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.mu.Lock()
+	tasks, failed, slow := a.tasks, a.failed, a.slow
+	a.mu.Unlock()
+
+	if slow != nil {
+		<-slow
+	}
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch req.URL.Path {
+	case "/v1/metadata":
+		json.NewEncoder(w).Encode(map[string]string{"Cluster": "production"})
+	case "/v1/tasks":
+		json.NewEncoder(w).Encode(map[string]interface{}{"Tasks": tasks})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (a *fakeECSAgent) addTask(arn, family, version, dockerID, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tasks = append(a.tasks, map[string]interface{}{
+		"Arn":           arn,
+		"Family":        family,
+		"Version":       version,
+		"DesiredStatus": "RUNNING",
+		"KnownStatus":   "RUNNING",
+		"Containers": []interface{}{
+			map[string]string{"DockerId": dockerID, "DockerName": "ecs-" + family + "-" + version + "-" + name, "Name": name},
+		},
+	})
+}
+
+// waitForECS transforms a message from a container until it has metadata
+func waitForECS(t *testing.T, e *ECS, containerID string) map[string]interface{} {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m := &types.LogMessage{Fields: map[string]interface{}{"container_id": containerID}}
+		e.Transform(m)
+		if metadata, ok := m.Fields["ecs"].(map[string]interface{}); ok {
+			return metadata
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected ecs metadata", containerID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestECS(t *testing.T) {
+	defer func(interval time.Duration) { ecsMinRefreshInterval = interval }(ecsMinRefreshInterval)
+	ecsMinRefreshInterval = 10 * time.Millisecond
+
+	agent := &fakeECSAgent{}
+	agent.addTask("arn:aws:ecs:eu-west-1:123456789012:task/0123", "web", "5", "0123456789ab0123456789ab0123456789ab0123456789ab0123456789ab0123", "nginx")
+	server := httptest.NewServer(agent)
+	defer server.Close()
+
+	e, err := NewECS(server.URL, time.Hour, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	expected := map[string]interface{}{
+		"cluster":        "production",
+		"task_arn":       "arn:aws:ecs:eu-west-1:123456789012:task/0123",
+		"task_family":    "web",
+		"task_revision":  "5",
+		"container_name": "nginx",
+	}
+	metadata := waitForECS(t, e, "0123456789ab")
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("expected %v, got %v", expected, metadata)
+	}
+
+	// containers that aren't known yet have the tasks refreshed early
+	agent.addTask("arn:aws:ecs:eu-west-1:123456789012:task/4567", "worker", "2", "456789abcdef456789abcdef456789abcdef456789abcdef456789abcdef4567", "app")
+	metadata = waitForECS(t, e, "456789abcdef")
+	if metadata["task_family"] != "worker" || metadata["container_name"] != "app" {
+		t.Errorf("expected worker app, got %v", metadata)
+	}
+
+	// tasks already known are kept while the agent fails
+	agent.mu.Lock()
+	agent.failed = true
+	agent.mu.Unlock()
+	m := &types.LogMessage{Fields: map[string]interface{}{"container_id": "ffffffffffff"}}
+	e.Transform(m)
+	time.Sleep(50 * time.Millisecond)
+	metadata = waitForECS(t, e, "0123456789ab")
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("expected %v, got %v", expected, metadata)
+	}
+}
+
+func TestECSDoesNotBlock(t *testing.T) {
+	agent := &fakeECSAgent{slow: make(chan struct{})}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+	defer close(agent.slow)
+
+	e, err := NewECS(server.URL, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	transformed := make(chan *types.LogMessage)
+	go func() {
+		m := &types.LogMessage{Fields: map[string]interface{}{"container_id": "0123456789ab", "message": "hello"}}
+		e.Transform(m)
+		e.Transform(m)
+		transformed <- m
+	}()
+
+	select {
+	case m := <-transformed:
+		if _, ok := m.Fields["ecs"]; ok {
+			t.Errorf("expected no ecs metadata, got %v", m.Fields["ecs"])
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected transform not to wait for the agent")
+	}
+}
+
+func TestECSInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "localhost:51678", "ftp://localhost"} {
+		_, err := NewECS(u, time.Minute, time.Second)
+		if err == nil {
+			t.Errorf("%s: expected error", u)
+		}
+	}
+}
+
+func TestECSInvalidInterval(t *testing.T) {
+	_, err := NewECS("http://localhost:51678", time.Second, time.Second)
+	if err == nil {
+		t.Error("expected error for an interval below the minimum")
+	}
+}
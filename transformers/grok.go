@@ -0,0 +1,275 @@
+package transformers
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/uswitch/loglet/filters"
+	"github.com/uswitch/loglet/types"
+)
+
+// Grok extracts fields from messages with named patterns, like logstash's
+// grok filter. Each rule has a pattern and optionally a filter expression
+// over message fields choosing the messages it applies to:
+//
+//	systemd_unit == "nginx.service" => %{NGINXACCESS}
+//
+// Patterns are regular expressions that can refer to other patterns with
+// %{NAME}, capturing the match as a field with %{NAME:field}, converted
+// to a number with %{NAME:field:int} or %{NAME:field:float}. The fields
+// of the first rule that matches are added to the message, replacing any
+// with the same name.
+type Grok struct {
+	rules []grokRule
+}
+
+type grokRule struct {
+	filter filters.Expr
+	re     *regexp.Regexp
+	// field and type for each named capture group
+	fields map[string]grokField
+}
+
+type grokField struct {
+	name string
+	typ  string
+}
+
+// grokPatterns are the built in patterns, written for go's regular
+// expressions so without lookarounds or atomic groups
+var grokPatterns = map[string]string{
+	"USERNAME":     `[a-zA-Z0-9._-]+`,
+	"USER":         `%{USERNAME}`,
+	"INT":          `(?:[+-]?(?:[0-9]+))`,
+	"BASE10NUM":    `(?:[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+))`,
+	"NUMBER":       `(?:%{BASE10NUM})`,
+	"BASE16NUM":    `(?:[+-]?(?:0x)?(?:[0-9A-Fa-f]+))`,
+	"POSINT":       `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":    `\b(?:[0-9]+)\b`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`,
+	"QS":           `%{QUOTEDSTRING}`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+
+	"IPV4":     `(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9]?[0-9])`,
+	"IPV6":     `(?:(?:[0-9A-Fa-f]{0,4}:){2,6}%{IPV4}|(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{0,4})(?:%[0-9A-Za-z]+)?`,
+	"IP":       `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME": `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?`,
+	"IPORHOST": `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	"UNIXPATH":     `(?:/[\w_%!$@:.,+~-]*)+`,
+	"PATH":         `%{UNIXPATH}`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+.-]+`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\[\]<>-]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	"MONTH":             `\b(?:Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|June?|July?|Aug(?:ust)?|Sep(?:tember)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9])`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?)`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"DATE":              `(?:%{DATE_US}|%{DATE_EU})`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"LOGLEVEL":          `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)?)`,
+
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{USER:ident} %{USER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response:int} (?:%{NUMBER:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+	// nginx's default combined log format
+	"NGINXACCESS": `%{COMBINEDAPACHELOG}`,
+
+	"HAPROXYTIME": `%{HOUR}:%{MINUTE}:%{SECOND}`,
+	"HAPROXYDATE": `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{HAPROXYTIME}\.%{INT}`,
+	// haproxy's option httplog format
+	"HAPROXYHTTP": `%{IP:client_ip}:%{INT:client_port:int} \[%{HAPROXYDATE:accept_date}\] %{NOTSPACE:frontend_name} %{NOTSPACE:backend_name}/%{NOTSPACE:server_name} %{INT:time_request:int}/%{INT:time_queue:int}/%{INT:time_backend_connect:int}/%{INT:time_backend_response:int}/%{NOTSPACE:time_duration} %{INT:http_status_code:int} %{NOTSPACE:bytes_read} %{DATA:captured_request_cookie} %{DATA:captured_response_cookie} %{NOTSPACE:termination_state} %{INT:actconn:int}/%{INT:feconn:int}/%{INT:beconn:int}/%{INT:srvconn:int}/%{NOTSPACE:retries} %{INT:srv_queue:int}/%{INT:backend_queue:int} (?:\{%{DATA:captured_request_headers}\} )?(?:\{%{DATA:captured_response_headers}\} )?"(?:%{WORD:http_verb} %{NOTSPACE:http_request}(?: HTTP/%{NUMBER:http_version})?|<BADREQ>)"`,
+}
+
+var grokRefRe = regexp.MustCompile(`%\{(\w+)(?::([\w.@-]+))?(?::(int|float))?\}`)
+
+// maximum depth of patterns referring to patterns, to catch cycles
+const grokMaxDepth = 32
+
+// NewGrok compiles rules, with patterns from files in addition to the built
+// in ones
+func NewGrok(rules []string, patternFiles []string) (*Grok, error) {
+	patterns := make(map[string]string, len(grokPatterns))
+	for name, pattern := range grokPatterns {
+		patterns[name] = pattern
+	}
+	for _, file := range patternFiles {
+		err := readGrokPatterns(file, patterns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g := &Grok{}
+	for _, rule := range rules {
+		var filterExpr string
+		pattern := rule
+		// the filter comes first, so split on the first arrow in case the
+		// pattern contains one
+		if i := strings.Index(rule, "=>"); i >= 0 {
+			filterExpr, pattern = strings.TrimSpace(rule[:i]), strings.TrimSpace(rule[i+2:])
+		}
+
+		r := grokRule{fields: make(map[string]grokField)}
+
+		if filterExpr != "" {
+			filter, err := filters.Compile(filterExpr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid grok rule '%s': %s", rule, err)
+			}
+			r.filter = filter
+		}
+
+		expanded, err := expandGrok(pattern, patterns, r.fields, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grok rule '%s': %s", rule, err)
+		}
+		r.re, err = regexp.Compile(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grok rule '%s': %s", rule, err)
+		}
+
+		g.rules = append(g.rules, r)
+	}
+
+	return g, nil
+}
+
+// readGrokPatterns reads a file of patterns, one per line as a name followed
+// by the pattern, as in logstash
+func readGrokPatterns(path string, patterns map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read grok patterns: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: expected a name followed by a pattern", path, n)
+		}
+		patterns[line[:i]] = strings.TrimSpace(line[i:])
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read grok patterns: %s", err)
+	}
+
+	return nil
+}
+
+// expandGrok replaces references to patterns with the patterns, capturing
+// named references in groups recorded in fields
+func expandGrok(pattern string, patterns map[string]string, fields map[string]grokField, depth int) (string, error) {
+	if depth > grokMaxDepth {
+		return "", fmt.Errorf("patterns nested too deeply, do they refer to themselves?")
+	}
+
+	var err error
+	expanded := grokRefRe.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		match := grokRefRe.FindStringSubmatch(ref)
+		name, field, typ := match[1], match[2], match[3]
+
+		p, ok := patterns[name]
+		if !ok {
+			err = fmt.Errorf("unknown pattern %s", name)
+			return ""
+		}
+		p, err = expandGrok(p, patterns, fields, depth+1)
+		if err != nil {
+			return ""
+		}
+
+		if field == "" {
+			return "(?:" + p + ")"
+		}
+		group := "f" + strconv.Itoa(len(fields))
+		fields[group] = grokField{field, typ}
+		return "(?P<" + group + ">" + p + ")"
+	})
+
+	return expanded, err
+}
+
+func (g *Grok) Transform(m *types.LogMessage) {
+	message, ok := m.Fields["message"].(string)
+	if !ok {
+		return
+	}
+
+	var fields map[string]string
+	for _, rule := range g.rules {
+		if rule.filter != nil {
+			if fields == nil {
+				fields = m.StringFields()
+			}
+			if !rule.filter.Match(fields) {
+				continue
+			}
+		}
+
+		match := rule.re.FindStringSubmatchIndex(message)
+		if match == nil {
+			continue
+		}
+
+		for i, group := range rule.re.SubexpNames() {
+			field, ok := rule.fields[group]
+			if !ok || match[2*i] < 0 {
+				continue
+			}
+			value := message[match[2*i]:match[2*i+1]]
+			m.Fields[field.name] = convertGrok(value, field.typ)
+		}
+		return
+	}
+}
+
+// convertGrok converts a captured value to its type, keeping it as a string
+// if it can't be
+func convertGrok(value, typ string) interface{} {
+	switch typ {
+	case "int":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	case "float":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	}
+	return value
+}
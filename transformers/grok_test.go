@@ -0,0 +1,171 @@
+package transformers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/uswitch/loglet/types"
+)
+
+func TestGrok(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-grok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	patterns := filepath.Join(dir, "patterns")
+	err = ioutil.WriteFile(patterns, []byte(`
+# application patterns
+REQUESTID [0-9a-f]{8}
+APPLINE %{TIMESTAMP_ISO8601:time} \[%{LOGLEVEL:level}\] %{REQUESTID:request_id} %{GREEDYDATA:message}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grok, err := NewGrok([]string{
+		`systemd_unit == "nginx.service" => %{NGINXACCESS}`,
+		`systemd_unit == "haproxy.service" => %{HAPROXYHTTP}`,
+		`%{APPLINE}`,
+		`took %{NUMBER:duration:float}s from %{IP:ip}`,
+	}, []string{patterns})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fields   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			map[string]interface{}{
+				"systemd_unit": "nginx.service",
+				"message":      `203.0.113.9 - alice [17/Oct/2026:10:00:00 +0000] "GET /index.html?q=1 HTTP/1.1" 200 512 "-" "curl/7.50"`,
+			},
+			map[string]interface{}{
+				"systemd_unit": "nginx.service",
+				"message":      `203.0.113.9 - alice [17/Oct/2026:10:00:00 +0000] "GET /index.html?q=1 HTTP/1.1" 200 512 "-" "curl/7.50"`,
+				"clientip":     "203.0.113.9",
+				"ident":        "-",
+				"auth":         "alice",
+				"timestamp":    "17/Oct/2026:10:00:00 +0000",
+				"verb":         "GET",
+				"request":      "/index.html?q=1",
+				"httpversion":  "1.1",
+				"response":     int64(200),
+				"bytes":        int64(512),
+				"referrer":     `"-"`,
+				"agent":        `"curl/7.50"`,
+			},
+		},
+		{
+			map[string]interface{}{
+				"systemd_unit": "haproxy.service",
+				"message":      `10.0.1.2:33317 [17/Oct/2026:10:00:00.123] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 "GET /index.html HTTP/1.1"`,
+			},
+			map[string]interface{}{
+				"systemd_unit":             "haproxy.service",
+				"message":                  `10.0.1.2:33317 [17/Oct/2026:10:00:00.123] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 "GET /index.html HTTP/1.1"`,
+				"client_ip":                "10.0.1.2",
+				"client_port":              int64(33317),
+				"accept_date":              "17/Oct/2026:10:00:00.123",
+				"frontend_name":            "http-in",
+				"backend_name":             "static",
+				"server_name":              "srv1",
+				"time_request":             int64(10),
+				"time_queue":               int64(0),
+				"time_backend_connect":     int64(30),
+				"time_backend_response":    int64(69),
+				"time_duration":            "109",
+				"http_status_code":         int64(200),
+				"bytes_read":               "2750",
+				"captured_request_cookie":  "-",
+				"captured_response_cookie": "-",
+				"termination_state":        "----",
+				"actconn":                  int64(1),
+				"feconn":                   int64(1),
+				"beconn":                   int64(1),
+				"srvconn":                  int64(1),
+				"retries":                  "0",
+				"srv_queue":                int64(0),
+				"backend_queue":            int64(0),
+				"http_verb":                "GET",
+				"http_request":             "/index.html",
+				"http_version":             "1.1",
+			},
+		},
+		// nginx pattern isn't used for other units
+		{
+			map[string]interface{}{
+				"systemd_unit": "web.service",
+				"message":      `2026-10-17T10:00:00Z [WARN] 0123abcd slow request`,
+			},
+			map[string]interface{}{
+				"systemd_unit": "web.service",
+				"message":      "slow request",
+				"time":         "2026-10-17T10:00:00Z",
+				"level":        "WARN",
+				"request_id":   "0123abcd",
+			},
+		},
+		{
+			map[string]interface{}{"message": "request took 1.5s from 2001:db8::1"},
+			map[string]interface{}{"message": "request took 1.5s from 2001:db8::1", "duration": 1.5, "ip": "2001:db8::1"},
+		},
+		// nothing matches
+		{
+			map[string]interface{}{"systemd_unit": "web.service", "message": "hello"},
+			map[string]interface{}{"systemd_unit": "web.service", "message": "hello"},
+		},
+	}
+
+	for _, test := range tests {
+		m := &types.LogMessage{Fields: test.fields}
+		grok.Transform(m)
+		if !reflect.DeepEqual(m.Fields, test.expected) {
+			t.Errorf("expected %v, got %v", test.expected, m.Fields)
+		}
+	}
+}
+
+func TestGrokErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loglet-grok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cycle := filepath.Join(dir, "cycle")
+	err = ioutil.WriteFile(cycle, []byte("A %{B}\nB x%{A}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid")
+	err = ioutil.WriteFile(invalid, []byte("NOPATTERN\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rules []string
+		files []string
+	}{
+		{[]string{"%{NOSUCHPATTERN}"}, nil},
+		{[]string{"%{A}"}, []string{cycle}},
+		{[]string{"%{INT}"}, []string{invalid}},
+		{[]string{"%{INT}"}, []string{filepath.Join(dir, "missing")}},
+		{[]string{"(unclosed"}, nil},
+		{[]string{`systemd_unit == => %{INT}`}, nil},
+	}
+
+	for _, test := range tests {
+		_, err := NewGrok(test.rules, test.files)
+		if err == nil {
+			t.Errorf("%v %v: expected error", test.rules, test.files)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package transformers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/uswitch/loglet/types"
+)
+
+// JSONMessage parses messages that are JSON objects into fields. Messages
+// that aren't, or fail to parse, are left as they are.
+type JSONMessage struct {
+	// Target is a field to put the parsed fields under, rather than merging
+	// them into the message
+	Target string
+	// PayloadWins replaces fields already in the message with parsed fields
+	// of the same name, rather than keeping them
+	PayloadWins bool
+	// MaxDepth is how deeply objects and arrays can be nested before they
+	// are kept as JSON strings rather than parsed
+	MaxDepth int
+	// MaxSize is the largest message that's parsed, in bytes
+	MaxSize int
+}
+
+func NewJSONMessage(target string, payloadWins bool, maxDepth, maxSize int) *JSONMessage {
+	return &JSONMessage{
+		Target:      target,
+		PayloadWins: payloadWins,
+		MaxDepth:    maxDepth,
+		MaxSize:     maxSize,
+	}
+}
+
+func (p *JSONMessage) Transform(m *types.LogMessage) {
+	message, ok := m.Fields["message"].(string)
+	if !ok || len(message) > p.MaxSize {
+		return
+	}
+	message = strings.TrimSpace(message)
+	if !strings.HasPrefix(message, "{") {
+		return
+	}
+
+	d := json.NewDecoder(strings.NewReader(message))
+	// keep numbers as they were written rather than as floats
+	d.UseNumber()
+
+	var payload map[string]interface{}
+	err := d.Decode(&payload)
+	if err != nil || d.More() {
+		return
+	}
+	limitDepth(payload, 1, p.MaxDepth)
+
+	if p.Target != "" {
+		if _, exists := m.Fields[p.Target]; !exists || p.PayloadWins {
+			m.Fields[p.Target] = payload
+		}
+		return
+	}
+
+	for k, v := range payload {
+		if _, exists := m.Fields[k]; !exists || p.PayloadWins {
+			m.Fields[k] = v
+		}
+	}
+}
+
+// limitDepth replaces objects and arrays nested deeper than max with their
+// JSON encoding
+func limitDepth(v interface{}, depth, max int) {
+	nested := func(v interface{}) interface{} {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			if depth >= max {
+				var buf bytes.Buffer
+				e := json.NewEncoder(&buf)
+				e.SetEscapeHTML(false)
+				e.Encode(v)
+				return strings.TrimSpace(buf.String())
+			}
+			limitDepth(v, depth+1, max)
+		}
+		return v
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = nested(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = nested(child)
+		}
+	}
+}
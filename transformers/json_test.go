@@ -0,0 +1,89 @@
+package transformers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/uswitch/loglet/types"
+)
+
+func TestJSONMessage(t *testing.T) {
+	tests := []struct {
+		transformer *JSONMessage
+		fields      string
+		expected    string
+	}{
+		// journal fields win by default
+		{
+			NewJSONMessage("", false, 10, 1024),
+			`{"message":"{\"level\":\"info\",\"hostname\":\"other\",\"n\":12345678901234567890}","hostname":"a"}`,
+			`{"hostname":"a","level":"info","message":"{\"level\":\"info\",\"hostname\":\"other\",\"n\":12345678901234567890}","n":12345678901234567890}`,
+		},
+		{
+			NewJSONMessage("", true, 10, 1024),
+			`{"message":" {\"hostname\":\"other\",\"message\":\"hi\"} ","hostname":"a"}`,
+			`{"hostname":"other","message":"hi"}`,
+		},
+		{
+			NewJSONMessage("app", false, 10, 1024),
+			`{"message":"{\"level\":\"info\"}"}`,
+			`{"app":{"level":"info"},"message":"{\"level\":\"info\"}"}`,
+		},
+		// target already in the journal entry
+		{
+			NewJSONMessage("app", false, 10, 1024),
+			`{"message":"{\"level\":\"info\"}","app":"x"}`,
+			`{"app":"x","message":"{\"level\":\"info\"}"}`,
+		},
+		{
+			NewJSONMessage("", false, 2, 1024),
+			`{"message":"{\"a\":{\"b\":{\"c\":[1,\"x\"]}},\"d\":[[1]]}"}`,
+			`{"a":{"b":"{\"c\":[1,\"x\"]}"},"d":["[1]"],"message":"{\"a\":{\"b\":{\"c\":[1,\"x\"]}},\"d\":[[1]]}"}`,
+		},
+		// too large
+		{
+			NewJSONMessage("", false, 10, 10),
+			`{"message":"{\"level\":\"info\"}"}`,
+			`{"message":"{\"level\":\"info\"}"}`,
+		},
+		// not JSON objects, or not only JSON
+		{
+			NewJSONMessage("", false, 10, 1024),
+			`{"message":"{\"level\":"}`,
+			`{"message":"{\"level\":"}`,
+		},
+		{
+			NewJSONMessage("", false, 10, 1024),
+			`{"message":"{\"level\":\"info\"} trailing"}`,
+			`{"message":"{\"level\":\"info\"} trailing"}`,
+		},
+		{
+			NewJSONMessage("", false, 10, 1024),
+			`{"message":"[1,2]"}`,
+			`{"message":"[1,2]"}`,
+		},
+		{
+			NewJSONMessage("", false, 10, 1024),
+			`{"message":1}`,
+			`{"message":1}`,
+		},
+	}
+
+	for _, test := range tests {
+		m := &types.LogMessage{}
+		err := json.Unmarshal([]byte(test.fields), &m.Fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test.transformer.Transform(m)
+
+		actual, err := json.Marshal(m.Fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.fields, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package transformers
+
+import (
+	"strings"
+
+	"github.com/uswitch/loglet/types"
+)
+
+// Kubernetes adds the namespace, pod and container of entries logged by
+// containers the kubelet started through docker's journald log driver,
+// from container names like k8s_app_pod-abc_default_0123_0, as
+// kubernetes_namespace, kubernetes_pod, kubernetes_container and
+// kubernetes_pod_uid. With a pod cache it also adds the pod's labels and
+// annotations as kubernetes_labels and kubernetes_annotations.
+type Kubernetes struct {
+	pods *PodCache
+}
+
+func NewKubernetes(pods *PodCache) *Kubernetes {
+	return &Kubernetes{
+		pods: pods,
+	}
+}
+
+type containerName struct {
+	container string
+	pod       string
+	namespace string
+	podUID    string
+}
+
+// parseContainerName parses the kubelet's container naming convention:
+//
+//	k8s_<container>_<pod>_<namespace>_<pod uid>_<attempt>
+//
+// none of which can contain underscores
+func parseContainerName(name string) (*containerName, bool) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "_")
+	if len(parts) != 6 || parts[0] != "k8s" {
+		return nil, false
+	}
+	for _, part := range parts[1:5] {
+		if part == "" {
+			return nil, false
+		}
+	}
+
+	return &containerName{
+		container: parts[1],
+		pod:       parts[2],
+		namespace: parts[3],
+		podUID:    parts[4],
+	}, true
+}
+
+func (k *Kubernetes) Transform(m *types.LogMessage) {
+	name, ok := m.Fields["container_name"].(string)
+	if !ok {
+		return
+	}
+	c, ok := parseContainerName(name)
+	if !ok {
+		return
+	}
+
+	// top level fields rather than an object, so filters, topic routes and
+	// loki labels can use them
+	m.Fields["kubernetes_namespace"] = c.namespace
+	m.Fields["kubernetes_pod"] = c.pod
+	m.Fields["kubernetes_container"] = c.container
+	m.Fields["kubernetes_pod_uid"] = c.podUID
+
+	if k.pods != nil {
+		if pod := k.pods.Pod(c.namespace, c.pod, c.podUID); pod != nil {
+			if len(pod.Labels) > 0 {
+				m.Fields["kubernetes_labels"] = pod.Labels
+			}
+			if len(pod.Annotations) > 0 {
+				m.Fields["kubernetes_annotations"] = pod.Annotations
+			}
+		}
+	}
+}
+
+// Close stops watching for changes to pods
+func (k *Kubernetes) Close() error {
+	if k.pods != nil {
+		k.pods.Close()
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+package transformers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// in cluster credentials for the kubernetes API
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// pods that couldn't be fetched are looked up again after at most this long,
+// which is also as often as pods are listed from the kubelet
+const podRetryInterval = 10 * time.Second
+
+// how often pods that have expired are removed from the cache
+const podPruneInterval = time.Minute
+
+// how many pods can be waiting to be fetched, after which pods that aren't
+// cached go without metadata until they can be queued
+const podFetchQueueSize = 100
+
+// Pod is the metadata of a pod added to messages
+type Pod struct {
+	UID         string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+type PodCacheOptions struct {
+	// Source is where pods are fetched from, either the kubernetes API
+	// ("api") or the kubelet's /pods ("kubelet")
+	Source string
+	// URL of the API, or the kubelet. Defaults to the API as seen from
+	// inside the cluster, or the kubelet's read only port.
+	URL string
+	// TokenFile holds a bearer token to authenticate with, and CAFile the
+	// certificates to verify the server with. Both default to those of the
+	// service account when fetching from the API inside the cluster.
+	TokenFile string
+	CAFile    string
+	// NodeName limits the pods watched to those on the node
+	NodeName string
+	// TTL is how long pods are cached
+	TTL time.Duration
+	// Timeout for fetching pods that aren't cached
+	Timeout time.Duration
+}
+
+// PodCache caches the metadata of pods by UID. Pods from the API are
+// watched for changes, and otherwise fetched again in the background once
+// they expire.
+type PodCache struct {
+	opts   PodCacheOptions
+	client *http.Client
+	// client for watches, which have no timeout
+	watchClient *http.Client
+
+	mu   sync.Mutex
+	pods map[string]*cachedPod
+	// pods waiting to be fetched, by namespace/name
+	queued map[string]bool
+
+	fetches chan podRef
+	// when pods were last listed from the kubelet, only used while fetching
+	listed time.Time
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type cachedPod struct {
+	// nil for pods that couldn't be found
+	pod     *Pod
+	expires time.Time
+}
+
+type podRef struct {
+	namespace string
+	name      string
+	uid       string
+}
+
+func NewPodCache(opts PodCacheOptions) (*PodCache, error) {
+	switch opts.Source {
+	case "api":
+		if opts.URL == "" {
+			host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+			if host == "" || port == "" {
+				return nil, fmt.Errorf("kubernetes: no API url given, and not running in a cluster")
+			}
+			opts.URL = "https://" + net.JoinHostPort(host, port)
+			if opts.TokenFile == "" {
+				opts.TokenFile = serviceAccountTokenFile
+			}
+			if opts.CAFile == "" {
+				opts.CAFile = serviceAccountCAFile
+			}
+		}
+	case "kubelet":
+		if opts.URL == "" {
+			opts.URL = "http://localhost:10255"
+		}
+	default:
+		return nil, fmt.Errorf("kubernetes: unknown metadata source '%s', expected api or kubelet", opts.Source)
+	}
+
+	u, err := url.Parse(opts.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("kubernetes: invalid url '%s'", opts.URL)
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: unable to read CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kubernetes: no certificates found in %s", opts.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &PodCache{
+		opts:        opts,
+		client:      &http.Client{Transport: transport, Timeout: opts.Timeout},
+		watchClient: &http.Client{Transport: transport},
+		pods:        make(map[string]*cachedPod),
+		queued:      make(map[string]bool),
+		fetches:     make(chan podRef, podFetchQueueSize),
+		cancel:      cancel,
+	}
+
+	c.wg.Add(1)
+	go c.fetchPods(ctx)
+	if opts.Source == "api" {
+		c.wg.Add(1)
+		go c.watch(ctx)
+	}
+
+	return c, nil
+}
+
+// Close stops fetching and watching pods
+func (c *PodCache) Close() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+// Pod returns the metadata of a pod, or nil if it isn't cached. Pods that
+// aren't cached, or have expired, are fetched in the background rather than
+// holding up messages, and expired pods are returned until they have been.
+// A pod whose name has been reused by one with a different UID is nil.
+func (c *PodCache) Pod(namespace, name, uid string) *Pod {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.pods[uid]
+	if ok && time.Now().Before(cached.expires) {
+		return cached.pod
+	}
+
+	key := namespace + "/" + name
+	if !c.queued[key] {
+		select {
+		case c.fetches <- podRef{namespace, name, uid}:
+			c.queued[key] = true
+		default:
+		}
+	}
+
+	if ok {
+		return cached.pod
+	}
+	return nil
+}
+
+// fetchPods fetches pods as they're asked for, and prunes those that have
+// expired, until stopped
+func (c *PodCache) fetchPods(ctx context.Context) {
+	defer c.wg.Done()
+
+	prune := time.NewTicker(podPruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-prune.C:
+			c.prune()
+		case ref := <-c.fetches:
+			c.fetch(ctx, ref)
+
+			c.mu.Lock()
+			delete(c.queued, ref.namespace+"/"+ref.name)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// fetch gets a pod from the API, or all pods from the kubelet. A pod with
+// the same name but a different UID has replaced the one asked for, which
+// is cached as not found.
+func (c *PodCache) fetch(ctx context.Context, ref podRef) {
+	key := ref.namespace + "/" + ref.name
+	// pods that aren't found are looked up again in case they were only
+	// just started, but those that were replaced won't come back
+	notFound := c.retryInterval()
+
+	if c.opts.Source == "api" {
+		var p kubePod
+		found, err := c.get(ctx, c.client, "/api/v1/namespaces/"+url.PathEscape(ref.namespace)+"/pods/"+url.PathEscape(ref.name), &p)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("kubernetes: unable to fetch pod %s: %s", key, err)
+			}
+			c.retry(ref.uid)
+			return
+		}
+		if found {
+			c.update(&p)
+			if p.Metadata.UID != ref.uid {
+				notFound = c.opts.TTL
+			}
+		}
+	} else if time.Since(c.listed) >= podRetryInterval {
+		var list kubePodList
+		_, err := c.get(ctx, c.client, "/pods", &list)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("kubernetes: unable to list pods: %s", err)
+			}
+			c.retry(ref.uid)
+			return
+		}
+		c.listed = time.Now()
+		for _, p := range list.Items {
+			c.update(&p)
+			if p.Metadata.Namespace == ref.namespace && p.Metadata.Name == ref.name && p.Metadata.UID != ref.uid {
+				notFound = c.opts.TTL
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.pods[ref.uid]; !ok || !time.Now().Before(cached.expires) {
+		c.pods[ref.uid] = &cachedPod{nil, time.Now().Add(notFound)}
+	}
+}
+
+// retry keeps what's cached for a pod that couldn't be fetched, or nothing,
+// until it's looked up again
+func (c *PodCache) retry(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.retryInterval())
+	if cached, ok := c.pods[uid]; ok {
+		cached.expires = expires
+		return
+	}
+	c.pods[uid] = &cachedPod{nil, expires}
+}
+
+func (c *PodCache) retryInterval() time.Duration {
+	if c.opts.TTL < podRetryInterval {
+		return c.opts.TTL
+	}
+	return podRetryInterval
+}
+
+// prune removes pods that have expired
+func (c *PodCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for uid, cached := range c.pods {
+		if !now.Before(cached.expires) {
+			delete(c.pods, uid)
+		}
+	}
+}
+
+// watch keeps pods from the API up to date, listing them and then watching
+// for changes until stopped
+func (c *PodCache) watch(ctx context.Context) {
+	defer c.wg.Done()
+
+	backoff := time.Second
+	for {
+		err := c.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("kubernetes: unable to watch pods, retrying in %s: %s", backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if err != nil && backoff < time.Minute {
+			backoff *= 2
+		} else if err == nil {
+			backoff = time.Second
+		}
+	}
+}
+
+func (c *PodCache) listAndWatch(ctx context.Context) error {
+	selector := ""
+	if c.opts.NodeName != "" {
+		selector = "fieldSelector=" + url.QueryEscape("spec.nodeName="+c.opts.NodeName)
+	}
+
+	var list kubePodList
+	_, err := c.get(ctx, c.client, "/api/v1/pods?"+selector, &list)
+	if err != nil {
+		return err
+	}
+	for _, p := range list.Items {
+		c.update(&p)
+	}
+
+	resp, err := c.request(ctx, c.watchClient, "/api/v1/pods?watch=1&resourceVersion="+url.QueryEscape(list.Metadata.ResourceVersion)+"&"+selector)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	d := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string  `json:"type"`
+			Object kubePod `json:"object"`
+		}
+		err := d.Decode(&event)
+		if err == io.EOF {
+			// the API ends watches after a while
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			c.update(&event.Object)
+		case "ERROR":
+			// most likely the resource version is too old, so list again
+			return nil
+		}
+		// deleted pods are kept until they expire, as their last messages
+		// may not have been read yet
+	}
+}
+
+func (c *PodCache) update(p *kubePod) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pods[p.Metadata.UID] = &cachedPod{p.pod(), time.Now().Add(c.opts.TTL)}
+}
+
+func (c *PodCache) request(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.opts.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	if c.opts.TokenFile != "" {
+		// read every time, as service account tokens are rotated
+		token, err := ioutil.ReadFile(c.opts.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	return client.Do(req)
+}
+
+// get decodes a JSON response, returning false if it wasn't found
+func (c *PodCache) get(ctx context.Context, client *http.Client, path string, v interface{}) (bool, error) {
+	resp, err := c.request(ctx, client, path)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid response: %s", err)
+	}
+	return true, nil
+}
+
+type kubePod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		UID         string            `json:"uid"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+type kubePodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubePod `json:"items"`
+}
+
+func (p *kubePod) pod() *Pod {
+	return &Pod{
+		UID:         p.Metadata.UID,
+		Labels:      p.Metadata.Labels,
+		Annotations: p.Metadata.Annotations,
+	}
+}
@@ -0,0 +1,406 @@
+package transformers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uswitch/loglet/types"
+)
+
+func TestParseContainerName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected *containerName
+	}{
+		{"k8s_app_web-1234_default_0123-4567_0", &containerName{"app", "web-1234", "default", "0123-4567"}},
+		{"/k8s_POD_web-1234_kube-system_0123-4567_2", &containerName{"POD", "web-1234", "kube-system", "0123-4567"}},
+		{"k8s_app_web-1234_default_0123-4567", nil},
+		{"k8s_app__default_0123-4567_0", nil},
+		{"docker_app_web-1234_default_0123-4567_0", nil},
+		{"elated_hopper", nil},
+	}
+
+	for _, test := range tests {
+		c, ok := parseContainerName(test.name)
+		if ok != (test.expected != nil) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected != nil, ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(c, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, c)
+		}
+	}
+}
+
+// fakeKubernetes stands in for the API and kubelet, serving pods and
+// streaming watch events sent to it
+type fakeKubernetes struct {
+	mu       sync.Mutex
+	pods     map[string]map[string]interface{}
+	gets     int
+	watching chan struct{}
+	events   chan string
+}
+
+func newFakeKubernetes() *fakeKubernetes {
+	return &fakeKubernetes{
+		pods:     make(map[string]map[string]interface{}),
+		watching: make(chan struct{}, 1),
+		events:   make(chan string, 10),
+	}
+}
+
+func kubernetesPod(namespace, name, uid string, labels map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"namespace":   namespace,
+			"name":        name,
+			"uid":         uid,
+			"labels":      labels,
+			"annotations": map[string]string{"owner": "team"},
+		},
+	}
+}
+
+func (f *fakeKubernetes) setPod(pod map[string]interface{}) {
+	metadata := pod["metadata"].(map[string]interface{})
+	f.mu.Lock()
+	f.pods[metadata["namespace"].(string)+"/"+metadata["name"].(string)] = pod
+	f.mu.Unlock()
+}
+
+func (f *fakeKubernetes) list() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []map[string]interface{}
+	for _, pod := range f.pods {
+		items = append(items, pod)
+	}
+	return items
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/pods":
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": f.list()})
+	case req.URL.Path == "/api/v1/pods" && req.URL.Query().Get("watch") == "1":
+		w.(http.Flusher).Flush()
+		f.watching <- struct{}{}
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case event := <-f.events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	case req.URL.Path == "/api/v1/pods":
+		if req.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": "1"},
+			"items":    f.list(),
+		})
+	default:
+		// /api/v1/namespaces/<namespace>/pods/<name>
+		parts := strings.Split(req.URL.Path, "/")
+		if len(parts) != 7 || parts[3] != "namespaces" || parts[5] != "pods" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		namespace, name := parts[4], parts[6]
+
+		f.mu.Lock()
+		f.gets++
+		pod, ok := f.pods[namespace+"/"+name]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pod)
+	}
+}
+
+func (f *fakeKubernetes) getCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gets
+}
+
+// writeToken writes the token the stand in expects to a file, for the
+// caller to remove
+func writeToken(t *testing.T) string {
+	f, err := ioutil.TempFile("", "loglet-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString("secret\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func newTestPodCache(t *testing.T, source, url, token string) *PodCache {
+	pods, err := NewPodCache(PodCacheOptions{
+		Source:    source,
+		URL:       url,
+		TokenFile: token,
+		NodeName:  "node-1",
+		TTL:       time.Minute,
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pods
+}
+
+func kubernetesMessage(container string) *types.LogMessage {
+	return &types.LogMessage{Fields: map[string]interface{}{"container_name": container}}
+}
+
+// kubernetesMetadata returns the kubernetes fields of a message, without
+// their prefix
+func kubernetesMetadata(m *types.LogMessage) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	for k, v := range m.Fields {
+		if strings.HasPrefix(k, "kubernetes_") {
+			metadata[strings.TrimPrefix(k, "kubernetes_")] = v
+		}
+	}
+	return metadata
+}
+
+// waitForLabels transforms a message from a container until its pod has
+// been fetched in the background
+func waitForLabels(t *testing.T, k *Kubernetes, container string) map[string]interface{} {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m := kubernetesMessage(container)
+		k.Transform(m)
+		metadata := kubernetesMetadata(m)
+		if _, ok := metadata["labels"]; ok {
+			return metadata
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected labels", container)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForFetches waits for pods to have been fetched from the API
+func waitForFetches(t *testing.T, f *fakeKubernetes, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for f.getCount() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d fetches, got %d", n, f.getCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// for the fetched pod to be cached
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestKubernetesFromAPI(t *testing.T) {
+	api := newFakeKubernetes()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	token := writeToken(t)
+	defer os.Remove(token)
+
+	pods := newTestPodCache(t, "api", server.URL, token)
+	k := NewKubernetes(pods)
+	defer k.Close()
+
+	// the first list is empty, so pods are fetched one at a time
+	<-api.watching
+	api.setPod(kubernetesPod("default", "web-1", "uid-1", map[string]string{"app": "web"}))
+
+	// pods that aren't cached are fetched without waiting for them
+	m := kubernetesMessage("k8s_app_web-1_default_uid-1_0")
+	k.Transform(m)
+	if _, ok := kubernetesMetadata(m)["labels"]; ok {
+		t.Errorf("expected no labels before the pod is fetched, got %v", kubernetesMetadata(m))
+	}
+
+	metadata := waitForLabels(t, k, "k8s_app_web-1_default_uid-1_0")
+	expected := map[string]interface{}{
+		"namespace":   "default",
+		"pod":         "web-1",
+		"container":   "app",
+		"pod_uid":     "uid-1",
+		"labels":      map[string]string{"app": "web"},
+		"annotations": map[string]string{"owner": "team"},
+	}
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("expected %v, got %v", expected, metadata)
+	}
+
+	// cached
+	k.Transform(kubernetesMessage("k8s_app_web-1_default_uid-1_0"))
+	if api.getCount() != 1 {
+		t.Errorf("expected pod to be fetched once, was fetched %d times", api.getCount())
+	}
+
+	// a pod replaced by one with the same name is fetched again, and the
+	// old pod keeps its own labels
+	api.setPod(kubernetesPod("default", "web-1", "uid-2", map[string]string{"app": "web", "version": "2"}))
+	labels := waitForLabels(t, k, "k8s_app_web-1_default_uid-2_0")["labels"]
+	if !reflect.DeepEqual(labels, map[string]string{"app": "web", "version": "2"}) {
+		t.Errorf("expected labels of replaced pod, got %v", labels)
+	}
+	labels = waitForLabels(t, k, "k8s_app_web-1_default_uid-1_0")["labels"]
+	if !reflect.DeepEqual(labels, map[string]string{"app": "web"}) {
+		t.Errorf("expected labels of old pod, got %v", labels)
+	}
+
+	// an old pod that wasn't cached doesn't get the labels of the pod that
+	// replaced it, and isn't fetched again
+	k.Transform(kubernetesMessage("k8s_app_web-1_default_uid-0_0"))
+	waitForFetches(t, api, 3)
+	for i := 0; i < 2; i++ {
+		m = kubernetesMessage("k8s_app_web-1_default_uid-0_0")
+		k.Transform(m)
+		if _, ok := kubernetesMetadata(m)["labels"]; ok {
+			t.Errorf("expected no labels for old pod, got %v", kubernetesMetadata(m))
+		}
+	}
+
+	// missing pods are cached too, and still get metadata from their name
+	k.Transform(kubernetesMessage("k8s_app_missing_default_uid-3_0"))
+	waitForFetches(t, api, 4)
+	m = kubernetesMessage("k8s_app_missing_default_uid-3_0")
+	k.Transform(m)
+	expected = map[string]interface{}{
+		"namespace": "default",
+		"pod":       "missing",
+		"container": "app",
+		"pod_uid":   "uid-3",
+	}
+	if !reflect.DeepEqual(kubernetesMetadata(m), expected) {
+		t.Errorf("expected %v, got %v", expected, kubernetesMetadata(m))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if api.getCount() != 4 {
+		t.Errorf("expected 4 fetches, got %d", api.getCount())
+	}
+
+	// changes are watched
+	api.events <- `{"type":"MODIFIED","object":{"metadata":{"namespace":"default","name":"web-1","uid":"uid-2","labels":{"app":"watched"}}}}`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		labels := waitForLabels(t, k, "k8s_app_web-1_default_uid-2_0")["labels"]
+		if reflect.DeepEqual(labels, map[string]string{"app": "watched"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected watched labels, got %v", labels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if api.getCount() != 4 {
+		t.Errorf("expected watched pod not to be fetched, got %d fetches", api.getCount())
+	}
+}
+
+func TestKubernetesFromKubelet(t *testing.T) {
+	kubelet := newFakeKubernetes()
+	kubelet.setPod(kubernetesPod("default", "web-1", "uid-1", map[string]string{"app": "web"}))
+	kubelet.setPod(kubernetesPod("monitoring", "agent-1", "uid-2", map[string]string{"app": "agent"}))
+	server := httptest.NewServer(kubelet)
+	defer server.Close()
+
+	token := writeToken(t)
+	defer os.Remove(token)
+
+	k := NewKubernetes(newTestPodCache(t, "kubelet", server.URL, token))
+	defer k.Close()
+
+	for _, test := range []struct {
+		container string
+		labels    map[string]string
+	}{
+		{"k8s_app_web-1_default_uid-1_0", map[string]string{"app": "web"}},
+		// from the same list
+		{"k8s_agent_agent-1_monitoring_uid-2_1", map[string]string{"app": "agent"}},
+	} {
+		labels := waitForLabels(t, k, test.container)["labels"]
+		if !reflect.DeepEqual(labels, test.labels) {
+			t.Errorf("%s: expected %v, got %v", test.container, test.labels, labels)
+		}
+	}
+
+	// entries from other containers are left alone
+	m := kubernetesMessage("elated_hopper")
+	k.Transform(m)
+	if metadata := kubernetesMetadata(m); len(metadata) > 0 {
+		t.Errorf("expected no kubernetes metadata, got %v", metadata)
+	}
+}
+
+func TestKubernetesDoesNotBlock(t *testing.T) {
+	slow := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-slow
+	}))
+	defer server.Close()
+	defer close(slow)
+
+	k := NewKubernetes(newTestPodCache(t, "kubelet", server.URL, ""))
+	defer k.Close()
+
+	transformed := make(chan *types.LogMessage)
+	go func() {
+		m := kubernetesMessage("k8s_app_web-1_default_uid-1_0")
+		k.Transform(m)
+		k.Transform(m)
+		transformed <- m
+	}()
+
+	select {
+	case <-transformed:
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("expected transform not to wait for the kubelet")
+	}
+}
+
+func TestPodCachePrunesExpiredPods(t *testing.T) {
+	pods := newTestPodCache(t, "kubelet", "http://localhost:10255", "")
+	defer pods.Close()
+
+	pods.mu.Lock()
+	pods.pods["expired"] = &cachedPod{&Pod{UID: "expired"}, time.Now().Add(-time.Second)}
+	pods.pods["cached"] = &cachedPod{&Pod{UID: "cached"}, time.Now().Add(time.Minute)}
+	pods.mu.Unlock()
+
+	pods.prune()
+
+	if _, ok := pods.pods["expired"]; ok {
+		t.Errorf("expected expired pod to be pruned")
+	}
+	if _, ok := pods.pods["cached"]; !ok {
+		t.Errorf("expected cached pod to be kept")
+	}
+}
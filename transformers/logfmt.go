@@ -0,0 +1,122 @@
+package transformers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/uswitch/loglet/types"
+)
+
+// Logfmt parses messages of key=value pairs, like those written by logrus'
+// text formatter:
+//
+//	time="2016-10-17T10:00:00Z" level=info msg="started, reading journal"
+//
+// Values may be quoted, with the escapes of go string literals. Messages
+// that aren't entirely key=value pairs are left as they are.
+type Logfmt struct {
+	// Promote replaces the message with its msg field. The level field is
+	// kept as level.
+	Promote bool
+}
+
+func NewLogfmt(promote bool) *Logfmt {
+	return &Logfmt{
+		Promote: promote,
+	}
+}
+
+func (p *Logfmt) Transform(m *types.LogMessage) {
+	message, ok := m.Fields["message"].(string)
+	if !ok {
+		return
+	}
+
+	pairs, ok := parseLogfmt(message)
+	if !ok {
+		return
+	}
+
+	for _, pair := range pairs {
+		if p.Promote && pair.key == "msg" {
+			m.Fields["message"] = pair.value
+			continue
+		}
+		if p.Promote && pair.key == "level" {
+			m.Fields["level"] = pair.value
+			continue
+		}
+		if _, exists := m.Fields[pair.key]; !exists {
+			m.Fields[pair.key] = pair.value
+		}
+	}
+}
+
+type logfmtPair struct {
+	key   string
+	value string
+}
+
+// parseLogfmt splits a line into key=value pairs, returning false if
+// anything else is found
+func parseLogfmt(line string) ([]logfmtPair, bool) {
+	var pairs []logfmtPair
+
+	s := strings.TrimSpace(line)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		key := s[:eq]
+		if strings.ContainsAny(key, " \t\"") {
+			return nil, false
+		}
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := closingQuote(s)
+			if end < 0 {
+				return nil, false
+			}
+			unquoted, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, false
+			}
+			value, s = unquoted, s[end+1:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+			if strings.ContainsAny(value, `"=`) {
+				return nil, false
+			}
+		}
+
+		if len(s) > 0 && s[0] != ' ' && s[0] != '\t' {
+			return nil, false
+		}
+		s = strings.TrimLeft(s, " \t")
+
+		pairs = append(pairs, logfmtPair{key, value})
+	}
+
+	return pairs, len(pairs) > 0
+}
+
+// closingQuote finds the quote ending a quoted string, skipping escaped
+// characters
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
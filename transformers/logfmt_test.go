@@ -0,0 +1,101 @@
+package transformers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/uswitch/loglet/types"
+)
+
+func TestLogfmtParsesLogrus(t *testing.T) {
+	formatter := &log.TextFormatter{DisableColors: true, TimestampFormat: time.RFC3339}
+
+	values := []string{
+		"plain",
+		"with space",
+		`quote " and backslash \`,
+		"new\nline\ttab",
+		"key=value",
+		"unicode ✓",
+	}
+
+	for _, value := range values {
+		entry := log.NewEntry(log.New()).WithField("field", value)
+		entry.Time = time.Date(2016, 10, 17, 10, 0, 0, 0, time.UTC)
+		entry.Level = log.WarnLevel
+		entry.Message = value
+
+		line, err := formatter.Format(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := &types.LogMessage{Fields: map[string]interface{}{"message": strings.TrimSpace(string(line))}}
+		NewLogfmt(true).Transform(m)
+
+		expected := map[string]interface{}{
+			"time":    "2016-10-17T10:00:00Z",
+			"level":   "warning",
+			"message": value,
+			"field":   value,
+		}
+		if !reflect.DeepEqual(m.Fields, expected) {
+			t.Errorf("%s: expected %v, got %v", line, expected, m.Fields)
+		}
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	tests := []struct {
+		promote  bool
+		fields   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			false,
+			map[string]interface{}{"message": `level=info msg="hi there" n=1`, "level": "journal"},
+			map[string]interface{}{"message": `level=info msg="hi there" n=1`, "level": "journal", "msg": "hi there", "n": "1"},
+		},
+		{
+			true,
+			map[string]interface{}{"message": `level=info msg="hi there" n=1`, "level": "journal"},
+			map[string]interface{}{"message": "hi there", "level": "info", "n": "1"},
+		},
+		{
+			false,
+			map[string]interface{}{"message": `  a=  b=""  `},
+			map[string]interface{}{"message": `  a=  b=""  `, "a": "", "b": ""},
+		},
+	}
+
+	for _, test := range tests {
+		m := &types.LogMessage{Fields: test.fields}
+		NewLogfmt(test.promote).Transform(m)
+		if !reflect.DeepEqual(m.Fields, test.expected) {
+			t.Errorf("expected %v, got %v", test.expected, m.Fields)
+		}
+	}
+
+	// messages that aren't entirely key=value pairs are left alone
+	for _, message := range []string{
+		"hello world",
+		"GET /index.html a=b",
+		"a=b c",
+		`a="unterminated`,
+		`a="x"b=c`,
+		`a=x"y`,
+		`{"a":"b=c"}`,
+		"=b",
+		"",
+	} {
+		m := &types.LogMessage{Fields: map[string]interface{}{"message": message}}
+		NewLogfmt(true).Transform(m)
+		if len(m.Fields) != 1 || m.Fields["message"] != message {
+			t.Errorf("%s: expected message to be left alone, got %v", message, m.Fields)
+		}
+	}
+}
@@ -1,9 +1,25 @@
 package types
 
+import "fmt"
+
 type LogMessage struct {
 	Fields map[string]interface{}
 }
 
+// StringFields formats the message's fields as strings for matching filter
+// expressions against
+func (m *LogMessage) StringFields() map[string]string {
+	fields := make(map[string]string, len(m.Fields))
+	for k, v := range m.Fields {
+		if s, ok := v.(string); ok {
+			fields[k] = s
+		} else {
+			fields[k] = fmt.Sprint(v)
+		}
+	}
+	return fields
+}
+
 type Transformer interface {
 	Transform(m *LogMessage)
 }